@@ -0,0 +1,490 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type FsyncPolicy int
+
+const (
+	// FsyncAlways 每条写命令都在回复客户端之前刷盘
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySec 每条写命令都写入文件 后台每秒刷盘一次
+	FsyncEverySec
+	// FsyncNo 只写入文件 何时刷盘交给操作系统
+	FsyncNo
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return 0, errors.Errorf("invalid appendfsync '%s'", s)
+}
+
+type Options struct {
+	// Dir 为 AOF 目录的完整路径
+	Dir string
+	// Filename 为文件名前缀 例如 appendonly.aof
+	Filename string
+	Fsync    FsyncPolicy
+	// LoadTruncated 为 true 时 最后一个文件尾部不完整的命令会被截断而不是报错
+	LoadTruncated bool
+}
+
+// AOF 多文件(multi part)的追加日志
+// 由一个 base 文件(重写时生成的全量数据)加上若干 incr 文件(之后的增量写命令)组成
+// 文件列表记录在 manifest 中 manifest 通过 rename 原子更新 因此任何时刻崩溃都能恢复
+type AOF struct {
+	mu       sync.Mutex
+	opts     Options
+	manifest *manifest
+	// file 当前正在追加的 incr 文件
+	file      *os.File
+	needFsync bool
+	// rewriting 是否有重写正在进行
+	rewriting bool
+	// rewriteIncrs 重写开始时新建的 incr 文件在 manifest.incrs 中的下标
+	// 在它之前的 incr 文件都会被新的 base 覆盖
+	rewriteIncrs int
+	done         chan struct{}
+}
+
+func Open(opts Options) (*AOF, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	a := &AOF{
+		opts:     opts,
+		manifest: new(manifest),
+		done:     make(chan struct{}),
+	}
+
+	m, err := loadManifest(a.manifestPath())
+	if err == nil {
+		a.manifest = m
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *AOF) manifestName() string {
+	return a.opts.Filename + ".manifest"
+}
+
+func (a *AOF) manifestPath() string {
+	return filepath.Join(a.opts.Dir, a.manifestName())
+}
+
+func (a *AOF) path(name string) string {
+	return filepath.Join(a.opts.Dir, name)
+}
+
+// Exists 磁盘上是否已有 AOF
+func (a *AOF) Exists() bool {
+	return a.manifest.base != nil || len(a.manifest.incrs) > 0
+}
+
+// Load 按照 manifest 的顺序加载所有文件
+// loadBase 用于加载 rdb 格式的 base 文件 exec 用于重放每一条命令
+func (a *AOF) Load(loadBase func(r io.Reader) error, exec func(args []string) error) error {
+	if a.manifest.base != nil {
+		if err := a.loadFile(a.manifest.base.name, false, loadBase, exec); err != nil {
+			return err
+		}
+	}
+
+	for i, f := range a.manifest.incrs {
+		last := i == len(a.manifest.incrs)-1
+		if err := a.loadFile(f.name, last, loadBase, exec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *AOF) loadFile(name string, last bool, loadBase func(r io.Reader) error, exec func(args []string) error) error {
+	path := a.path(name)
+	f, err := os.Open(path)
+	if err != nil {
+		// 新建的 incr 文件可能还未写入任何内容就崩溃了
+		if os.IsNotExist(err) && !strings.HasSuffix(name, ".rdb") {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	// base 文件可能是 rdb 格式
+	if magic, err := r.Peek(5); err == nil && string(magic) == "REDIS" {
+		if err := loadBase(r); err != nil {
+			return errors.WithMessagef(err, "load AOF base file %s", name)
+		}
+		return nil
+	}
+
+	var offset int64
+	count := 0
+	for {
+		args, n, err := readCommand(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			if !last || !a.opts.LoadTruncated {
+				return errors.Errorf("unexpected end of file reading the append only file %s", name)
+			}
+			log.Printf("!!! Warning: short read while loading the AOF file %s!!!", name)
+			log.Printf("AOF %s loaded anyway because aof-load-truncated is enabled, truncating to offset %d", name, offset)
+			if err := os.Truncate(path, offset); err != nil {
+				return errors.WithStack(err)
+			}
+			break
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "bad file format reading the append only file %s", name)
+		}
+
+		if err := exec(args); err != nil {
+			return errors.WithMessagef(err, "replay '%s' from %s", strings.Join(args, " "), name)
+		}
+		offset += n
+		count++
+	}
+
+	log.Printf("DB loaded from incr file %s: %d commands", name, count)
+	return nil
+}
+
+// readCommand 读取一条 RESP 数组格式的命令 返回参数以及消耗的字节数
+// 文件在命令边界结束时返回 io.EOF 在命令中间结束时返回 io.ErrUnexpectedEOF
+func readCommand(r *bufio.Reader) ([]string, int64, error) {
+	var n int64
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		n += int64(len(line))
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasSuffix(line, "\r\n") {
+			return "", errors.New("expected CRLF")
+		}
+		return line[:len(line)-2], nil
+	}
+
+	line, err := readLine()
+	if err == io.EOF {
+		if n == 0 {
+			return nil, 0, io.EOF
+		}
+		return nil, n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, n, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, n, errors.Errorf("expected '*' but got '%s'", line)
+	}
+	argc, err := strconv.Atoi(line[1:])
+	if err != nil || argc < 1 {
+		return nil, n, errors.Errorf("invalid multibulk length '%s'", line)
+	}
+
+	args := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil, n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, n, errors.Errorf("expected '$' but got '%s'", line)
+		}
+		l, err := strconv.Atoi(line[1:])
+		if err != nil || l < 0 {
+			return nil, n, errors.Errorf("invalid bulk length '%s'", line)
+		}
+
+		buf := make([]byte, l+2)
+		m, err := io.ReadFull(r, buf)
+		n += int64(m)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		if buf[l] != '\r' || buf[l+1] != '\n' {
+			return nil, n, errors.New("expected CRLF after bulk")
+		}
+		args = append(args, string(buf[:l]))
+	}
+
+	return args, n, nil
+}
+
+// encodeCommand 编码为 RESP 数组
+func encodeCommand(args []string) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// Start 打开最新的 incr 文件用于追加 并启动后台刷盘
+// 必须在 Load 之后调用
+func (a *AOF) Start() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.manifest.incrs) == 0 {
+		if err := a.openNewIncr(); err != nil {
+			return err
+		}
+	} else {
+		name := a.manifest.incrs[len(a.manifest.incrs)-1].name
+		f, err := os.OpenFile(a.path(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		a.file = f
+	}
+
+	if a.opts.Fsync == FsyncEverySec {
+		go a.handleFsync()
+	}
+	return nil
+}
+
+// openNewIncr 新建 incr 文件 并将其写入 manifest
+// 外部必须持有锁
+func (a *AOF) openNewIncr() error {
+	seq := a.manifest.incrSeq() + 1
+	name := fmt.Sprintf("%s.%d.incr.aof", a.opts.Filename, seq)
+	f, err := os.OpenFile(a.path(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	a.manifest.incrs = append(a.manifest.incrs, &manifestFile{name: name, seq: seq, typ: typeIncr})
+	if err := a.manifest.persist(a.opts.Dir, a.manifestName()); err != nil {
+		a.manifest.incrs = a.manifest.incrs[:len(a.manifest.incrs)-1]
+		f.Close()
+		os.Remove(a.path(name))
+		return err
+	}
+
+	if a.file != nil {
+		a.file.Sync()
+		a.file.Close()
+	}
+	a.file = f
+	return nil
+}
+
+// Feed 追加一条已经成功执行的写命令
+// 调用方需保证调用顺序与命令的执行顺序一致
+func (a *AOF) Feed(args []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return
+	}
+
+	if _, err := a.file.Write(encodeCommand(args)); err != nil {
+		log.Printf("aof: error writing to the AOF file: %v", err)
+		return
+	}
+
+	switch a.opts.Fsync {
+	case FsyncAlways:
+		if err := a.file.Sync(); err != nil {
+			log.Printf("aof: can't persist AOF for fsync error: %v", err)
+		}
+	case FsyncEverySec:
+		a.needFsync = true
+	}
+}
+
+func (a *AOF) handleFsync() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		a.mu.Lock()
+		f, need := a.file, a.needFsync
+		a.needFsync = false
+		a.mu.Unlock()
+
+		// 刷盘在锁外进行 不阻塞写入
+		if need && f != nil {
+			f.Sync()
+		}
+	}
+}
+
+// Rewriting 是否有重写正在进行
+func (a *AOF) Rewriting() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rewriting
+}
+
+// BeginRewrite 切换到新的 incr 文件
+// 调用方必须保证切换与数据快照处于同一时刻(即期间没有写命令执行)
+// 这样旧的文件 + 快照之前的写命令 正好等于新的 base
+func (a *AOF) BeginRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriting {
+		return errors.New("ERR Background append only file rewriting already in progress")
+	}
+
+	if err := a.openNewIncr(); err != nil {
+		return err
+	}
+
+	a.rewriting = true
+	a.rewriteIncrs = len(a.manifest.incrs) - 1
+	return nil
+}
+
+// FinishRewrite 写出新的 base 文件 然后更新 manifest 并删除过时的文件
+// writeBase 负责把 BeginRewrite 时刻的数据集写入 w
+func (a *AOF) FinishRewrite(writeBase func(w io.Writer) error) error {
+	err := a.finishRewrite(writeBase)
+
+	a.mu.Lock()
+	a.rewriting = false
+	a.mu.Unlock()
+
+	return err
+}
+
+func (a *AOF) finishRewrite(writeBase func(w io.Writer) error) error {
+	tmp := a.path(fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	w := bufio.NewWriter(f)
+	if err := writeBase(w); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seq := a.manifest.baseSeq() + 1
+	name := fmt.Sprintf("%s.%d.base.rdb", a.opts.Filename, seq)
+	if err := os.Rename(tmp, a.path(name)); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+
+	// 旧的 base 以及被覆盖的 incr 标记为 history
+	old := a.manifest
+	next := &manifest{
+		base:  &manifestFile{name: name, seq: seq, typ: typeBase},
+		incrs: append([]*manifestFile(nil), old.incrs[a.rewriteIncrs:]...),
+	}
+	history := append([]*manifestFile(nil), old.history...)
+	if old.base != nil {
+		history = append(history, old.base)
+	}
+	history = append(history, old.incrs[:a.rewriteIncrs]...)
+
+	if err := next.persist(a.opts.Dir, a.manifestName()); err != nil {
+		os.Remove(a.path(name))
+		return err
+	}
+	a.manifest = next
+	a.rewriteIncrs = 0
+
+	// manifest 已经不再引用它们 删除失败也不影响正确性
+	for _, h := range history {
+		os.Remove(a.path(h.name))
+	}
+	return nil
+}
+
+// Close 刷盘并关闭当前文件
+func (a *AOF) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-a.done:
+		return nil
+	default:
+		close(a.done)
+	}
+
+	if a.file == nil {
+		return nil
+	}
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return errors.WithStack(err)
+	}
+	err := a.file.Close()
+	a.file = nil
+	return errors.WithStack(err)
+}
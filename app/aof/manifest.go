@@ -0,0 +1,167 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 文件类型
+const (
+	typeBase    = "b"
+	typeIncr    = "i"
+	typeHistory = "h"
+)
+
+type manifestFile struct {
+	name string
+	seq  int64
+	typ  string
+}
+
+// manifest 描述当前 AOF 由哪些文件组成
+// 格式与 redis 7 一致 每行一个文件:
+// file appendonly.aof.1.base.rdb seq 1 type b
+// file appendonly.aof.1.incr.aof seq 1 type i
+// 加载时按照 base -> incr(按 seq 递增) 的顺序重放
+type manifest struct {
+	base    *manifestFile
+	incrs   []*manifestFile
+	history []*manifestFile
+}
+
+func (m *manifest) baseSeq() int64 {
+	if m.base == nil {
+		return 0
+	}
+	return m.base.seq
+}
+
+func (m *manifest) incrSeq() int64 {
+	if len(m.incrs) == 0 {
+		return 0
+	}
+	return m.incrs[len(m.incrs)-1].seq
+}
+
+func (m *manifest) String() string {
+	var sb strings.Builder
+	files := make([]*manifestFile, 0, len(m.history)+len(m.incrs)+1)
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	files = append(files, m.history...)
+	files = append(files, m.incrs...)
+	for _, f := range files {
+		fmt.Fprintf(&sb, "file %s seq %d type %s\n", f.name, f.seq, f.typ)
+	}
+	return sb.String()
+}
+
+func loadManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	m := new(manifest)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, errors.Errorf("invalid AOF manifest line '%s'", line)
+		}
+		file := new(manifestFile)
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				file.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, errors.Errorf("invalid AOF manifest line '%s'", line)
+				}
+				file.seq = seq
+			case "type":
+				file.typ = fields[i+1]
+			}
+		}
+		if file.name == "" || file.seq <= 0 {
+			return nil, errors.Errorf("invalid AOF manifest line '%s'", line)
+		}
+
+		switch file.typ {
+		case typeBase:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file information in AOF manifest")
+			}
+			m.base = file
+		case typeIncr:
+			if len(m.incrs) > 0 && file.seq <= m.incrSeq() {
+				return nil, errors.New("found a non-monotonic sequence number in AOF manifest")
+			}
+			m.incrs = append(m.incrs, file)
+		case typeHistory:
+			m.history = append(m.history, file)
+		default:
+			return nil, errors.Errorf("unknown AOF file type '%s'", file.typ)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return m, nil
+}
+
+// persist 先写临时文件再重命名 保证 manifest 始终完整
+func (m *manifest) persist(dir, name string) error {
+	tmp := filepath.Join(dir, "temp-"+name)
+	if err := writeFileSync(tmp, []byte(m.String())); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	return syncDir(dir)
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// syncDir 刷新目录项 确保 rename 在崩溃后依然可见
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer d.Close()
+	// 部分文件系统不支持对目录 fsync 忽略该错误
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,183 @@
+package clock
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock 时间来源
+// 存储中所有的时间(过期、阻塞超时、stream ID、后台任务的定时器与时间预算)都经过它
+// 测试时替换为 Fake 可以手动推进时间 不需要真正等待
+type Clock interface {
+	Now() time.Time
+	// Since 与 time.Since 相同
+	Since(t time.Time) time.Duration
+	// After 与 time.After 相同
+	After(d time.Duration) <-chan time.Time
+	// NewTicker 与 time.NewTicker 相同
+	NewTicker(d time.Duration) Ticker
+	// Sleep 与 time.Sleep 相同
+	Sleep(d time.Duration)
+}
+
+// Ticker 与 time.Ticker 相同 接收方来不及处理时丢弃多余的 tick
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// System 使用系统时间
+type System struct{}
+
+func (System) Now() time.Time {
+	return time.Now()
+}
+
+func (System) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (System) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (System) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (System) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
+
+// fakeTimer period 不为 0 时是 ticker 每次到期后重新计时
+type fakeTimer struct {
+	when   time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// Fake 只有调用 Advance/Set/Sleep 时才会前进的时钟 可以被并发使用
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake 创建一个停在 now 的时钟
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// After 返回的 channel 在时钟被推进到 now+d 时收到当时的时间
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.timers = append(f.timers, &fakeTimer{when: f.now.Add(d), ch: ch})
+	return ch
+}
+
+// NewTicker 时钟每被推进 d 触发一次 一次推进跨过多个周期时与 time.Ticker 一样只保留一个 tick
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	timer := &fakeTimer{when: f.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	f.timers = append(f.timers, timer)
+	return &fakeTicker{f: f, timer: timer}
+}
+
+type fakeTicker struct {
+	f     *Fake
+	timer *fakeTimer
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.timer.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	t.f.timers = slices.DeleteFunc(t.f.timers, func(timer *fakeTimer) bool {
+		return timer == t.timer
+	})
+}
+
+// Sleep 直接推进时钟 不会阻塞
+func (f *Fake) Sleep(d time.Duration) {
+	f.Advance(d)
+}
+
+// Advance 将时钟推进 d 并触发所有到期的定时器
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	now := f.now.Add(d)
+	f.mu.Unlock()
+	f.Set(now)
+}
+
+// Set 将时钟设置为 t 并按到期顺序触发所有到期的定时器 不能回拨
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if t.Before(f.now) {
+		return
+	}
+	f.now = t
+
+	sort.Slice(f.timers, func(i, j int) bool {
+		return f.timers[i].when.Before(f.timers[j].when)
+	})
+	for _, timer := range f.timers {
+		if timer.when.After(t) {
+			break
+		}
+		if timer.period == 0 {
+			timer.ch <- timer.when
+			continue
+		}
+		select {
+		case timer.ch <- timer.when:
+		default:
+		}
+		timer.when = timer.when.Add((t.Sub(timer.when)/timer.period + 1) * timer.period)
+	}
+	// 重新计时的 ticker 仍然留在列表中 下一次 Set 时重新排序
+	f.timers = slices.DeleteFunc(f.timers, func(timer *fakeTimer) bool {
+		return timer.period == 0 && !timer.when.After(t)
+	})
+}
@@ -15,59 +15,245 @@ const (
 	// TCODE 用于临时测试某个resp协议编码
 	TCODE command = "TCODE"
 
-	PING   command = "PING"
-	ECHO   command = "ECHO"
-	SET    command = "SET"
-	GET    command = "GET"
-	LPUSH  command = "LPUSH"
-	RPUSH  command = "RPUSH"
-	LRANGE command = "LRANGE"
-	LLEN   command = "LLEN"
-	LPOP   command = "LPOP"
-	BLPOP  command = "BLPOP"
-	TYPE   command = "TYPE"
-	XADD   command = "XADD"
-	XRANGE command = "XRANGE"
-	XREAD  command = "XREAD"
+	PING    command = "PING"
+	ECHO    command = "ECHO"
+	SET     command = "SET"
+	GET     command = "GET"
+	LPUSH   command = "LPUSH"
+	RPUSH   command = "RPUSH"
+	LRANGE  command = "LRANGE"
+	LLEN    command = "LLEN"
+	LPOP    command = "LPOP"
+	BLPOP   command = "BLPOP"
+	RPOP    command = "RPOP"
+	LPUSHX  command = "LPUSHX"
+	RPUSHX  command = "RPUSHX"
+	LINDEX  command = "LINDEX"
+	LSET    command = "LSET"
+	LINSERT command = "LINSERT"
+	LREM    command = "LREM"
+	LTRIM   command = "LTRIM"
+	LPOS    command = "LPOS"
+	BRPOP   command = "BRPOP"
+	LMPOP   command = "LMPOP"
+	BLMPOP  command = "BLMPOP"
+	TYPE    command = "TYPE"
+	XADD    command = "XADD"
+	XRANGE  command = "XRANGE"
+	XREAD   command = "XREAD"
+	XTRIM   command = "XTRIM"
+
+	LMOVE      command = "LMOVE"
+	BLMOVE     command = "BLMOVE"
+	RPOPLPUSH  command = "RPOPLPUSH"
+	BRPOPLPUSH command = "BRPOPLPUSH"
+
+	XGROUP     command = "XGROUP"
+	XREADGROUP command = "XREADGROUP"
+	XACK       command = "XACK"
+	XPENDING   command = "XPENDING"
+	XCLAIM     command = "XCLAIM"
+	XAUTOCLAIM command = "XAUTOCLAIM"
+
+	SAVE     command = "SAVE"
+	BGSAVE   command = "BGSAVE"
+	LASTSAVE command = "LASTSAVE"
+
+	BGREWRITEAOF command = "BGREWRITEAOF"
+
+	DUMP    command = "DUMP"
+	RESTORE command = "RESTORE"
+	MIGRATE command = "MIGRATE"
+
+	DEL      command = "DEL"
+	UNLINK   command = "UNLINK"
+	EXISTS   command = "EXISTS"
+	TOUCH    command = "TOUCH"
+	RENAME   command = "RENAME"
+	RENAMENX command = "RENAMENX"
+	COPY     command = "COPY"
+	KEYS     command = "KEYS"
+	SCAN     command = "SCAN"
+
+	EXPIRE      command = "EXPIRE"
+	PEXPIRE     command = "PEXPIRE"
+	EXPIREAT    command = "EXPIREAT"
+	PEXPIREAT   command = "PEXPIREAT"
+	TTL         command = "TTL"
+	PTTL        command = "PTTL"
+	EXPIRETIME  command = "EXPIRETIME"
+	PEXPIRETIME command = "PEXPIRETIME"
+	PERSIST     command = "PERSIST"
+
+	INFO   command = "INFO"
+	DEBUG  command = "DEBUG"
+	OBJECT command = "OBJECT"
+	MEMORY command = "MEMORY"
+	CLIENT command = "CLIENT"
+
+	SELECT    command = "SELECT"
+	MOVE      command = "MOVE"
+	SWAPDB    command = "SWAPDB"
+	DBSIZE    command = "DBSIZE"
+	FLUSHDB   command = "FLUSHDB"
+	FLUSHALL  command = "FLUSHALL"
+	RANDOMKEY command = "RANDOMKEY"
 )
 
-type handlers map[command]func(args []*protocol.Value) (*protocol.Value, error)
+// denyOOM 可能增加内存占用的命令 与 redis 的 CMD_DENYOOM 标记对应
+// 执行前先按 maxmemory-policy 淘汰 key 内存仍然超出 maxmemory 时拒绝执行
+var denyOOM = map[command]bool{
+	SET:     true,
+	LPUSH:   true,
+	RPUSH:   true,
+	LPUSHX:  true,
+	RPUSHX:  true,
+	LSET:    true,
+	LINSERT: true,
+	LMOVE:   true,
+	BLMOVE:  true,
+	XADD:    true,
+	RESTORE: true,
+	COPY:    true,
+
+	RPOPLPUSH:  true,
+	BRPOPLPUSH: true,
+	XGROUP:     true,
+}
 
-func NewHandler() handlers {
-	store := store.NewKVStore()
+type handlers map[command]func(c *store.Client, args []*protocol.Value) (*protocol.Value, error)
 
+func NewHandler(store *store.KVStore) handlers {
 	return handlers{
-		TCODE:  handleTCODE,
-		PING:   handlePING,
-		ECHO:   handleECHO,
-		SET:    store.HandleSET,
-		GET:    store.HandleGET,
-		LPUSH:  store.HandleLPUSH,
-		RPUSH:  store.HandleRPUSH,
-		LRANGE: store.HandleLRANGE,
-		LLEN:   store.HandleLLEN,
-		LPOP:   store.HandleLPOP,
-		BLPOP:  store.HandleBLPOP,
-		TYPE:   store.HandleTYPE,
-		XADD:   store.HandleXADD,
-		XRANGE: store.HandleXRANGE,
-		XREAD:  store.HandleXREAD,
+		TCODE:   handleTCODE,
+		PING:    handlePING,
+		ECHO:    handleECHO,
+		SET:     store.HandleSET,
+		GET:     store.HandleGET,
+		LPUSH:   store.HandleLPUSH,
+		RPUSH:   store.HandleRPUSH,
+		LRANGE:  store.HandleLRANGE,
+		LLEN:    store.HandleLLEN,
+		LPOP:    store.HandleLPOP,
+		BLPOP:   store.HandleBLPOP,
+		RPOP:    store.HandleRPOP,
+		LPUSHX:  store.HandleLPUSHX,
+		RPUSHX:  store.HandleRPUSHX,
+		LINDEX:  store.HandleLINDEX,
+		LSET:    store.HandleLSET,
+		LINSERT: store.HandleLINSERT,
+		LREM:    store.HandleLREM,
+		LTRIM:   store.HandleLTRIM,
+		LPOS:    store.HandleLPOS,
+		BRPOP:   store.HandleBRPOP,
+		LMPOP:   store.HandleLMPOP,
+		BLMPOP:  store.HandleBLMPOP,
+		TYPE:    store.HandleTYPE,
+		XADD:    store.HandleXADD,
+		XRANGE:  store.HandleXRANGE,
+		XREAD:   store.HandleXREAD,
+		XTRIM:   store.HandleXTRIM,
+
+		LMOVE:      store.HandleLMOVE,
+		BLMOVE:     store.HandleBLMOVE,
+		RPOPLPUSH:  store.HandleRPOPLPUSH,
+		BRPOPLPUSH: store.HandleBRPOPLPUSH,
+
+		XGROUP:     store.HandleXGROUP,
+		XREADGROUP: store.HandleXREADGROUP,
+		XACK:       store.HandleXACK,
+		XPENDING:   store.HandleXPENDING,
+		XCLAIM:     store.HandleXCLAIM,
+		XAUTOCLAIM: store.HandleXAUTOCLAIM,
+
+		SAVE:     store.HandleSAVE,
+		BGSAVE:   store.HandleBGSAVE,
+		LASTSAVE: store.HandleLASTSAVE,
+
+		BGREWRITEAOF: store.HandleBGREWRITEAOF,
+
+		DUMP:    store.HandleDUMP,
+		RESTORE: store.HandleRESTORE,
+		MIGRATE: store.HandleMIGRATE,
+
+		DEL:      store.HandleDEL,
+		UNLINK:   store.HandleUNLINK,
+		EXISTS:   store.HandleEXISTS,
+		TOUCH:    store.HandleTOUCH,
+		RENAME:   store.HandleRENAME,
+		RENAMENX: store.HandleRENAMENX,
+		COPY:     store.HandleCOPY,
+		KEYS:     store.HandleKEYS,
+		SCAN:     store.HandleSCAN,
+
+		EXPIRE:      store.HandleEXPIRE,
+		PEXPIRE:     store.HandlePEXPIRE,
+		EXPIREAT:    store.HandleEXPIREAT,
+		PEXPIREAT:   store.HandlePEXPIREAT,
+		TTL:         store.HandleTTL,
+		PTTL:        store.HandlePTTL,
+		EXPIRETIME:  store.HandleEXPIRETIME,
+		PEXPIRETIME: store.HandlePEXPIRETIME,
+		PERSIST:     store.HandlePERSIST,
+
+		INFO:   store.HandleINFO,
+		DEBUG:  store.HandleDEBUG,
+		OBJECT: store.HandleOBJECT,
+		MEMORY: store.HandleMEMORY,
+		CLIENT: store.HandleCLIENT,
+
+		SELECT:    store.HandleSELECT,
+		MOVE:      store.HandleMOVE,
+		SWAPDB:    store.HandleSWAPDB,
+		DBSIZE:    store.HandleDBSIZE,
+		FLUSHDB:   store.HandleFLUSHDB,
+		FLUSHALL:  store.HandleFLUSHALL,
+		RANDOMKEY: store.HandleRANDOMKEY,
+	}
+}
+
+func (h handlers) Handle(c *store.Client, cmd string, args []*protocol.Value) (*protocol.Value, error) {
+	if denyOOM[command(strings.ToUpper(cmd))] {
+		if err := c.PerformEvictions(); err != nil {
+			return nil, err
+		}
 	}
+	return h.dispatch(c, cmd, args)
 }
 
-func (h handlers) Handle(cmd string, args []*protocol.Value) (*protocol.Value, error) {
+// dispatch 查找并执行命令
+func (h handlers) dispatch(c *store.Client, cmd string, args []*protocol.Value) (*protocol.Value, error) {
 	// 规范命令
-	c := command(strings.ToUpper(cmd))
+	name := command(strings.ToUpper(cmd))
 
-	handler, ok := h[c]
+	handler, ok := h[name]
 	if !ok {
 		return nil, fmt.Errorf("unknown command '%q'", cmd)
 	}
 
-	return handler(args)
+	return handler(c, args)
+}
+
+// Replay 用于加载 AOF 时重放一条命令
+func (h handlers) Replay(c *store.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	values := make([]*protocol.Value, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		values = append(values, new(protocol.Value).SetBulk(arg))
+	}
+
+	// 与 redis 一致 加载数据时不受 maxmemory 限制
+	res, err := h.dispatch(c, args[0], values)
+	if err != nil {
+		return err
+	}
+	return res.Error()
 }
 
-func handlePING(args []*protocol.Value) (*protocol.Value, error) {
+func handlePING(_ *store.Client, args []*protocol.Value) (*protocol.Value, error) {
 	switch len(args) {
 	case 0:
 		return new(protocol.Value).SetStr("PONG"), nil
@@ -78,7 +264,7 @@ func handlePING(args []*protocol.Value) (*protocol.Value, error) {
 	}
 }
 
-func handleECHO(args []*protocol.Value) (*protocol.Value, error) {
+func handleECHO(_ *store.Client, args []*protocol.Value) (*protocol.Value, error) {
 	if len(args) != 1 {
 		return nil, errors.New("ERR wrong number of arguments for 'echo' command")
 	}
@@ -86,7 +272,7 @@ func handleECHO(args []*protocol.Value) (*protocol.Value, error) {
 	return new(protocol.Value).SetBulk(args[0].Bulk()), nil
 }
 
-func handleTCODE(args []*protocol.Value) (*protocol.Value, error) {
+func handleTCODE(_ *store.Client, args []*protocol.Value) (*protocol.Value, error) {
 	magicDouble := 3.14159
 	return new(protocol.Value).SetDouble(magicDouble), nil
 }
@@ -0,0 +1,301 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SaveParam 自动快照规则
+// 距离上次保存超过 Seconds 秒且至少发生了 Changes 次修改时触发 BGSAVE
+type SaveParam struct {
+	Seconds int
+	Changes int
+}
+
+type Config struct {
+	Port           int
+	Dir            string
+	DBFilename     string
+	SaveParams     []SaveParam
+	RDBCompression bool
+	RDBChecksum    bool
+
+	AppendOnly       bool
+	AppendFsync      string
+	AppendFilename   string
+	AppendDirname    string
+	AOFLoadTruncated bool
+
+	// Hz 每秒执行后台任务(主动过期等)的次数
+	Hz int
+	// Databases 逻辑数据库的数量
+	Databases int
+	// ExecutionMode 命令的执行方式
+	// locked 每个连接在自己的 goroutine 中执行命令 通过分片锁同步
+	// eventloop 所有命令交给同一个 goroutine 串行执行 与 redis 的线程模型一致
+	ExecutionMode string
+
+	// MaxMemory 内存上限(字节) 为 0 表示不限制
+	MaxMemory int64
+	// MaxMemoryPolicy 超出内存上限时的淘汰策略
+	MaxMemoryPolicy string
+	// MaxMemorySamples 每次淘汰时在每个数据库中采样的 key 的数量
+	MaxMemorySamples int
+	// LFULogFactor LFU 对数计数器的增长因子 越大计数器增长越慢
+	LFULogFactor int
+	// LFUDecayTime LFU 计数器每经过多少分钟衰减一次 为 0 表示不衰减
+	LFUDecayTime int
+	// ListMaxListpackSize 列表 quicklist 单个节点的大小 正数为元素数量上限 -1 到 -5 为 4KB 到 64KB 的字节数上限
+	ListMaxListpackSize int
+	// ListCompressDepth 列表两端不压缩的节点数 0 表示不压缩
+	ListCompressDepth int
+}
+
+// Default 与 redis.conf 默认值保持一致
+func Default() *Config {
+	return &Config{
+		Port:       6379,
+		Dir:        ".",
+		DBFilename: "dump.rdb",
+		SaveParams: []SaveParam{
+			{Seconds: 3600, Changes: 1},
+			{Seconds: 300, Changes: 100},
+			{Seconds: 60, Changes: 10000},
+		},
+		RDBCompression: true,
+		RDBChecksum:    true,
+
+		AppendOnly:       false,
+		AppendFsync:      "everysec",
+		AppendFilename:   "appendonly.aof",
+		AppendDirname:    "appendonlydir",
+		AOFLoadTruncated: true,
+
+		Hz:            10,
+		Databases:     16,
+		ExecutionMode: "locked",
+
+		MaxMemory:        0,
+		MaxMemoryPolicy:  "noeviction",
+		MaxMemorySamples: 5,
+		LFULogFactor:     10,
+		LFUDecayTime:     1,
+
+		ListMaxListpackSize: -2,
+		ListCompressDepth:   0,
+	}
+}
+
+// Parse 解析 redis-server 风格的命令行参数
+// 例如: --port 6380 --dir /tmp --dbfilename dump.rdb --save "60 1000 300 10"
+func Parse(args []string) (*Config, error) {
+	cfg := Default()
+
+	for i := 0; i < len(args); i++ {
+		name := args[i]
+		if !strings.HasPrefix(name, "--") {
+			return nil, errors.Errorf("unexpected argument '%s'", name)
+		}
+		if i+1 >= len(args) {
+			return nil, errors.Errorf("missing value for '%s'", name)
+		}
+		i++
+		if err := cfg.Set(strings.TrimPrefix(name, "--"), args[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// Set 按照配置项名称设置值
+func (c *Config) Set(name, value string) error {
+	switch strings.ToLower(name) {
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return errors.Errorf("invalid port '%s'", value)
+		}
+		c.Port = port
+	case "dir":
+		c.Dir = value
+	case "dbfilename":
+		c.DBFilename = value
+	case "save":
+		params, err := parseSaveParams(value)
+		if err != nil {
+			return err
+		}
+		c.SaveParams = params
+	case "rdbcompression":
+		b, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		c.RDBCompression = b
+	case "rdbchecksum":
+		b, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		c.RDBChecksum = b
+	case "appendonly":
+		b, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		c.AppendOnly = b
+	case "appendfsync":
+		switch strings.ToLower(value) {
+		case "always", "everysec", "no":
+			c.AppendFsync = strings.ToLower(value)
+		default:
+			return errors.Errorf("invalid appendfsync '%s'", value)
+		}
+	case "appendfilename":
+		if value == "" || strings.ContainsRune(value, '/') {
+			return errors.Errorf("appendfilename can't be a path, just a filename")
+		}
+		c.AppendFilename = value
+	case "appenddirname":
+		if value == "" || strings.ContainsRune(value, '/') {
+			return errors.Errorf("appenddirname can't be a path, just a dirname")
+		}
+		c.AppendDirname = value
+	case "aof-load-truncated":
+		b, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		c.AOFLoadTruncated = b
+	case "hz":
+		hz, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.Errorf("invalid hz '%s'", value)
+		}
+		// 与 redis 一致 超出范围时截断到 [1, 500]
+		c.Hz = min(max(hz, 1), 500)
+	case "databases":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return errors.Errorf("invalid number of databases '%s'", value)
+		}
+		c.Databases = n
+	case "execution-mode":
+		switch strings.ToLower(value) {
+		case "locked", "eventloop":
+			c.ExecutionMode = strings.ToLower(value)
+		default:
+			return errors.Errorf("invalid execution-mode '%s'", value)
+		}
+	case "maxmemory":
+		n, err := parseMemory(value)
+		if err != nil {
+			return err
+		}
+		c.MaxMemory = n
+	case "maxmemory-policy":
+		switch strings.ToLower(value) {
+		case "noeviction",
+			"allkeys-lru", "allkeys-lfu", "allkeys-random",
+			"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl":
+			c.MaxMemoryPolicy = strings.ToLower(value)
+		default:
+			return errors.Errorf("invalid maxmemory-policy '%s'", value)
+		}
+	case "maxmemory-samples":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 64 {
+			return errors.Errorf("invalid maxmemory-samples '%s'", value)
+		}
+		c.MaxMemorySamples = n
+	case "lfu-log-factor":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.Errorf("invalid lfu-log-factor '%s'", value)
+		}
+		c.LFULogFactor = n
+	case "lfu-decay-time":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.Errorf("invalid lfu-decay-time '%s'", value)
+		}
+		c.LFUDecayTime = n
+	case "list-max-listpack-size", "list-max-ziplist-size":
+		// list-max-ziplist-size 是 redis 7.0 之前的名称 作为别名保留
+		n, err := strconv.Atoi(value)
+		if err != nil || n < -5 || n == 0 {
+			return errors.Errorf("invalid list-max-listpack-size '%s'", value)
+		}
+		c.ListMaxListpackSize = n
+	case "list-compress-depth":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.Errorf("invalid list-compress-depth '%s'", value)
+		}
+		c.ListCompressDepth = n
+	default:
+		return errors.Errorf("unknown config '%s'", name)
+	}
+	return nil
+}
+
+// parseSaveParams "<seconds> <changes> [<seconds> <changes> ...]"
+// 空字符串表示关闭自动快照
+func parseSaveParams(value string) ([]SaveParam, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, errors.Errorf("invalid save parameters '%s'", value)
+	}
+
+	params := make([]SaveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, errors.Errorf("invalid save parameters '%s'", value)
+		}
+		params = append(params, SaveParam{Seconds: seconds, Changes: changes})
+	}
+	return params, nil
+}
+
+// parseMemory 解析带单位的内存大小 与 redis.conf 一致
+// k/m/g 以 1000 为进制 kb/mb/gb 以 1024 为进制 不区分大小写
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			mul = u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid memory size '%s'", value)
+	}
+	return n * mul, nil
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.Errorf("argument must be 'yes' or 'no' but got '%s'", value)
+}
@@ -1,6 +1,7 @@
 package connection
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/codecrafters-io/redis-starter-go/app/command"
 	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
 	"github.com/pkg/errors"
 )
 
@@ -35,24 +37,36 @@ func isNormalDisconnect(err error) bool {
 		strings.Contains(msg, "connection reset by peer")
 }
 
-func Handle(conn net.Conn) {
+// hasErrorCode 错误信息是否已经以错误码开头(如 ERR、WRONGTYPE)
+// 已带错误码的错误原样返回 避免出现 "ERR ERR ..."
+func hasErrorCode(msg string) bool {
+	code, _, ok := strings.Cut(msg, " ")
+	if !ok || code == "" {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Handle 处理一个连接 直到连接断开
+// 请求由单独的 goroutine 读取 命令阻塞时仍然能发现连接已经断开
+// 断开时取消客户端的 context 阻塞中的命令随之返回 不会再有数据交给已经断开的客户端
+func Handle(conn net.Conn, kv *store.KVStore) {
 	defer conn.Close()
-	remote := conn.RemoteAddr()
 
-	resp := protocol.NewResp(conn)
-	writer := protocol.NewWriter(conn)
-	handler := command.NewHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	for {
-		value, err := resp.Read()
-		if err != nil {
-			if isNormalDisconnect(err) {
-				return
-			}
-			log.Printf("[conn %s] read error: %v", remote, err)
-			return
-		}
+	writer := protocol.NewWriter(conn)
+	handler := command.NewHandler(kv)
+	client := kv.Connect(ctx, conn.RemoteAddr().String())
+	defer client.Close()
 
+	for value := range readRequests(ctx, cancel, conn, kv) {
 		// 检查是否是数组类型 (Redis 命令都是数组格式)
 		if value.Array() == nil {
 			log.Println("Invalid command format: expected array")
@@ -71,11 +85,19 @@ func Handle(conn net.Conn) {
 		// 获取命令参数
 		args := value.Array()[1:]
 
-		response, err := handler.Handle(cmd, args)
+		response, err := kv.Execute(client, func() (*protocol.Value, error) {
+			return handler.Handle(client, cmd, args)
+		})
+		if errors.Is(err, context.Canceled) {
+			// 阻塞中的命令因为连接断开而返回 没有需要回复的内容
+			return
+		}
 		if err != nil {
 			// 优先写入被指定错误
 			if resErr := response.Error(); resErr != nil {
 				response = new(protocol.Value).SetError(resErr.Error())
+			} else if hasErrorCode(err.Error()) {
+				response = new(protocol.Value).SetError(err.Error())
 			} else {
 				response = new(protocol.Value).SetError(fmt.Sprintf("ERR %v", err))
 			}
@@ -85,3 +107,38 @@ func Handle(conn net.Conn) {
 		log.Printf("resp: %+v", *response)
 	}
 }
+
+// readRequests 在单独的 goroutine 中依次读取请求
+// 读取出错(包括连接断开)时调用 cancel 并关闭返回的 channel
+func readRequests(ctx context.Context, cancel context.CancelFunc, conn net.Conn, kv *store.KVStore) <-chan *protocol.Value {
+	remote := conn.RemoteAddr()
+	resp := protocol.NewResp(conn)
+	requests := make(chan *protocol.Value)
+
+	go func() {
+		defer close(requests)
+		defer cancel()
+
+		for {
+			// 缓冲区中没有未处理的命令 即将阻塞等待网络数据
+			if resp.Buffered() == 0 {
+				kv.BeforeSleep()
+			}
+
+			value, err := resp.Read()
+			if err != nil {
+				if !isNormalDisconnect(err) {
+					log.Printf("[conn %s] read error: %v", remote, err)
+				}
+				return
+			}
+
+			select {
+			case requests <- value:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return requests
+}
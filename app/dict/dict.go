@@ -0,0 +1,363 @@
+package dict
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// initialSize 哈希表的最小桶数 必须是 2 的幂
+	initialSize = 4
+	// minFillPercent 元素数量低于桶数的该百分比时缩容
+	minFillPercent = 10
+	// rehashEmptyVisits 每次渐进式 rehash 最多访问的空桶数 避免单步耗时过长
+	rehashEmptyVisits = 10
+)
+
+type entry[V any] struct {
+	key  string
+	val  V
+	next *entry[V]
+}
+
+type table[V any] struct {
+	buckets []*entry[V]
+	used    int
+}
+
+func (t *table[V]) mask() uint64 {
+	return uint64(len(t.buckets) - 1)
+}
+
+// Dict 与 redis 的 dict 对应的链式哈希表
+// 桶数始终为 2 的幂 扩缩容时通过渐进式 rehash 把元素从 ht[0] 搬到 ht[1]
+// 相比 Go 的 map 它可以提供稳定的游标遍历(见 Scan)
+// Dict 不是并发安全的 由调用方加锁
+type Dict[V any] struct {
+	ht   [2]table[V]
+	seed maphash.Seed
+	// rehashIdx 为 -1 表示没有在 rehash 否则为 ht[0] 中下一个要搬迁的桶
+	rehashIdx int
+}
+
+func New[V any]() *Dict[V] {
+	return &Dict[V]{seed: maphash.MakeSeed(), rehashIdx: -1}
+}
+
+func (d *Dict[V]) hash(key string) uint64 {
+	return maphash.String(d.seed, key)
+}
+
+func (d *Dict[V]) rehashing() bool {
+	return d.rehashIdx != -1
+}
+
+// Rehashing 是否正在进行渐进式 rehash
+func (d *Dict[V]) Rehashing() bool {
+	return d.rehashing()
+}
+
+// Len 元素数量
+func (d *Dict[V]) Len() int {
+	return d.ht[0].used + d.ht[1].used
+}
+
+// Buckets 两张表的桶数之和
+func (d *Dict[V]) Buckets() int {
+	return len(d.ht[0].buckets) + len(d.ht[1].buckets)
+}
+
+func (d *Dict[V]) find(key string) *entry[V] {
+	if d.Len() == 0 {
+		return nil
+	}
+	h := d.hash(key)
+	for i := range d.ht {
+		t := &d.ht[i]
+		if len(t.buckets) == 0 {
+			continue
+		}
+		for e := t.buckets[h&t.mask()]; e != nil; e = e.next {
+			if e.key == key {
+				return e
+			}
+		}
+		if !d.rehashing() {
+			break
+		}
+	}
+	return nil
+}
+
+// Get 查找 key 不会触发 rehash 持有读锁时也可以调用
+func (d *Dict[V]) Get(key string) (V, bool) {
+	if e := d.find(key); e != nil {
+		return e.val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Set 插入或覆盖 返回 key 之前是否不存在
+func (d *Dict[V]) Set(key string, val V) bool {
+	d.rehashStep()
+
+	if e := d.find(key); e != nil {
+		e.val = val
+		return false
+	}
+
+	d.expandIfNeeded()
+
+	// rehash 期间新元素直接写入 ht[1]
+	t := &d.ht[0]
+	if d.rehashing() {
+		t = &d.ht[1]
+	}
+	idx := d.hash(key) & t.mask()
+	t.buckets[idx] = &entry[V]{key: key, val: val, next: t.buckets[idx]}
+	t.used++
+	return true
+}
+
+// Delete 删除 key 返回 key 是否存在
+func (d *Dict[V]) Delete(key string) bool {
+	if d.Len() == 0 {
+		return false
+	}
+	d.rehashStep()
+
+	h := d.hash(key)
+	for i := range d.ht {
+		t := &d.ht[i]
+		if len(t.buckets) == 0 {
+			continue
+		}
+		idx := h & t.mask()
+		var prev *entry[V]
+		for e := t.buckets[idx]; e != nil; prev, e = e, e.next {
+			if e.key != key {
+				continue
+			}
+			if prev == nil {
+				t.buckets[idx] = e.next
+			} else {
+				prev.next = e.next
+			}
+			t.used--
+			d.shrinkIfNeeded()
+			return true
+		}
+		if !d.rehashing() {
+			break
+		}
+	}
+	return false
+}
+
+// Range 遍历所有元素 fn 返回 false 时停止
+// 遍历期间不能修改 Dict
+func (d *Dict[V]) Range(fn func(key string, val V) bool) {
+	for i := range d.ht {
+		for _, e := range d.ht[i].buckets {
+			for ; e != nil; e = e.next {
+				if !fn(e.key, e.val) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// RandomKey 随机返回一个元素 与 redis 的 dictGetRandomKey 一致
+// 先随机选择一个非空桶 再在桶的链表中随机选择 链表长度不同会带来一定的偏差
+func (d *Dict[V]) RandomKey() (string, V, bool) {
+	if d.Len() == 0 {
+		var zero V
+		return "", zero, false
+	}
+
+	var e *entry[V]
+	for e == nil {
+		if d.rehashing() {
+			// ht[0] 中 rehashIdx 之前的桶已经搬空 不需要考虑
+			s0 := len(d.ht[0].buckets)
+			i := d.rehashIdx + rand.IntN(s0+len(d.ht[1].buckets)-d.rehashIdx)
+			if i >= s0 {
+				e = d.ht[1].buckets[i-s0]
+			} else {
+				e = d.ht[0].buckets[i]
+			}
+		} else {
+			e = d.ht[0].buckets[rand.IntN(len(d.ht[0].buckets))]
+		}
+	}
+
+	n := 0
+	for p := e; p != nil; p = p.next {
+		n++
+	}
+	for i := rand.IntN(n); i > 0; i-- {
+		e = e.next
+	}
+	return e.key, e.val, true
+}
+
+// Clear 清空所有元素
+func (d *Dict[V]) Clear() {
+	d.ht = [2]table[V]{}
+	d.rehashIdx = -1
+}
+
+func nextPower(size int) int {
+	n := initialSize
+	for n < size {
+		n <<= 1
+	}
+	return n
+}
+
+// resize 创建新表并开始渐进式 rehash
+func (d *Dict[V]) resize(size int) {
+	size = nextPower(size)
+	if size == len(d.ht[0].buckets) {
+		return
+	}
+
+	t := table[V]{buckets: make([]*entry[V], size)}
+	if len(d.ht[0].buckets) == 0 {
+		d.ht[0] = t
+		return
+	}
+	d.ht[1] = t
+	d.rehashIdx = 0
+}
+
+// expandIfNeeded 元素数量达到桶数时扩容为两倍
+func (d *Dict[V]) expandIfNeeded() {
+	if d.rehashing() {
+		return
+	}
+	if len(d.ht[0].buckets) == 0 {
+		d.resize(initialSize)
+		return
+	}
+	if d.ht[0].used >= len(d.ht[0].buckets) {
+		d.resize(d.ht[0].used + 1)
+	}
+}
+
+// shrinkIfNeeded 填充率过低时缩容
+func (d *Dict[V]) shrinkIfNeeded() {
+	if d.rehashing() {
+		return
+	}
+	size := len(d.ht[0].buckets)
+	if size > initialSize && d.ht[0].used*100 < size*minFillPercent {
+		d.resize(d.ht[0].used)
+	}
+}
+
+// rehash 搬迁 n 个桶 返回是否还有剩余的桶需要搬迁
+func (d *Dict[V]) rehash(n int) bool {
+	if !d.rehashing() {
+		return false
+	}
+
+	emptyVisits := n * rehashEmptyVisits
+	src, dst := &d.ht[0], &d.ht[1]
+	for ; n > 0 && src.used > 0; n-- {
+		for src.buckets[d.rehashIdx] == nil {
+			d.rehashIdx++
+			if emptyVisits--; emptyVisits == 0 {
+				return true
+			}
+		}
+		for e := src.buckets[d.rehashIdx]; e != nil; {
+			next := e.next
+			idx := d.hash(e.key) & dst.mask()
+			e.next = dst.buckets[idx]
+			dst.buckets[idx] = e
+			src.used--
+			dst.used++
+			e = next
+		}
+		src.buckets[d.rehashIdx] = nil
+		d.rehashIdx++
+	}
+
+	if src.used == 0 {
+		d.ht[0] = d.ht[1]
+		d.ht[1] = table[V]{}
+		d.rehashIdx = -1
+		return false
+	}
+	return true
+}
+
+func (d *Dict[V]) rehashStep() {
+	d.rehash(1)
+}
+
+// RehashFor 在给定时间内尽量完成 rehash 由后台定时任务调用
+// 返回是否还有剩余的桶需要搬迁
+func (d *Dict[V]) RehashFor(limit time.Duration) bool {
+	start := time.Now()
+	for d.rehash(100) {
+		if time.Since(start) > limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan 从 cursor 开始遍历一个桶(rehash 时为小表的一个桶及其在大表中对应的所有桶)
+// 返回下一次调用的游标 返回 0 表示遍历结束
+//
+// 游标按照反向二进制位递增 即先递增最高位
+// 这样表扩容时 已经遍历过的桶在新表中对应的桶的游标都比当前游标小
+// 缩容时已遍历的桶也会被合并到游标较小的桶中
+// 因此整个遍历期间一直存在的元素至少会被返回一次(可能会重复)
+func (d *Dict[V]) Scan(cursor uint64, fn func(key string, val V)) uint64 {
+	if d.Len() == 0 {
+		return 0
+	}
+
+	emit := func(e *entry[V]) {
+		for ; e != nil; e = e.next {
+			fn(e.key, e.val)
+		}
+	}
+
+	if !d.rehashing() {
+		t := &d.ht[0]
+		m := t.mask()
+		emit(t.buckets[cursor&m])
+
+		// 将未被掩码覆盖的高位置 1 后对反转的游标加 1
+		cursor |= ^m
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		return cursor
+	}
+
+	small, large := &d.ht[0], &d.ht[1]
+	if len(small.buckets) > len(large.buckets) {
+		small, large = large, small
+	}
+	m0, m1 := small.mask(), large.mask()
+
+	emit(small.buckets[cursor&m0])
+
+	// 遍历大表中与小表当前桶对应的所有桶
+	for {
+		emit(large.buckets[cursor&m1])
+		cursor |= ^m1
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		if cursor&(m0^m1) == 0 {
+			break
+		}
+	}
+	return cursor
+}
@@ -0,0 +1,496 @@
+package listpack
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// listpack 布局
+// <total-bytes uint32> <num-elements uint16> <entry> ... <entry> <end-byte 0xFF>
+// 每个 entry 为 <encoding-type><element-data><element-tot-len>
+// element-tot-len(backlen) 记录前两部分的长度 用于反向遍历
+const (
+	headerSize = 6
+	eof        = 0xff
+	// numUnknown 元素数量超过 uint16 时头部记录的值 与 redis 的 LP_HDR_NUMELE_UNKNOWN 一致
+	numUnknown = 0xffff
+)
+
+// Listpack 与 redis 的 listpack 对应 所有元素紧凑地保存在一段连续内存中
+// 元素通过偏移量定位 First/Last/Next/Prev 在元素之间移动 没有元素时返回 -1
+// 插入和删除之后之前取得的偏移量失效
+// Listpack 不是并发安全的 由调用方加锁
+type Listpack struct {
+	buf   []byte
+	count int
+}
+
+// New 创建空的 listpack
+func New() *Listpack {
+	lp := &Listpack{buf: make([]byte, headerSize, headerSize+1)}
+	lp.buf = append(lp.buf, eof)
+	lp.updateHeader()
+	return lp
+}
+
+// FromBytes 从完整的 listpack 创建 会校验格式 b 之后归 Listpack 所有
+func FromBytes(b []byte) (*Listpack, error) {
+	count := 0
+	err := walk(b, func(string) { count++ })
+	if err != nil {
+		return nil, err
+	}
+	return &Listpack{buf: b, count: count}, nil
+}
+
+// Len 元素数量
+func (lp *Listpack) Len() int {
+	return lp.count
+}
+
+// Size 占用的字节数
+func (lp *Listpack) Size() int {
+	return len(lp.buf)
+}
+
+// Bytes 完整的 listpack 调用方不能修改返回值
+func (lp *Listpack) Bytes() []byte {
+	return lp.buf
+}
+
+// Clone 深拷贝
+func (lp *Listpack) Clone() *Listpack {
+	return &Listpack{buf: append([]byte(nil), lp.buf...), count: lp.count}
+}
+
+func (lp *Listpack) updateHeader() {
+	binary.LittleEndian.PutUint32(lp.buf, uint32(len(lp.buf)))
+	binary.LittleEndian.PutUint16(lp.buf[4:], uint16(min(lp.count, numUnknown)))
+}
+
+// AppendString 追加字符串 能表示为整数的字符串会以整数编码(与 redis 一致)
+func (lp *Listpack) AppendString(s string) {
+	lp.buf = appendEntry(lp.buf[:len(lp.buf)-1], s)
+	lp.buf = append(lp.buf, eof)
+	lp.count++
+	lp.updateHeader()
+}
+
+// AppendInt 追加整数
+func (lp *Listpack) AppendInt(v int64) {
+	start := len(lp.buf) - 1
+	lp.buf = appendInt(lp.buf[:start], v)
+	lp.buf = appendBacklen(lp.buf, len(lp.buf)-start)
+	lp.buf = append(lp.buf, eof)
+	lp.count++
+	lp.updateHeader()
+}
+
+// PrependString 在表头插入字符串
+func (lp *Listpack) PrependString(s string) {
+	lp.Insert(headerSize, s)
+}
+
+// Insert 在偏移量 off 处的元素之前插入 off 为 -1 时追加到末尾
+func (lp *Listpack) Insert(off int, s string) {
+	if off < 0 || off == len(lp.buf)-1 {
+		lp.AppendString(s)
+		return
+	}
+
+	size := EntrySize(s)
+	tail := len(lp.buf)
+	lp.buf = append(lp.buf, make([]byte, size)...)
+	copy(lp.buf[off+size:], lp.buf[off:tail])
+	appendEntry(lp.buf[off:off], s)
+	lp.count++
+	lp.updateHeader()
+}
+
+// Replace 把偏移量 off 处的元素替换为 s
+func (lp *Listpack) Replace(off int, s string) {
+	oldSize := lp.entrySize(off)
+	newSize := EntrySize(s)
+	end := len(lp.buf)
+	if newSize > oldSize {
+		lp.buf = append(lp.buf, make([]byte, newSize-oldSize)...)
+	}
+	copy(lp.buf[off+newSize:], lp.buf[off+oldSize:end])
+	lp.buf = lp.buf[:end+newSize-oldSize]
+	appendEntry(lp.buf[off:off], s)
+	lp.updateHeader()
+}
+
+// Delete 删除偏移量 off 处的元素 返回下一个元素的偏移量
+func (lp *Listpack) Delete(off int) int {
+	return lp.DeleteRange(off, 1)
+}
+
+// DeleteRange 从偏移量 off 处开始删除最多 n 个元素 返回删除之后下一个元素的偏移量
+func (lp *Listpack) DeleteRange(off, n int) int {
+	end := off
+	deleted := 0
+	for ; deleted < n && lp.buf[end] != eof; deleted++ {
+		end += lp.entrySize(end)
+	}
+	lp.buf = append(lp.buf[:off], lp.buf[end:]...)
+	lp.count -= deleted
+	lp.updateHeader()
+
+	if lp.buf[off] == eof {
+		return -1
+	}
+	return off
+}
+
+// First 第一个元素的偏移量
+func (lp *Listpack) First() int {
+	if lp.count == 0 {
+		return -1
+	}
+	return headerSize
+}
+
+// Last 最后一个元素的偏移量
+func (lp *Listpack) Last() int {
+	if lp.count == 0 {
+		return -1
+	}
+	return lp.prev(len(lp.buf) - 1)
+}
+
+// Next 下一个元素的偏移量
+func (lp *Listpack) Next(off int) int {
+	off += lp.entrySize(off)
+	if lp.buf[off] == eof {
+		return -1
+	}
+	return off
+}
+
+// Prev 上一个元素的偏移量
+func (lp *Listpack) Prev(off int) int {
+	if off <= headerSize {
+		return -1
+	}
+	return lp.prev(off)
+}
+
+// Seek 下标为 i 的元素的偏移量 负数表示从末尾开始 越界时返回 -1
+// 根据下标的位置从较近的一端开始遍历
+func (lp *Listpack) Seek(i int) int {
+	if i < 0 {
+		i += lp.count
+	}
+	if i < 0 || i >= lp.count {
+		return -1
+	}
+
+	if i < lp.count/2 {
+		off := headerSize
+		for ; i > 0; i-- {
+			off += lp.entrySize(off)
+		}
+		return off
+	}
+	off := len(lp.buf) - 1
+	for i = lp.count - i; i > 0; i-- {
+		off = lp.prev(off)
+	}
+	return off
+}
+
+// Get 偏移量 off 处的元素 整数元素会转为十进制字符串
+func (lp *Listpack) Get(off int) string {
+	val, _, err := decodeEntry(lp.buf[off:])
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// prev 根据 off 之前的 backlen 计算上一个元素的偏移量
+func (lp *Listpack) prev(off int) int {
+	p := off - 1
+	l, shift, n := 0, 0, 0
+	for {
+		c := lp.buf[p]
+		l |= int(c&127) << shift
+		n++
+		if c&128 == 0 {
+			break
+		}
+		shift += 7
+		p--
+	}
+	return off - n - l
+}
+
+// entrySize 偏移量 off 处元素占用的字节数 包括 backlen
+func (lp *Listpack) entrySize(off int) int {
+	b := lp.buf[off:]
+	var l int
+	c := b[0]
+	switch {
+	case c&0x80 == 0:
+		l = 1
+	case c&0xc0 == 0x80:
+		l = 1 + int(c&0x3f)
+	case c&0xe0 == 0xc0:
+		l = 2
+	case c&0xf0 == 0xe0:
+		l = 2 + (int(c&0x0f)<<8 | int(b[1]))
+	case c == 0xf0:
+		l = 5 + int(binary.LittleEndian.Uint32(b[1:]))
+	case c == 0xf1:
+		l = 3
+	case c == 0xf2:
+		l = 4
+	case c == 0xf3:
+		l = 5
+	default:
+		l = 9
+	}
+	return l + backlenSize(l)
+}
+
+// EntrySize 元素 s 在 listpack 中占用的字节数 包括编码头和 backlen
+func EntrySize(s string) int {
+	var l int
+	if v, ok := parseCanonicalInt(s); ok {
+		l = intSize(v)
+	} else {
+		l = strHeaderSize(len(s)) + len(s)
+	}
+	return l + backlenSize(l)
+}
+
+// appendEntry 把 s 编码后追加到 dst 包括 backlen
+func appendEntry(dst []byte, s string) []byte {
+	start := len(dst)
+	if v, ok := parseCanonicalInt(s); ok {
+		dst = appendInt(dst, v)
+	} else {
+		dst = appendStr(dst, s)
+	}
+	return appendBacklen(dst, len(dst)-start)
+}
+
+func strHeaderSize(l int) int {
+	switch {
+	case l < 64:
+		return 1
+	case l < 4096:
+		return 2
+	}
+	return 5
+}
+
+func appendStr(dst []byte, s string) []byte {
+	l := len(s)
+	switch {
+	case l < 64:
+		dst = append(dst, 0x80|byte(l))
+	case l < 4096:
+		dst = append(dst, 0xe0|byte(l>>8), byte(l))
+	default:
+		dst = append(dst, 0xf0, byte(l), byte(l>>8), byte(l>>16), byte(l>>24))
+	}
+	return append(dst, s...)
+}
+
+func intSize(v int64) int {
+	switch {
+	case v >= 0 && v <= 127:
+		return 1
+	case v >= -4096 && v <= 4095:
+		return 2
+	case v >= -(1<<15) && v < 1<<15:
+		return 3
+	case v >= -(1<<23) && v < 1<<23:
+		return 4
+	case v >= -(1<<31) && v < 1<<31:
+		return 5
+	}
+	return 9
+}
+
+func appendInt(dst []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 127:
+		return append(dst, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint64(v)
+		if v < 0 {
+			u = uint64((1 << 13) + v)
+		}
+		return append(dst, 0xc0|byte(u>>8), byte(u))
+	case v >= -(1<<15) && v < 1<<15:
+		return append(dst, 0xf1, byte(v), byte(v>>8))
+	case v >= -(1<<23) && v < 1<<23:
+		return append(dst, 0xf2, byte(v), byte(v>>8), byte(v>>16))
+	case v >= -(1<<31) && v < 1<<31:
+		return append(dst, 0xf3, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+	return binary.LittleEndian.AppendUint64(append(dst, 0xf4), uint64(v))
+}
+
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// appendBacklen 反向可读的变长编码 每字节 7 位 除最高位字节外都置位 128
+func appendBacklen(dst []byte, l int) []byte {
+	switch {
+	case l <= 127:
+		return append(dst, byte(l))
+	case l < 16383:
+		return append(dst, byte(l>>7), byte(l&127)|128)
+	case l < 2097151:
+		return append(dst, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+	case l < 268435455:
+		return append(dst, byte(l>>21), byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	}
+	return append(dst, byte(l>>28), byte((l>>21)&127)|128, byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+}
+
+// parseCanonicalInt 只有当字符串是整数的规范表示时才返回 true
+// 例如 "12" 可以 但 "012"、"+12"、" 12" 都不行 这样才能保证还原后字节完全一致
+func parseCanonicalInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != s {
+		return 0, false
+	}
+	return v, true
+}
+
+// Parse 将 listpack 解析为字符串切片 整数元素会转为十进制字符串
+func Parse(b []byte) ([]string, error) {
+	var res []string
+	if len(b) >= headerSize {
+		res = make([]string, 0, binary.LittleEndian.Uint16(b[4:]))
+	}
+	err := walk(b, func(val string) { res = append(res, val) })
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// walk 校验 listpack 的格式并按顺序访问每个元素
+func walk(b []byte, fn func(string)) error {
+	if len(b) < headerSize+1 {
+		return errors.New("listpack: too short")
+	}
+	if int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return errors.New("listpack: total bytes mismatch")
+	}
+
+	p := headerSize
+	for {
+		if p >= len(b) {
+			return errors.New("listpack: missing terminator")
+		}
+		if b[p] == eof {
+			return nil
+		}
+
+		val, size, err := decodeEntry(b[p:])
+		if err != nil {
+			return err
+		}
+		fn(val)
+		p += size + backlenSize(size)
+	}
+}
+
+// decodeEntry 返回元素值以及 encoding+data 部分占用的字节数
+func decodeEntry(b []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return errors.New("listpack: entry out of range")
+		}
+		return nil
+	}
+
+	c := b[0]
+	switch {
+	case c&0x80 == 0: // 7 位无符号整数
+		return strconv.FormatInt(int64(c&0x7f), 10), 1, nil
+	case c&0xc0 == 0x80: // 6 位长度字符串
+		l := int(c & 0x3f)
+		if err := need(1 + l); err != nil {
+			return "", 0, err
+		}
+		return string(b[1 : 1+l]), 1 + l, nil
+	case c&0xe0 == 0xc0: // 13 位有符号整数
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		u := int64(c&0x1f)<<8 | int64(b[1])
+		if u >= 1<<12 {
+			u -= 1 << 13
+		}
+		return strconv.FormatInt(u, 10), 2, nil
+	case c&0xf0 == 0xe0: // 12 位长度字符串
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		l := int(c&0x0f)<<8 | int(b[1])
+		if err := need(2 + l); err != nil {
+			return "", 0, err
+		}
+		return string(b[2 : 2+l]), 2 + l, nil
+	}
+
+	switch c {
+	case 0xf0: // 32 位长度字符串
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		l := int(binary.LittleEndian.Uint32(b[1:]))
+		if err := need(5 + l); err != nil {
+			return "", 0, err
+		}
+		return string(b[5 : 5+l]), 5 + l, nil
+	case 0xf1:
+		if err := need(3); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(b[1:]))), 10), 3, nil
+	case 0xf2:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		u := uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16
+		v := int64(int32(u<<8) >> 8)
+		return strconv.FormatInt(v, 10), 4, nil
+	case 0xf3:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(b[1:]))), 10), 5, nil
+	case 0xf4:
+		if err := need(9); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(b[1:])), 10), 9, nil
+	}
+
+	return "", 0, errors.Errorf("listpack: unknown encoding 0x%x", c)
+}
@@ -0,0 +1,134 @@
+package lzf
+
+import "github.com/pkg/errors"
+
+// lzf 压缩格式(与 liblzf 保持一致) RDB 中的字符串以及 quicklist 的节点都使用它压缩
+// 控制字节 c:
+// 1. c < 32: 后面跟随 c+1 个字面量字节
+// 2. 否则: 高 3 位为匹配长度 len (len == 7 时再读一个字节累加)
+// 低 5 位与下一个字节组成回溯偏移 off 从 out[当前位置-off-1] 处复制 len+2 个字节
+const (
+	lzfMaxLit = 1 << 5
+	lzfMaxOff = 1 << 13
+	lzfMaxRef = (1 << 8) + (1 << 3)
+	// lzfMaxExpand 每个输入字节最多展开的输出字节数 3 字节的回溯引用最多产生 264 字节
+	lzfMaxExpand = lzfMaxRef / 3
+)
+
+// Compress 压缩数据 当压缩结果不比原数据小时返回 nil
+func Compress(in []byte) []byte {
+	n := len(in)
+	out := make([]byte, 0, n)
+	lit := make([]byte, 0, lzfMaxLit)
+	htab := make(map[uint32]int, n)
+
+	flushLit := func() {
+		if len(lit) == 0 {
+			return
+		}
+		out = append(out, byte(len(lit)-1))
+		out = append(out, lit...)
+		lit = lit[:0]
+	}
+
+	ip := 0
+	for ip+2 < n {
+		key := uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])
+		ref, ok := htab[key]
+		htab[key] = ip
+
+		if ok && ip-ref-1 < lzfMaxOff {
+			off := ip - ref - 1
+			maxLen := n - ip
+			if maxLen > lzfMaxRef {
+				maxLen = lzfMaxRef
+			}
+			l := 3
+			for l < maxLen && in[ref+l] == in[ip+l] {
+				l++
+			}
+
+			flushLit()
+			if enc := l - 2; enc < 7 {
+				out = append(out, byte(enc<<5|off>>8), byte(off))
+			} else {
+				out = append(out, byte(7<<5|off>>8), byte(enc-7), byte(off))
+			}
+			ip += l
+			continue
+		}
+
+		lit = append(lit, in[ip])
+		if len(lit) == lzfMaxLit {
+			flushLit()
+		}
+		ip++
+
+		if len(out) >= n {
+			return nil
+		}
+	}
+
+	for ; ip < n; ip++ {
+		lit = append(lit, in[ip])
+		if len(lit) == lzfMaxLit {
+			flushLit()
+		}
+	}
+	flushLit()
+
+	if len(out) >= n {
+		return nil
+	}
+	return out
+}
+
+// Decompress 解压数据 outLen 为原始数据长度
+func Decompress(in []byte, outLen int) ([]byte, error) {
+	if outLen < 0 || outLen > len(in)*lzfMaxExpand {
+		return nil, errors.New("lzf: invalid decompressed length")
+	}
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		c := int(in[i])
+		i++
+
+		// 字面量
+		if c < lzfMaxLit {
+			l := c + 1
+			if i+l > len(in) {
+				return nil, errors.New("lzf: literal run out of range")
+			}
+			out = append(out, in[i:i+l]...)
+			i += l
+			continue
+		}
+
+		// 回溯引用
+		l := c >> 5
+		if l == 7 {
+			if i >= len(in) {
+				return nil, errors.New("lzf: unexpected end of input")
+			}
+			l += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("lzf: unexpected end of input")
+		}
+		ref := len(out) - ((c & 0x1f) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("lzf: back reference out of range")
+		}
+		// 引用区间可能与输出重叠 必须逐字节复制
+		for j := 0; j < l+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, errors.New("lzf: decompressed length mismatch")
+	}
+	return out, nil
+}
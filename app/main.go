@@ -5,8 +5,13 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/app/config"
 	"github.com/codecrafters-io/redis-starter-go/app/connection"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
 	"github.com/pkg/errors"
 )
 
@@ -14,20 +19,44 @@ var _ = net.Listen
 var _ = os.Exit
 
 func main() {
-	l, err := net.Listen("tcp", ":6379")
+	cfg, err := config.Parse(os.Args[1:])
 	if err != nil {
-		fmt.Println("Failed to bind to port 6379")
+		fmt.Println("Bad config:", err)
+		os.Exit(1)
+	}
+
+	kv := store.NewKVStore(store.Options{Config: cfg})
+	if err := kv.LoadData(command.NewHandler(kv).Replay); err != nil {
+		log.Fatalf("Failed loading data: %+v", err)
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		fmt.Printf("Failed to bind to port %d\n", cfg.Port)
 		os.Exit(1)
 	}
 
 	log.Println("server start at ", l.Addr())
 
+	// 收到退出信号时停止后台任务并刷写 AOF
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Println("shutting down")
+		if err := kv.Close(); err != nil {
+			log.Printf("close store: %+v", err)
+		}
+		os.Exit(0)
+	}()
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			log.Println("Error accepting connection: ", errors.New(err.Error()))
+			continue
 		}
 
-		go connection.Handle(conn)
+		go connection.Handle(conn, kv)
 	}
 }
@@ -52,6 +52,11 @@ func NewResp(rd io.Reader) *Resp {
 	return &Resp{reader: bufio.NewReader(rd)}
 }
 
+// Buffered 缓冲区中尚未解析的字节数 为 0 时下一次 Read 会阻塞在网络读取上
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
 // readLine 从缓冲区读取数据
 // 返回读取到的有效数据以及字节数和可能发送的错误
 // 其中有效数据和字节数均不包含 \r\n
@@ -106,6 +111,10 @@ func (r *Resp) Read() (*Value, error) {
 		return r.readArray()
 	case DOUBLE:
 		return r.readDouble()
+	case ERROR:
+		return r.readError()
+	case INTEGER:
+		return r.readInteger()
 	default:
 		return nil, errors.New(fmt.Sprintf("Unknown type: %v", string(typ)))
 	}
@@ -122,6 +131,30 @@ func (r *Resp) readString() (*Value, error) {
 	return v, nil
 }
 
+// -Error message\r\n
+func (r *Resp) readError() (*Value, error) {
+	v := new(Value)
+	v.typ = TERROR
+	line, _, err := r.readLine()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	v.str = string(line)
+	return v, nil
+}
+
+// :[<+|->]<value>\r\n
+func (r *Resp) readInteger() (*Value, error) {
+	v := new(Value)
+	v.typ = TINTEGER
+	num, err := r.readLength()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	v.integer = num
+	return v, nil
+}
+
 // $<length>\r\n<data>\r\n
 func (r *Resp) readBulk() (*Value, error) {
 	v := new(Value)
@@ -139,8 +172,11 @@ func (r *Resp) readBulk() (*Value, error) {
 	}
 
 	// 手动分配一个大小等于bulk的缓冲区
+	// bufio.Reader.Read 单次最多返回缓冲区中的数据 大于缓冲区的 bulk 必须读满
 	bulk := make([]byte, len)
-	r.reader.Read(bulk)
+	if _, err := io.ReadFull(r.reader, bulk); err != nil {
+		return nil, errors.WithStack(err)
+	}
 
 	v.bulk = string(bulk)
 
@@ -95,6 +95,11 @@ func (v *Value) Error() error {
 	return errors.New(v.str)
 }
 
+// IsNull 是否为 Null Bulk String
+func (v *Value) IsNull() bool {
+	return v.typ == TNULL
+}
+
 func (v *Value) SetNullBulk() *Value {
 	v.typ = TNULL
 	return v
@@ -0,0 +1,563 @@
+package quicklist
+
+import (
+	"github.com/codecrafters-io/redis-starter-go/app/listpack"
+	"github.com/codecrafters-io/redis-starter-go/app/lzf"
+)
+
+const (
+	// sizeSafetyLimit fill 为正数时单个节点的字节数上限 与 redis 的 SIZE_SAFETY_LIMIT 一致
+	sizeSafetyLimit = 8192
+	// minCompressBytes 小于该字节数的节点不压缩 与 redis 的 MIN_COMPRESS_BYTES 一致
+	minCompressBytes = 48
+	// minCompressImprove 压缩至少要节省的字节数 与 redis 的 MIN_COMPRESS_IMPROVE 一致
+	minCompressImprove = 8
+	// nodeOverhead 估算的每个节点的结构体开销
+	nodeOverhead = 48
+)
+
+// optimizationLevel fill 为负数时 -1 到 -5 对应的节点字节数上限
+var optimizationLevel = [...]int{4096, 8192, 16384, 32768, 65536}
+
+// node 一个 listpack 节点 压缩时 lp 为 nil 数据保存在 lzf 中
+type node struct {
+	prev, next *node
+	lp         *listpack.Listpack
+	lzf        []byte
+	// count 节点中的元素数量
+	count int
+	// sz 未压缩的 listpack 字节数
+	sz int
+}
+
+// stored 节点实际占用的字节数 压缩的节点按压缩后的大小计算
+func (n *node) stored() int {
+	if n.lp == nil {
+		return len(n.lzf)
+	}
+	return n.lp.Size()
+}
+
+// listpack 节点的 listpack 压缩的节点临时解压 不会改变节点本身
+func (n *node) listpack() *listpack.Listpack {
+	if n.lp != nil {
+		return n.lp
+	}
+	b, err := lzf.Decompress(n.lzf, n.sz)
+	if err != nil {
+		panic(err)
+	}
+	lp, err := listpack.FromBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return lp
+}
+
+// Quicklist 与 redis 的 quicklist 对应 由 listpack 节点组成的双向链表
+// 两端的插入和弹出都是 O(1) 的 按下标访问时先按节点的元素数量跳过整个节点
+// fill 控制单个节点的大小 正数为元素数量上限 负数 -1 到 -5 为 4KB 到 64KB 的字节数上限
+// compress 为两端不压缩的节点数 0 表示不压缩 中间的节点使用 lzf 压缩
+// Quicklist 不是并发安全的 由调用方加锁
+type Quicklist struct {
+	head, tail *node
+	count      int
+	nodes      int
+	fill       int
+	compress   int
+	// bytes 所有节点实际占用的字节数
+	bytes int
+}
+
+// New 创建空的 quicklist 参数与 list-max-listpack-size 和 list-compress-depth 对应
+func New(fill, compress int) *Quicklist {
+	if fill == 0 {
+		fill = 1
+	}
+	if fill < -len(optimizationLevel) {
+		fill = -len(optimizationLevel)
+	}
+	return &Quicklist{fill: fill, compress: max(compress, 0)}
+}
+
+// Len 元素数量
+func (ql *Quicklist) Len() int {
+	return ql.count
+}
+
+// Nodes 节点数量
+func (ql *Quicklist) Nodes() int {
+	return ql.nodes
+}
+
+// MemoryUsage 估算的内存占用 O(1)
+func (ql *Quicklist) MemoryUsage() int64 {
+	return int64(ql.bytes + ql.nodes*nodeOverhead)
+}
+
+// allowInsert 节点 n 能否再容纳 sz 字节的元素
+func (ql *Quicklist) allowInsert(n *node, sz int) bool {
+	if n == nil {
+		return false
+	}
+	newSz := n.sz + sz
+	if ql.fill > 0 {
+		return n.count < ql.fill && newSz <= sizeSafetyLimit
+	}
+	return newSz <= optimizationLevel[-ql.fill-1]
+}
+
+// PushHead 在表头插入
+func (ql *Quicklist) PushHead(v string) {
+	if n := ql.head; ql.allowInsert(n, listpack.EntrySize(v)) {
+		ql.decompress(n)
+		n.lp.PrependString(v)
+		ql.updated(n)
+	} else {
+		n = ql.newNode()
+		n.lp.AppendString(v)
+		ql.updated(n)
+		ql.insertNode(nil, n)
+	}
+	ql.count++
+}
+
+// PushTail 在表尾插入
+func (ql *Quicklist) PushTail(v string) {
+	if n := ql.tail; ql.allowInsert(n, listpack.EntrySize(v)) {
+		ql.decompress(n)
+		n.lp.AppendString(v)
+		ql.updated(n)
+	} else {
+		n = ql.newNode()
+		n.lp.AppendString(v)
+		ql.updated(n)
+		ql.insertNode(ql.tail, n)
+	}
+	ql.count++
+}
+
+// PopHead 弹出表头的元素
+func (ql *Quicklist) PopHead() (string, bool) {
+	if ql.head == nil {
+		return "", false
+	}
+	n := ql.head
+	ql.decompress(n)
+	v := n.lp.Get(n.lp.First())
+	ql.delIndex(n, 0, 1)
+	return v, true
+}
+
+// PopTail 弹出表尾的元素
+func (ql *Quicklist) PopTail() (string, bool) {
+	if ql.tail == nil {
+		return "", false
+	}
+	n := ql.tail
+	ql.decompress(n)
+	v := n.lp.Get(n.lp.Last())
+	ql.delIndex(n, n.count-1, 1)
+	return v, true
+}
+
+// Index 下标为 i 的元素 负数表示从末尾开始
+func (ql *Quicklist) Index(i int) (string, bool) {
+	n, idx := ql.locate(i)
+	if n == nil {
+		return "", false
+	}
+	lp := n.listpack()
+	return lp.Get(lp.Seek(idx)), true
+}
+
+// Replace 把下标为 i 的元素替换为 v 越界时返回 false
+// 节点放不下新的值时与 redis 一样改为插入新元素再删除旧元素 由 Insert 负责拆分节点
+func (ql *Quicklist) Replace(i int, v string) bool {
+	n, idx := ql.locate(i)
+	if n == nil {
+		return false
+	}
+	if n.count > 1 && !ql.allowInsert(n, listpack.EntrySize(v)) {
+		if i < 0 {
+			i += ql.count
+		}
+		ql.Insert(i, v, true)
+		ql.DelRange(i, 1)
+		return true
+	}
+
+	ql.decompress(n)
+	n.lp.Replace(n.lp.Seek(idx), v)
+	ql.updated(n)
+	ql.compressNode(n)
+	return true
+}
+
+// Insert 在下标为 i 的元素之前插入 v after 为 true 时插入到它之后 越界时返回 false
+// 与 redis 的 _quicklistInsert 一致 所在节点已满时依次尝试相邻节点、新节点以及拆分当前节点
+func (ql *Quicklist) Insert(i int, v string, after bool) bool {
+	n, idx := ql.locate(i)
+	if n == nil {
+		return false
+	}
+	if after {
+		idx++
+	}
+
+	sz := listpack.EntrySize(v)
+	switch {
+	case ql.allowInsert(n, sz):
+		ql.decompress(n)
+		n.lp.Insert(n.lp.Seek(idx), v)
+		ql.updated(n)
+		ql.compressNode(n)
+	case idx == n.count && ql.allowInsert(n.next, sz):
+		next := n.next
+		ql.decompress(next)
+		next.lp.PrependString(v)
+		ql.updated(next)
+		ql.compressNode(next)
+	case idx == 0 && ql.allowInsert(n.prev, sz):
+		prev := n.prev
+		ql.decompress(prev)
+		prev.lp.AppendString(v)
+		ql.updated(prev)
+		ql.compressNode(prev)
+	case idx == 0 || idx == n.count:
+		nn := ql.newNode()
+		nn.lp.AppendString(v)
+		ql.updated(nn)
+		if idx == 0 {
+			ql.insertNode(n.prev, nn)
+		} else {
+			ql.insertNode(n, nn)
+		}
+	default:
+		// 从插入位置把节点拆成两半 新元素放在前一半的末尾
+		ql.decompress(n)
+		nn := ql.newNode()
+		for off := n.lp.Seek(idx); off >= 0; off = n.lp.Next(off) {
+			nn.lp.AppendString(n.lp.Get(off))
+		}
+		n.lp.DeleteRange(n.lp.Seek(idx), n.count-idx)
+		n.lp.AppendString(v)
+		ql.updated(n)
+		ql.updated(nn)
+		ql.insertNode(n, nn)
+		ql.compressNode(n)
+	}
+	ql.count++
+	return true
+}
+
+// DeleteIf 删除满足 match 的元素 从表头开始 reverse 为 true 时从表尾开始
+// limit 大于 0 时最多删除 limit 个 返回删除的数量
+func (ql *Quicklist) DeleteIf(reverse bool, limit int, match func(v string) bool) int {
+	deleted := 0
+	n := ql.head
+	if reverse {
+		n = ql.tail
+	}
+	for n != nil && (limit <= 0 || deleted < limit) {
+		next := n.next
+		if reverse {
+			next = n.prev
+		}
+
+		lp := n.listpack()
+		off := lp.First()
+		if reverse {
+			off = lp.Last()
+		}
+		removed := 0
+		for off >= 0 && (limit <= 0 || deleted+removed < limit) {
+			if !match(lp.Get(off)) {
+				if reverse {
+					off = lp.Prev(off)
+				} else {
+					off = lp.Next(off)
+				}
+				continue
+			}
+			if removed == 0 {
+				// 第一次删除时才真正解压 没有匹配的节点保持原样
+				ql.decompress(n)
+				lp = n.lp
+			}
+			removed++
+			if reverse {
+				prev := lp.Prev(off)
+				lp.Delete(off)
+				off = prev
+			} else {
+				off = lp.Delete(off)
+			}
+		}
+
+		if removed > 0 {
+			deleted += removed
+			ql.count -= removed
+			ql.updated(n)
+			if n.count == 0 {
+				ql.delNode(n)
+			} else {
+				ql.compressNode(n)
+			}
+		}
+		n = next
+	}
+	return deleted
+}
+
+// DelRange 从下标 start 开始删除 n 个元素 返回实际删除的数量
+func (ql *Quicklist) DelRange(start, n int) int {
+	if start < 0 {
+		start += ql.count
+	}
+	if start < 0 || start >= ql.count || n <= 0 {
+		return 0
+	}
+	n = min(n, ql.count-start)
+
+	node, idx := ql.locate(start)
+	for deleted := 0; deleted < n; {
+		next := node.next
+		k := min(node.count-idx, n-deleted)
+		ql.delIndex(node, idx, k)
+		deleted += k
+		node, idx = next, 0
+	}
+	return n
+}
+
+// Clone 深拷贝
+func (ql *Quicklist) Clone() *Quicklist {
+	c := New(ql.fill, ql.compress)
+	for n := ql.head; n != nil; n = n.next {
+		cn := &node{count: n.count, sz: n.sz}
+		if n.lp != nil {
+			cn.lp = n.lp.Clone()
+		} else {
+			cn.lzf = append([]byte(nil), n.lzf...)
+		}
+		c.linkAfter(c.tail, cn)
+	}
+	c.count, c.bytes = ql.count, ql.bytes
+	return c
+}
+
+// ForEachNode 按顺序访问每个节点的 listpack 压缩的节点临时解压
+func (ql *Quicklist) ForEachNode(fn func(lp []byte) error) error {
+	for n := ql.head; n != nil; n = n.next {
+		if err := fn(n.listpack().Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release 断开所有节点 帮助 GC 回收大列表
+func (ql *Quicklist) Release() {
+	for n := ql.head; n != nil; {
+		next := n.next
+		n.prev, n.next = nil, nil
+		n = next
+	}
+	ql.head, ql.tail = nil, nil
+	ql.count, ql.nodes, ql.bytes = 0, 0, 0
+}
+
+// Iterator 从下标 i 开始的迭代器 forward 为 false 时向表头方向移动
+// 迭代期间不能修改 quicklist
+func (ql *Quicklist) Iterator(i int, forward bool) *Iterator {
+	it := &Iterator{forward: forward, off: -1}
+	if it.n, i = ql.locate(i); it.n != nil {
+		it.lp = it.n.listpack()
+		it.off = it.lp.Seek(i)
+	}
+	return it
+}
+
+// Iterator 见 Quicklist.Iterator
+type Iterator struct {
+	n       *node
+	lp      *listpack.Listpack
+	off     int
+	forward bool
+}
+
+// Next 返回当前元素并移动到下一个 没有更多元素时返回 false
+func (it *Iterator) Next() (string, bool) {
+	if it.off < 0 {
+		return "", false
+	}
+	v := it.lp.Get(it.off)
+
+	if it.forward {
+		it.off = it.lp.Next(it.off)
+	} else {
+		it.off = it.lp.Prev(it.off)
+	}
+	if it.off < 0 {
+		if it.forward {
+			it.n = it.n.next
+		} else {
+			it.n = it.n.prev
+		}
+		if it.n != nil {
+			it.lp = it.n.listpack()
+			if it.forward {
+				it.off = it.lp.First()
+			} else {
+				it.off = it.lp.Last()
+			}
+		}
+	}
+	return v, true
+}
+
+// locate 下标 i 所在的节点以及在节点中的下标 越界时返回 nil
+func (ql *Quicklist) locate(i int) (*node, int) {
+	if i < 0 {
+		i += ql.count
+	}
+	if i < 0 || i >= ql.count {
+		return nil, 0
+	}
+
+	if i < ql.count/2 {
+		n := ql.head
+		for i >= n.count {
+			i -= n.count
+			n = n.next
+		}
+		return n, i
+	}
+	n := ql.tail
+	i = ql.count - 1 - i
+	for i >= n.count {
+		i -= n.count
+		n = n.prev
+	}
+	return n, n.count - 1 - i
+}
+
+// delIndex 删除节点 n 中从下标 idx 开始的 k 个元素 节点变空时删除节点
+func (ql *Quicklist) delIndex(n *node, idx, k int) {
+	ql.count -= k
+	if k == n.count {
+		ql.delNode(n)
+		return
+	}
+	ql.decompress(n)
+	n.lp.DeleteRange(n.lp.Seek(idx), k)
+	ql.updated(n)
+	ql.compressNode(n)
+}
+
+func (ql *Quicklist) newNode() *node {
+	return &node{lp: listpack.New()}
+}
+
+// updated 节点的 listpack 修改之后更新统计信息
+func (ql *Quicklist) updated(n *node) {
+	ql.bytes += n.lp.Size() - n.sz
+	n.sz = n.lp.Size()
+	n.count = n.lp.Len()
+}
+
+// insertNode 把新节点插入到 after 之后 after 为 nil 时插入到表头
+// 新节点的字节数已经由 updated 计入
+func (ql *Quicklist) insertNode(after, n *node) {
+	ql.linkAfter(after, n)
+	ql.compressNode(n)
+}
+
+func (ql *Quicklist) linkAfter(after, n *node) {
+	if after == nil {
+		n.next = ql.head
+		if ql.head != nil {
+			ql.head.prev = n
+		}
+		ql.head = n
+	} else {
+		n.prev, n.next = after, after.next
+		if after.next != nil {
+			after.next.prev = n
+		}
+		after.next = n
+	}
+	if n.next == nil {
+		ql.tail = n
+	}
+	ql.nodes++
+}
+
+func (ql *Quicklist) delNode(n *node) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		ql.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		ql.tail = n.prev
+	}
+	n.prev, n.next = nil, nil
+	ql.nodes--
+	ql.bytes -= n.stored()
+	// 删除节点之后两端深度以内的节点可能变化
+	ql.compressNode(nil)
+}
+
+// compressNode 与 redis 的 __quicklistCompress 对应
+// 保证两端 compress 个节点不压缩 并压缩 n 以及刚好超出深度的节点
+func (ql *Quicklist) compressNode(n *node) {
+	if ql.compress == 0 || ql.nodes < ql.compress*2 {
+		return
+	}
+
+	forward, reverse := ql.head, ql.tail
+	inDepth := false
+	for depth := 0; depth < ql.compress; depth++ {
+		ql.decompress(forward)
+		ql.decompress(reverse)
+		if forward == n || reverse == n {
+			inDepth = true
+		}
+		if forward == reverse || forward.next == reverse {
+			return
+		}
+		forward, reverse = forward.next, reverse.prev
+	}
+	if !inDepth && n != nil {
+		ql.compressRaw(n)
+	}
+	ql.compressRaw(forward)
+	ql.compressRaw(reverse)
+}
+
+// compressRaw 压缩节点 太小或者压缩效果不明显时保持原样
+func (ql *Quicklist) compressRaw(n *node) {
+	if n.lp == nil || n.sz < minCompressBytes {
+		return
+	}
+	comp := lzf.Compress(n.lp.Bytes())
+	if comp == nil || len(comp)+minCompressImprove >= n.sz {
+		return
+	}
+	ql.bytes += len(comp) - n.sz
+	n.lp, n.lzf = nil, comp
+}
+
+// decompress 解压节点 之后由 compressNode 重新压缩
+func (ql *Quicklist) decompress(n *node) {
+	if n.lp != nil {
+		return
+	}
+	n.lp = n.listpack()
+	ql.bytes += n.sz - len(n.lzf)
+	n.lzf = nil
+}
@@ -0,0 +1,81 @@
+package rdb
+
+// Version 写出的 rdb 版本号
+// 10 对应 redis 7.0 可以被 7.0 及以上版本的 redis-server 直接加载
+const Version = 10
+
+// MaxVersion 能够读取的最高 rdb 版本号
+const MaxVersion = 12
+
+// 对象类型
+const (
+	TypeString           byte = 0
+	TypeList             byte = 1
+	TypeSet              byte = 2
+	TypeZSet             byte = 3
+	TypeHash             byte = 4
+	TypeZSet2            byte = 5
+	TypeModule2          byte = 7
+	TypeHashZipmap       byte = 9
+	TypeListZiplist      byte = 10
+	TypeSetIntset        byte = 11
+	TypeZSetZiplist      byte = 12
+	TypeHashZiplist      byte = 13
+	TypeListQuicklist    byte = 14
+	TypeStreamListpacks  byte = 15
+	TypeHashListpack     byte = 16
+	TypeZSetListpack     byte = 17
+	TypeListQuicklist2   byte = 18
+	TypeStreamListpacks2 byte = 19
+	TypeSetListpack      byte = 20
+	TypeStreamListpacks3 byte = 21
+	// 带有字段过期时间的哈希 redis 7.4
+	TypeHashMetadataPreGA   byte = 22
+	TypeHashListpackExPreGA byte = 23
+	TypeHashMetadata        byte = 24
+	TypeHashListpackEx      byte = 25
+)
+
+// 操作码
+const (
+	OpSlotInfo     byte = 244
+	OpFunction2    byte = 245
+	OpFunctionPre  byte = 246
+	OpModuleAux    byte = 247
+	OpIdle         byte = 248
+	OpFreq         byte = 249
+	OpAux          byte = 250
+	OpResizeDB     byte = 251
+	OpExpireTimeMS byte = 252
+	OpExpireTime   byte = 253
+	OpSelectDB     byte = 254
+	OpEOF          byte = 255
+)
+
+// 长度编码
+// 00xxxxxx                      6 位长度
+// 01xxxxxx xxxxxxxx             14 位长度
+// 10000000 + 4 字节(大端)        32 位长度
+// 10000001 + 8 字节(大端)        64 位长度
+// 11xxxxxx                      特殊编码 低 6 位为编码类型
+const (
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	lenEnc   = 3
+)
+
+// 特殊编码的字符串
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// quicklist2 中节点的容器类型
+const (
+	QuicklistNodePlain  = 1
+	QuicklistNodePacked = 2
+)
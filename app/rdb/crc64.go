@@ -0,0 +1,17 @@
+package rdb
+
+import "hash/crc64"
+
+// redis 使用的是 crc-64-jones 多项式(反射形式)
+// 与标准库不同的是 redis 的初始值为 0 且不做最终取反
+// 因此这里只复用标准库生成的查找表 更新逻辑自行实现
+// 校验值: crc64("123456789") = 0xe9c6d914c4b8d9ca
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// CRC64 在 crc 的基础上继续计算 p 的校验和
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
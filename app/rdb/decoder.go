@@ -0,0 +1,265 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/app/lzf"
+	"github.com/pkg/errors"
+)
+
+// rawChunkSize 长度未知的输入按块读取大字符串 避免按伪造的长度一次性分配内存
+const rawChunkSize = 64 << 10
+
+// ErrBadLength 长度或元素数量超出了剩余的数据
+var ErrBadLength = errors.New("length out of range")
+
+// Decoder 负责读取 rdb 格式的数据 并同步计算 crc64 校验和
+type Decoder struct {
+	r       *bufio.Reader
+	crc     uint64
+	Version int
+	// remain 剩余可读的字节数 -1 表示未知
+	remain int64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), remain: -1}
+}
+
+// NewDecoderSize 用于长度已知的输入(如 DUMP 载荷) 超出剩余字节数的长度直接视为错误
+func NewDecoderSize(r io.Reader, size int64) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), remain: size}
+}
+
+// Sum 返回目前为止读入的所有字节的 crc64
+func (d *Decoder) Sum() uint64 {
+	return d.crc
+}
+
+func (d *Decoder) ReadRaw(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrBadLength
+	}
+	if err := d.checkLength(uint64(n)); err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	if d.remain < 0 && n > rawChunkSize {
+		// 长度不可信 随读随扩容 数据不足时在 EOF 处失败
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, d.r, int64(n)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		buf = b.Bytes()
+	} else {
+		buf = make([]byte, n)
+		if _, err := io.ReadFull(d.r, buf); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	d.consume(len(buf))
+	d.crc = CRC64(d.crc, buf)
+	return buf, nil
+}
+
+func (d *Decoder) ReadByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	d.consume(1)
+	d.crc = CRC64(d.crc, []byte{b})
+	return b, nil
+}
+
+// checkLength 检查 n 个字节(或至少各占一个字节的 n 个元素)是否可能还在输入中
+func (d *Decoder) checkLength(n uint64) error {
+	if n > math.MaxInt || d.remain >= 0 && n > uint64(d.remain) {
+		return ErrBadLength
+	}
+	return nil
+}
+
+func (d *Decoder) consume(n int) {
+	if d.remain >= 0 {
+		d.remain -= int64(n)
+	}
+}
+
+// ReadHeader 校验魔数并记录版本号
+func (d *Decoder) ReadHeader() error {
+	buf, err := d.ReadRaw(9)
+	if err != nil {
+		return err
+	}
+	if string(buf[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(buf[5:]))
+	if err != nil || version < 1 || version > MaxVersion {
+		return errors.Errorf("can't handle RDB format version %s", buf[5:])
+	}
+	d.Version = version
+	return nil
+}
+
+// ReadLength 返回长度以及该长度是否为特殊编码
+// 当 encoded 为 true 时 返回值为编码类型而非长度
+func (d *Decoder) ReadLength() (n uint64, encoded bool, err error) {
+	b, err := d.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3f), false, nil
+	case len14Bit:
+		next, err := d.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case lenEnc:
+		return uint64(b & 0x3f), true, nil
+	}
+
+	switch b {
+	case len32Bit:
+		buf, err := d.ReadRaw(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf, err := d.ReadRaw(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+
+	return 0, false, errors.Errorf("unknown length encoding %d", b)
+}
+
+// ReadLen 读取普通长度 不允许出现特殊编码
+func (d *Decoder) ReadLen() (uint64, error) {
+	n, encoded, err := d.ReadLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, errors.New("unexpected encoded length")
+	}
+	return n, nil
+}
+
+// ReadCount 读取元素数量 每个元素至少占用一个字节 数量超出剩余数据时返回 ErrBadLength
+func (d *Decoder) ReadCount() (int, error) {
+	n, err := d.ReadLen()
+	if err != nil {
+		return 0, err
+	}
+	if err := d.checkLength(n); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (d *Decoder) ReadString() (string, error) {
+	n, encoded, err := d.ReadLength()
+	if err != nil {
+		return "", err
+	}
+
+	if !encoded {
+		buf, err := d.ReadRaw(int(n))
+		if err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+
+	switch n {
+	case encInt8:
+		buf, err := d.ReadRaw(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int8(buf[0])), 10), nil
+	case encInt16:
+		buf, err := d.ReadRaw(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(buf))), 10), nil
+	case encInt32:
+		buf, err := d.ReadRaw(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(buf))), 10), nil
+	case encLZF:
+		clen, err := d.ReadLen()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.ReadLen()
+		if err != nil {
+			return "", err
+		}
+		comp, err := d.ReadRaw(int(clen))
+		if err != nil {
+			return "", err
+		}
+		raw, err := lzf.Decompress(comp, int(ulen))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return string(raw), nil
+	}
+
+	return "", errors.Errorf("unknown string encoding %d", n)
+}
+
+// ReadMillisecondTime 8 字节小端
+func (d *Decoder) ReadMillisecondTime() (int64, error) {
+	buf, err := d.ReadRaw(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// ReadSecondTime 4 字节小端
+func (d *Decoder) ReadSecondTime() (int64, error) {
+	buf, err := d.ReadRaw(4)
+	if err != nil {
+		return 0, err
+	}
+	return int64(int32(binary.LittleEndian.Uint32(buf))), nil
+}
+
+// VerifyChecksum 在读完 EOF 操作码后调用
+// 版本 5 以前的文件没有校验和 值为 0 时表示写入方关闭了校验
+func (d *Decoder) VerifyChecksum() error {
+	if d.Version < 5 {
+		return nil
+	}
+	expected := d.crc
+	buf, err := d.ReadRaw(8)
+	if err != nil {
+		return err
+	}
+	got := binary.LittleEndian.Uint64(buf)
+	if got != 0 && got != expected {
+		return errors.New("wrong RDB checksum")
+	}
+	return nil
+}
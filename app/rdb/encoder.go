@@ -0,0 +1,187 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/app/lzf"
+	"github.com/pkg/errors"
+)
+
+// Encoder 负责以 rdb 格式写出数据 并同步计算 crc64 校验和
+type Encoder struct {
+	w   io.Writer
+	crc uint64
+	// Compress 为 true 时 超过 20 字节的字符串会尝试 lzf 压缩
+	Compress bool
+	// Checksum 为 false 时 文件尾部的校验和写 0
+	Checksum bool
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:        w,
+		Compress: true,
+		Checksum: true,
+	}
+}
+
+// Sum 返回目前为止写出的所有字节的 crc64
+func (e *Encoder) Sum() uint64 {
+	return e.crc
+}
+
+func (e *Encoder) WriteRaw(p []byte) error {
+	e.crc = CRC64(e.crc, p)
+	if _, err := e.w.Write(p); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (e *Encoder) WriteByte(b byte) error {
+	return e.WriteRaw([]byte{b})
+}
+
+// WriteHeader REDIS + 4 位版本号
+func (e *Encoder) WriteHeader() error {
+	return e.WriteRaw([]byte(fmt.Sprintf("REDIS%04d", Version)))
+}
+
+func (e *Encoder) WriteAux(key, value string) error {
+	if err := e.WriteByte(OpAux); err != nil {
+		return err
+	}
+	if err := e.WriteString(key); err != nil {
+		return err
+	}
+	return e.WriteString(value)
+}
+
+func (e *Encoder) WriteSelectDB(db int) error {
+	if err := e.WriteByte(OpSelectDB); err != nil {
+		return err
+	}
+	return e.WriteLength(uint64(db))
+}
+
+func (e *Encoder) WriteResizeDB(size, expires int) error {
+	if err := e.WriteByte(OpResizeDB); err != nil {
+		return err
+	}
+	if err := e.WriteLength(uint64(size)); err != nil {
+		return err
+	}
+	return e.WriteLength(uint64(expires))
+}
+
+// WriteExpireMS 写出毫秒级的过期时间戳 必须位于对应 key 之前
+func (e *Encoder) WriteExpireMS(ms int64) error {
+	if err := e.WriteByte(OpExpireTimeMS); err != nil {
+		return err
+	}
+	return e.WriteMillisecondTime(ms)
+}
+
+// WriteMillisecondTime 8 字节小端
+func (e *Encoder) WriteMillisecondTime(ms int64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ms))
+	return e.WriteRaw(buf[:])
+}
+
+func (e *Encoder) WriteLength(n uint64) error {
+	switch {
+	case n < 1<<6:
+		return e.WriteRaw([]byte{byte(len6Bit<<6 | n)})
+	case n < 1<<14:
+		return e.WriteRaw([]byte{byte(len14Bit<<6 | n>>8), byte(n)})
+	case n <= 0xffffffff:
+		buf := make([]byte, 5)
+		buf[0] = len32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		return e.WriteRaw(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = len64Bit
+		binary.BigEndian.PutUint64(buf[1:], n)
+		return e.WriteRaw(buf)
+	}
+}
+
+// WriteString 写出字符串 编码选择与 redis 一致
+// 1.能表示为 32 位以内整数的短字符串使用整数编码
+// 2.开启压缩且长度超过 20 的字符串尝试 lzf 压缩
+// 3.其余情况使用 长度+原始字节
+func (e *Encoder) WriteString(s string) error {
+	if len(s) <= 11 {
+		if v, ok := parseCanonicalInt(s); ok {
+			if buf := encodeInt(v); buf != nil {
+				return e.WriteRaw(buf)
+			}
+		}
+	}
+
+	if e.Compress && len(s) > 20 {
+		if comp := lzf.Compress([]byte(s)); comp != nil {
+			if err := e.WriteByte(lenEnc<<6 | encLZF); err != nil {
+				return err
+			}
+			if err := e.WriteLength(uint64(len(comp))); err != nil {
+				return err
+			}
+			if err := e.WriteLength(uint64(len(s))); err != nil {
+				return err
+			}
+			return e.WriteRaw(comp)
+		}
+	}
+
+	if err := e.WriteLength(uint64(len(s))); err != nil {
+		return err
+	}
+	return e.WriteRaw([]byte(s))
+}
+
+// WriteEOF 写出结束标记以及 8 字节(小端)的校验和
+func (e *Encoder) WriteEOF() error {
+	if err := e.WriteByte(OpEOF); err != nil {
+		return err
+	}
+	var buf [8]byte
+	if e.Checksum {
+		binary.LittleEndian.PutUint64(buf[:], e.crc)
+	}
+	return e.WriteRaw(buf[:])
+}
+
+// encodeInt 返回整数编码后的字节 超出 32 位范围时返回 nil
+func encodeInt(v int64) []byte {
+	switch {
+	case v >= -(1<<7) && v < 1<<7:
+		return []byte{lenEnc<<6 | encInt8, byte(v)}
+	case v >= -(1<<15) && v < 1<<15:
+		return []byte{lenEnc<<6 | encInt16, byte(v), byte(v >> 8)}
+	case v >= -(1<<31) && v < 1<<31:
+		return []byte{lenEnc<<6 | encInt32, byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+	}
+	return nil
+}
+
+// parseCanonicalInt 只有当字符串是整数的规范表示时才返回 true
+// 例如 "12" 可以 但 "012"、"+12"、" 12" 都不行 这样才能保证还原后字节完全一致
+func parseCanonicalInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if strconv.FormatInt(v, 10) != s {
+		return 0, false
+	}
+	return v, true
+}
@@ -0,0 +1,127 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ParseZiplist 解析旧版本(redis 7.0 之前)使用的 ziplist
+// <zlbytes uint32> <zltail uint32> <zllen uint16> <entry> ... <zlend 0xFF>
+// entry: <prevlen> <encoding> <data>
+func ParseZiplist(b []byte) ([]string, error) {
+	if len(b) < 11 {
+		return nil, errors.New("ziplist: too short")
+	}
+
+	res := make([]string, 0, binary.LittleEndian.Uint16(b[8:]))
+	p := 10
+	for {
+		if p >= len(b) {
+			return nil, errors.New("ziplist: missing terminator")
+		}
+		if b[p] == 0xff {
+			break
+		}
+
+		// prevlen
+		if b[p] == 0xfe {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= len(b) {
+			return nil, errors.New("ziplist: entry out of range")
+		}
+
+		val, size, err := zlDecodeEntry(b[p:])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, val)
+		p += size
+	}
+
+	return res, nil
+}
+
+func zlDecodeEntry(b []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(b) < n {
+			return errors.New("ziplist: entry out of range")
+		}
+		return nil
+	}
+
+	c := b[0]
+	switch c >> 6 {
+	case 0: // 6 位长度字符串
+		l := int(c & 0x3f)
+		if err := need(1 + l); err != nil {
+			return "", 0, err
+		}
+		return string(b[1 : 1+l]), 1 + l, nil
+	case 1: // 14 位长度字符串(大端)
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		l := int(c&0x3f)<<8 | int(b[1])
+		if err := need(2 + l); err != nil {
+			return "", 0, err
+		}
+		return string(b[2 : 2+l]), 2 + l, nil
+	case 2: // 32 位长度字符串(大端)
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		l := int(binary.BigEndian.Uint32(b[1:]))
+		if err := need(5 + l); err != nil {
+			return "", 0, err
+		}
+		return string(b[5 : 5+l]), 5 + l, nil
+	}
+
+	var v int64
+	var size int
+	switch c {
+	case 0xc0:
+		size = 3
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(int16(binary.LittleEndian.Uint16(b[1:])))
+	case 0xd0:
+		size = 5
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(int32(binary.LittleEndian.Uint32(b[1:])))
+	case 0xe0:
+		size = 9
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(binary.LittleEndian.Uint64(b[1:]))
+	case 0xf0:
+		size = 4
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		u := uint32(b[1]) | uint32(b[2])<<8 | uint32(b[3])<<16
+		v = int64(int32(u<<8) >> 8)
+	case 0xfe:
+		size = 2
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(int8(b[1]))
+	default:
+		if c >= 0xf1 && c <= 0xfd {
+			return strconv.Itoa(int(c&0x0f) - 1), 1, nil
+		}
+		return "", 0, errors.Errorf("ziplist: unknown encoding 0x%x", c)
+	}
+
+	return strconv.FormatInt(v, 10), size, nil
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/pkg/errors"
+)
+
+// LoadData 启动时加载数据
+// 开启 AOF 时以 AOF 为准 否则加载 rdb
+// replay 用于重放 AOF 中的命令 由 command 包提供
+// 所有命令都由同一个伪客户端执行 使 AOF 中的 SELECT 能够生效
+func (s *KVStore) LoadData(replay func(c *Client, args []string) error) error {
+	if !s.cfg.AppendOnly {
+		return s.LoadRDB()
+	}
+
+	policy, err := aof.ParseFsyncPolicy(s.cfg.AppendFsync)
+	if err != nil {
+		return err
+	}
+
+	a, err := aof.Open(aof.Options{
+		Dir:           filepath.Join(s.cfg.Dir, s.cfg.AppendDirname),
+		Filename:      s.cfg.AppendFilename,
+		Fsync:         policy,
+		LoadTruncated: s.cfg.AOFLoadTruncated,
+	})
+	if err != nil {
+		return err
+	}
+
+	exists := a.Exists()
+	if exists {
+		loadBase := func(r io.Reader) error {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return s.rdbLoad(r)
+		}
+		c := s.NewClient()
+		exec := func(args []string) error {
+			_, err := s.Execute(c, func() (*protocol.Value, error) {
+				return nil, replay(c, args)
+			})
+			return err
+		}
+		if err := a.Load(loadBase, exec); err != nil {
+			return err
+		}
+	} else if err := s.LoadRDB(); err != nil {
+		// 首次开启 AOF 时 以已有的 rdb 作为初始数据
+		return err
+	}
+
+	if err := a.Start(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.aof = a
+	s.aofSelectedDB = -1
+	s.dirty.Store(0)
+	s.mutex.Unlock()
+
+	// 首次开启时立即生成 base 文件 保证 AOF 独立于 rdb 也是完整的
+	if !exists {
+		if err := s.rewriteAOF(false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// propagate 将写命令记录到 AOF
+// 外部必须持有所修改的 key 所在分片的写锁(或全局写锁)
+// 这样同一个 key 上的命令在 AOF 中的顺序与实际执行顺序一致 不同分片上的命令互不影响 可以任意交错
+// 非确定性的命令需要由调用方改写为确定的形式 例如相对过期时间改为绝对时间
+// db 与上一条命令不同时先写入 SELECT 为 nil 表示命令与数据库无关(如 FLUSHALL)
+func (s *KVStore) propagate(db *database, args ...string) {
+	if s.aof == nil {
+		return
+	}
+	s.propagateMu.Lock()
+	defer s.propagateMu.Unlock()
+	if db != nil && db.id != s.aofSelectedDB {
+		s.aof.Feed([]string{"SELECT", strconv.Itoa(db.id)})
+		s.aofSelectedDB = db.id
+	}
+	s.aof.Feed(args)
+}
+
+// rewriteAOF 从当前数据集重写 AOF
+// 在持有写锁期间(没有写命令可以执行)切换 incr 文件并生成快照
+// 之后的 base 写入可以在后台进行
+func (s *KVStore) rewriteAOF(background bool) error {
+	s.mutex.Lock()
+	a := s.aof
+	if a == nil {
+		s.mutex.Unlock()
+		return errors.New("ERR AOF is not enabled")
+	}
+	if err := a.BeginRewrite(); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	// 新的 incr 文件在 base 之后重放 不能依赖旧文件中的 SELECT
+	s.aofSelectedDB = -1
+	entries, _ := s.snapshotLocked()
+	s.mutex.Unlock()
+
+	rewrite := func() error {
+		return a.FinishRewrite(func(w io.Writer) error {
+			return s.rdbWrite(w, entries, true)
+		})
+	}
+
+	if !background {
+		return rewrite()
+	}
+
+	s.background(func() {
+		if err := rewrite(); err != nil {
+			log.Printf("aof: background AOF rewrite failed: %+v", err)
+			return
+		}
+		log.Println("aof: background AOF rewrite finished successfully")
+	})
+	return nil
+}
+
+func (s *KVStore) HandleBGREWRITEAOF(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 0 {
+		return nil, errors.New(emsgArgsNumber("bgrewriteaof"))
+	}
+
+	if err := s.rewriteAOF(true); err != nil {
+		return nil, err
+	}
+
+	return new(protocol.Value).SetStr("Background append only file rewriting started"), nil
+}
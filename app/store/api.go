@@ -0,0 +1,264 @@
+package store
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/pkg/errors"
+)
+
+// 进程内使用的 Go API
+//
+// Client 上的方法作用于客户端当前选中的数据库 同一个 Client 不能被多个 goroutine 同时 Select
+// KVStore 上的同名方法作用于 0 号数据库 可以被并发调用
+//
+// 内部复用命令的实现 因此过期、阻塞唤醒、AOF 等行为与通过网络执行命令完全一致
+// 类型不匹配等错误以 error 返回 错误信息与命令的错误回复相同
+
+// StreamEntry stream 中的一个条目
+type StreamEntry struct {
+	ID string
+	// Fields field1 value1 field2 value2 ...
+	Fields []string
+}
+
+type handlerFunc func(c *Client, args []*protocol.Value) (*protocol.Value, error)
+
+// call 以字符串参数执行命令
+func (c *Client) call(handler handlerFunc, args ...string) (*protocol.Value, error) {
+	values := make([]*protocol.Value, 0, len(args))
+	for _, arg := range args {
+		values = append(values, new(protocol.Value).SetBulk(arg))
+	}
+
+	res, err := c.s.Execute(c, func() (*protocol.Value, error) {
+		return handler(c, values)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := res.Error(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// callDenyOOM 执行可能增加内存占用的命令 内存不足且无法淘汰时返回 OOM 错误
+func (c *Client) callDenyOOM(handler handlerFunc, args ...string) (*protocol.Value, error) {
+	return c.call(func(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+		if err := c.s.performEvictions(); err != nil {
+			return nil, err
+		}
+		return handler(c, args)
+	}, args...)
+}
+
+func bulkStrings(values []*protocol.Value) []string {
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		strs = append(strs, v.Bulk())
+	}
+	return strs
+}
+
+// Select 切换客户端使用的数据库
+func (c *Client) Select(db int) error {
+	_, err := c.call(c.s.HandleSELECT, strconv.Itoa(db))
+	return err
+}
+
+// Get 获取字符串的值 key 不存在时 ok 为 false
+func (c *Client) Get(key string) (value string, ok bool, err error) {
+	res, err := c.call(c.s.HandleGET, key)
+	if err != nil {
+		return "", false, err
+	}
+	// GET 对不存在的 key 返回 nil 而不是空字符串
+	if res.IsNull() {
+		return "", false, nil
+	}
+	return res.Bulk(), true, nil
+}
+
+// Set 设置字符串的值 ttl 为 0 表示不过期
+func (c *Client) Set(key, value string, ttl time.Duration) error {
+	args := []string{key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := c.callDenyOOM(c.s.HandleSET, args...)
+	return err
+}
+
+// Del 删除 key 返回被删除的数量
+func (c *Client) Del(keys ...string) (int, error) {
+	res, err := c.call(c.s.HandleDEL, keys...)
+	if err != nil {
+		return 0, err
+	}
+	return res.Integer(), nil
+}
+
+// Exists 返回存在的 key 的数量
+func (c *Client) Exists(keys ...string) (int, error) {
+	res, err := c.call(c.s.HandleEXISTS, keys...)
+	if err != nil {
+		return 0, err
+	}
+	return res.Integer(), nil
+}
+
+// Expire 设置 key 的剩余生存时间 key 不存在时返回 false
+func (c *Client) Expire(key string, ttl time.Duration) (bool, error) {
+	res, err := c.call(c.s.HandlePEXPIRE, key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+	return res.Integer() == 1, nil
+}
+
+// TTL 返回 key 的剩余生存时间
+// 与 PTTL 一致 key 不存在时返回 -2 没有过期时间时返回 -1(单位均为纳秒)
+func (c *Client) TTL(key string) (time.Duration, error) {
+	res, err := c.call(c.s.HandlePTTL, key)
+	if err != nil {
+		return 0, err
+	}
+	if res.Integer() < 0 {
+		return time.Duration(res.Integer()), nil
+	}
+	return time.Duration(res.Integer()) * time.Millisecond, nil
+}
+
+// LPush 将值依次插入列表头部 返回插入后列表的长度
+func (c *Client) LPush(key string, values ...string) (int, error) {
+	res, err := c.callDenyOOM(c.s.HandleLPUSH, append([]string{key}, values...)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.Integer(), nil
+}
+
+// RPush 将值依次插入列表尾部 返回插入后列表的长度
+func (c *Client) RPush(key string, values ...string) (int, error) {
+	res, err := c.callDenyOOM(c.s.HandleRPUSH, append([]string{key}, values...)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.Integer(), nil
+}
+
+// LPop 弹出列表头部的元素 列表不存在时 ok 为 false
+func (c *Client) LPop(key string) (value string, ok bool, err error) {
+	res, err := c.call(c.s.HandleLPOP, key)
+	if err != nil {
+		return "", false, err
+	}
+	if res.IsNull() {
+		return "", false, nil
+	}
+	return res.Bulk(), true, nil
+}
+
+// LRange 返回列表中 [start, stop] 范围内的元素 支持负数下标
+func (c *Client) LRange(key string, start, stop int) ([]string, error) {
+	res, err := c.call(c.s.HandleLRANGE, key, strconv.Itoa(start), strconv.Itoa(stop))
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(res.Array()), nil
+}
+
+// LLen 返回列表的长度
+func (c *Client) LLen(key string) (int, error) {
+	res, err := c.call(c.s.HandleLLEN, key)
+	if err != nil {
+		return 0, err
+	}
+	return res.Integer(), nil
+}
+
+// XAdd 向 stream 追加条目 id 为 "*" 时自动生成 返回实际的 ID
+// fields 为 field1 value1 field2 value2 ...
+func (c *Client) XAdd(key, id string, fields ...string) (string, error) {
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return "", errors.New(emsgArgsNumber("xadd"))
+	}
+	res, err := c.callDenyOOM(c.s.HandleXADD, append([]string{key, id}, fields...)...)
+	if err != nil {
+		return "", err
+	}
+	return res.Bulk(), nil
+}
+
+// XRange 返回 ID 在 [start, end] 范围内的条目 可以使用 "-" 和 "+" 表示最小和最大 ID
+func (c *Client) XRange(key, start, end string) ([]StreamEntry, error) {
+	res, err := c.call(c.s.HandleXRANGE, key, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]StreamEntry, 0, len(res.Array()))
+	for _, item := range res.Array() {
+		pair := item.Array()
+		entries = append(entries, StreamEntry{
+			ID:     pair[0].Bulk(),
+			Fields: bulkStrings(pair[1].Array()),
+		})
+	}
+	return entries, nil
+}
+
+// Keys 返回匹配 glob 风格 pattern 的所有 key
+func (c *Client) Keys(pattern string) ([]string, error) {
+	res, err := c.call(c.s.HandleKEYS, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return bulkStrings(res.Array()), nil
+}
+
+// 以下方法作用于 0 号数据库
+
+func (s *KVStore) Get(key string) (string, bool, error) { return s.api.Get(key) }
+
+func (s *KVStore) Set(key, value string, ttl time.Duration) error {
+	return s.api.Set(key, value, ttl)
+}
+
+func (s *KVStore) Del(keys ...string) (int, error) { return s.api.Del(keys...) }
+
+func (s *KVStore) Exists(keys ...string) (int, error) { return s.api.Exists(keys...) }
+
+func (s *KVStore) Expire(key string, ttl time.Duration) (bool, error) {
+	return s.api.Expire(key, ttl)
+}
+
+func (s *KVStore) TTL(key string) (time.Duration, error) { return s.api.TTL(key) }
+
+func (s *KVStore) LPush(key string, values ...string) (int, error) {
+	return s.api.LPush(key, values...)
+}
+
+func (s *KVStore) RPush(key string, values ...string) (int, error) {
+	return s.api.RPush(key, values...)
+}
+
+func (s *KVStore) LPop(key string) (string, bool, error) { return s.api.LPop(key) }
+
+func (s *KVStore) LRange(key string, start, stop int) ([]string, error) {
+	return s.api.LRange(key, start, stop)
+}
+
+func (s *KVStore) LLen(key string) (int, error) { return s.api.LLen(key) }
+
+func (s *KVStore) XAdd(key, id string, fields ...string) (string, error) {
+	return s.api.XAdd(key, id, fields...)
+}
+
+func (s *KVStore) XRange(key, start, end string) ([]StreamEntry, error) {
+	return s.api.XRange(key, start, end)
+}
+
+func (s *KVStore) Keys(pattern string) ([]string, error) { return s.api.Keys(pattern) }
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// 并发读写的基准测试 Shards 为 1 时等价于全局锁 用来与默认的分片数量对比
+// go test -run ^$ -bench . -cpu 1,4,8 ./app/store
+
+const benchKeys = 1024
+
+var benchShards = []struct {
+	name   string
+	shards int
+}{
+	{"shards=1", 1},
+	{"shards=default", 0},
+}
+
+// runParallel 为每种分片数量创建存储 准备好数据后并发执行 op
+// 每个 goroutine 从不同的位置开始依次访问 benchKeys 个 key
+func runParallel(b *testing.B, setup func(s *KVStore, key string), op func(s *KVStore, key string) error) {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+
+	for _, bs := range benchShards {
+		b.Run(bs.name, func(b *testing.B) {
+			s := newTestStore(b, "locked", Options{Shards: bs.shards})
+			for _, key := range keys {
+				setup(s, key)
+			}
+
+			var seq atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seq.Add(1)) * 7919
+				for pb.Next() {
+					if err := op(s, keys[i%benchKeys]); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	runParallel(b, func(s *KVStore, key string) {
+		s.Set(key, "value", 0)
+	}, func(s *KVStore, key string) error {
+		_, _, err := s.Get(key)
+		return err
+	})
+}
+
+func BenchmarkSet(b *testing.B) {
+	runParallel(b, func(s *KVStore, key string) {}, func(s *KVStore, key string) error {
+		return s.Set(key, "value", 0)
+	})
+}
+
+func BenchmarkLRange(b *testing.B) {
+	values := make([]string, 16)
+	for i := range values {
+		values[i] = "item:" + strconv.Itoa(i)
+	}
+	runParallel(b, func(s *KVStore, key string) {
+		s.RPush(key, values...)
+	}, func(s *KVStore, key string) error {
+		_, err := s.LRange(key, 0, -1)
+		return err
+	})
+}
@@ -0,0 +1,290 @@
+package store
+
+// 阻塞命令的服务时机 与 redis 的 signalKeyAsReady / handleClientsBlockedOnKeys 对应
+// 写命令不会在执行过程中直接把数据交给阻塞的客户端 只是把有客户端等待的 key 标记为就绪
+// 命令执行结束后 再按 key 被标记的顺序 依次按 FIFO 顺序服务阻塞在这些 key 上的客户端
+// 因此写命令看到的是真实的列表长度 一条命令写入多个值时阻塞的客户端按 redis 的顺序拿到数据
+// 加锁模式下写命令在释放分片锁之前服务它锁住的就绪 key(见 serveLockedReadyKeys)
+// 其他客户端的命令不会在写入与服务之间取走数据 与 redis 中没有命令能插在两者之间一致
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// readyKey 有客户端阻塞等待 并且刚刚被写入的 key
+type readyKey struct {
+	db  *database
+	key string
+}
+
+// signalKeyAsReady 把 key 标记为就绪 没有客户端阻塞在 key 上时什么也不做
+// 同一个 key 在被服务之前只会记录一次
+// 外部必须持有 key 所在分片的锁
+func (s *KVStore) signalKeyAsReady(db *database, key string) {
+	sh := db.shard(key)
+	if len(sh.listWaiters[key]) == 0 && len(sh.streamWaiters[key]) == 0 {
+		return
+	}
+
+	rk := readyKey{db: db, key: key}
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	if _, ok := s.readySet[rk]; ok {
+		return
+	}
+	if s.readySet == nil {
+		s.readySet = make(map[readyKey]struct{})
+	}
+	s.readySet[rk] = struct{}{}
+	s.readyKeys = append(s.readyKeys, rk)
+	s.readyLen.Store(int32(len(s.readyKeys)))
+}
+
+// signalDeletedKeyAsReady key 被删除或者被覆盖时调用 与 redis 的 signalDeletedKeyAsReady 对应
+// 只有阻塞的 XREADGROUP 需要知道 stream 已经不存在 阻塞在列表上的客户端继续等待
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) signalDeletedKeyAsReady(db *database, key string) {
+	if len(db.shard(key).streamWaiters[key]) == 0 {
+		return
+	}
+	s.signalKeyAsReady(db, key)
+}
+
+// takeReadyKeys 取出所有就绪的 key
+func (s *KVStore) takeReadyKeys() []readyKey {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	keys := s.readyKeys
+	s.readyKeys = nil
+	s.readyLen.Store(0)
+	clear(s.readySet)
+	return keys
+}
+
+// takeReadyKeysFunc 按就绪的顺序取出满足 fn 的 key 其余的 key 保持原来的顺序
+func (s *KVStore) takeReadyKeysFunc(fn func(rk readyKey) bool) []readyKey {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	var keys []readyKey
+	rest := s.readyKeys[:0]
+	for _, rk := range s.readyKeys {
+		if fn(rk) {
+			keys = append(keys, rk)
+			delete(s.readySet, rk)
+		} else {
+			rest = append(rest, rk)
+		}
+	}
+	clear(s.readyKeys[len(rest):])
+	s.readyKeys = rest
+	s.readyLen.Store(int32(len(rest)))
+	return keys
+}
+
+// serveLockedReadyKeys 释放写锁之前调用 服务所有所在分片被 l 锁住的就绪 key
+// 阻塞的 BLMOVE 的目标列表不在 l 锁住的分片中时无法在这里服务 留给命令结束后的 handleReadyKeys
+func (s *KVStore) serveLockedReadyKeys(l shardLock) {
+	for s.readyLen.Load() > 0 {
+		keys := s.takeReadyKeysFunc(func(rk readyKey) bool {
+			if !l.holds(rk.db.shard(rk.key)) {
+				return false
+			}
+			for _, w := range rk.db.shard(rk.key).listWaiters[rk.key] {
+				if w.move && !l.holds(rk.db.shard(w.dst)) {
+					return false
+				}
+			}
+			return true
+		})
+		if len(keys) == 0 {
+			return
+		}
+		// 服务 BLMOVE 时可能又有 key 就绪
+		for _, rk := range keys {
+			s.serveListWaiters(rk.db, rk.key)
+			s.serveStreamWaiters(rk.db, rk.key)
+		}
+	}
+}
+
+// handleReadyKeys 每条命令执行结束后调用 按就绪的顺序服务阻塞的客户端
+// 加锁模式下大部分就绪的 key 已经在写命令释放锁之前被服务 这里只处理剩下的
+// 服务过程中又有 key 就绪时(例如阻塞的 BLMOVE 写入了目标列表)继续处理 直到没有就绪的 key
+// 调用时不能持有任何锁
+func (s *KVStore) handleReadyKeys() {
+	for {
+		keys := s.takeReadyKeys()
+		if len(keys) == 0 {
+			return
+		}
+		for _, rk := range keys {
+			s.serveReadyKey(rk)
+		}
+	}
+}
+
+// serveReadyKey 服务阻塞在 rk 上的客户端
+// 阻塞的 BLMOVE 被服务时同时写入目标列表 所以还要锁住这些目标列表所在的分片
+// 等待队列只能在持有锁时读取 加锁后发现了新的目标列表就释放重来
+func (s *KVStore) serveReadyKey(rk readyKey) {
+	keys := []string{rk.key}
+	for {
+		lk := s.lockKeys(rk.db, keys...)
+		n := len(keys)
+		for _, w := range rk.db.shard(rk.key).listWaiters[rk.key] {
+			if w.move && !slices.Contains(keys, w.dst) {
+				keys = append(keys, w.dst)
+			}
+		}
+		if len(keys) == n {
+			s.serveListWaiters(rk.db, rk.key)
+			s.serveStreamWaiters(rk.db, rk.key)
+			lk.unlock()
+			return
+		}
+		lk.unlock()
+	}
+}
+
+// hasReadyKeys 是否还有就绪的 key 等待服务
+func (s *KVStore) hasReadyKeys() bool {
+	return s.readyLen.Load() > 0
+}
+
+// blockState 客户端正在执行的阻塞命令 供 CLIENT UNBLOCK、CLIENT LIST 与 INFO 使用
+type blockState struct {
+	// keys 阻塞等待的 key
+	keys []string
+	// unblock 容量为 1 CLIENT UNBLOCK 写入 nil 表示按超时处理 否则以该错误回复
+	unblock chan error
+}
+
+// blockClient 记录客户端开始阻塞在 keys 上 命令结束时必须调用 unblockClient
+func (s *KVStore) blockClient(c *Client, keys []string) *blockState {
+	bs := &blockState{keys: keys, unblock: make(chan error, 1)}
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	c.blocked = bs
+	return bs
+}
+
+// unblockClient 客户端不再阻塞
+func (s *KVStore) unblockClient(c *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	c.blocked = nil
+}
+
+// clientCounts 返回已连接的客户端数量以及其中正在阻塞的数量
+func (s *KVStore) clientCounts() (connected, blocked int) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	for _, c := range s.clients {
+		if c.blocked != nil {
+			blocked++
+		}
+	}
+	return len(s.clients), blocked
+}
+
+// blockingKeys 有客户端阻塞等待的 key 的数量 与 redis 的 total_blocking_keys 对应
+// 等待队列为空时 key 会从 listWaiters/streamWaiters 中删除
+// 外部必须持有全局写锁
+func (s *KVStore) blockingKeys() int {
+	n := 0
+	for _, db := range s.dbs {
+		for _, sh := range db.shards {
+			n += len(sh.listWaiters)
+			for key := range sh.streamWaiters {
+				if _, ok := sh.listWaiters[key]; !ok {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// blockedWait 一次阻塞等待 注册好等待者之后交给 awaitBlocked
+// 等待者被服务时 ch 恰好被写入一次 done 由服务方与超时方竞争 先把它改为 true 的一方拥有这个客户端
+type blockedWait[T any] struct {
+	ch      <-chan T
+	done    *atomic.Bool
+	timeout time.Duration
+	// cleanup 把等待者从所有等待队列中移除
+	cleanup func()
+	// reply 用服务方送来的数据构造回复
+	reply func(T) *protocol.Value
+	// restore 连接断开时 数据已经交给客户端却没有人接收 由它放回原处 为 nil 时直接丢弃
+	restore func(T)
+}
+
+// awaitBlocked 阻塞命令等待的公共部分 统一处理超时、CLIENT UNBLOCK 与连接断开
+// 调用时 bs 已经由 blockClient 记录 并且不能持有任何锁
+// 超时、被 CLIENT UNBLOCK 以 TIMEOUT 唤醒时回复 nil 数组
+func awaitBlocked[T any](s *KVStore, c *Client, bs *blockState, w blockedWait[T]) (*protocol.Value, error) {
+	cleanup := func() {
+		s.unblockClient(c)
+		w.cleanup()
+	}
+
+	// 事件循环模式下不能阻塞执行 goroutine 挂起客户端 由之后的命令把数据送到 w.ch
+	if s.exec != nil {
+		ready := func() (*protocol.Value, bool) {
+			select {
+			case res := <-w.ch:
+				return w.reply(res), true
+			default:
+			}
+			// 被 CLIENT UNBLOCK 唤醒
+			select {
+			case err := <-bs.unblock:
+				w.done.Store(true)
+				if err != nil {
+					return new(protocol.Value).SetError(err.Error()), true
+				}
+				return new(protocol.Value).SetNullArray(), true
+			default:
+				return nil, false
+			}
+		}
+		s.exec.park(ready, new(protocol.Value).SetNullArray(), cleanup, w.timeout)
+		return nil, errParked
+	}
+
+	var timeoutCh <-chan time.Time
+	if w.timeout > 0 {
+		timeoutCh = s.clock.After(w.timeout)
+	}
+	defer cleanup()
+
+	select {
+	case res := <-w.ch:
+		return w.reply(res), nil
+	case <-timeoutCh:
+		// 超时的同时可能正好被服务 数据已经取出 必须交给客户端
+		if !w.done.CompareAndSwap(false, true) {
+			return w.reply(<-w.ch), nil
+		}
+		return new(protocol.Value).SetNullArray(), nil
+	case err := <-bs.unblock:
+		// CLIENT UNBLOCK 默认按超时处理
+		if !w.done.CompareAndSwap(false, true) {
+			return w.reply(<-w.ch), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return new(protocol.Value).SetNullArray(), nil
+	case <-c.ctx.Done():
+		// 连接已经断开 被服务时送来的数据没有人接收 放回原处
+		if !w.done.CompareAndSwap(false, true) && w.restore != nil {
+			w.restore(<-w.ch)
+		}
+		return nil, c.ctx.Err()
+	}
+}
@@ -0,0 +1,215 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/pkg/errors"
+)
+
+// errUnblocked CLIENT UNBLOCK id ERROR 时被唤醒的客户端收到的错误
+var errUnblocked = errors.New("UNBLOCKED client unblocked via CLIENT UNBLOCK")
+
+// Client 单个连接的会话状态
+// 除注明的字段外只会被所属连接的 goroutine 访问
+type Client struct {
+	s *KVStore
+	// id 与 redis 一致 从 1 开始递增 不会重复使用
+	id int64
+	// db 当前选中的数据库 只有所属 goroutine 会修改 修改时持有 KVStore.clientsMu
+	db *database
+	// ctx 连接断开时取消 阻塞命令据此停止等待
+	ctx context.Context
+
+	// addr 对端地址 ctime 连接建立的时间 只有网络连接才有
+	addr  string
+	ctime time.Time
+	// blocked 正在执行的阻塞命令 没有阻塞时为 nil 由 KVStore.clientsMu 保护
+	blocked *blockState
+}
+
+// NewClient 新连接默认使用 0 号数据库
+// 返回的客户端也可以直接作为 Go API 使用 见 api.go
+func (s *KVStore) NewClient() *Client {
+	return s.NewClientWithContext(context.Background())
+}
+
+// NewClientWithContext 与 NewClient 相同 ctx 被取消时客户端上正在阻塞的命令立即返回
+func (s *KVStore) NewClientWithContext(ctx context.Context) *Client {
+	return &Client{s: s, id: s.nextClientID.Add(1), db: s.dbs[0], ctx: ctx}
+}
+
+// Connect 为网络连接创建客户端 出现在 CLIENT LIST 中 可以被 CLIENT UNBLOCK 唤醒
+// ctx 应当在连接断开时取消 连接结束后必须调用 Close
+func (s *KVStore) Connect(ctx context.Context, addr string) *Client {
+	c := s.NewClientWithContext(ctx)
+	c.addr = addr
+	c.ctime = s.clock.Now()
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if s.clients == nil {
+		s.clients = make(map[int64]*Client)
+	}
+	s.clients[c.id] = c
+	return c
+}
+
+// Close 连接结束 从 CLIENT LIST 中移除
+func (c *Client) Close() {
+	c.s.clientsMu.Lock()
+	defer c.s.clientsMu.Unlock()
+	delete(c.s.clients, c.id)
+}
+
+// Context 返回客户端的 context
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+// ID 返回客户端的 id 与 CLIENT ID 相同
+func (c *Client) ID() int64 {
+	return c.id
+}
+
+// selectDB 切换当前数据库 CLIENT LIST 会在其他 goroutine 中读取
+func (c *Client) selectDB(db *database) {
+	c.s.clientsMu.Lock()
+	defer c.s.clientsMu.Unlock()
+	c.db = db
+}
+
+// HandleCLIENT
+// CLIENT ID
+// CLIENT INFO
+// CLIENT LIST [ID client-id [client-id ...]]
+// CLIENT UNBLOCK client-id [TIMEOUT|ERROR]
+// CLIENT HELP
+func (s *KVStore) HandleCLIENT(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("client"))
+	}
+
+	switch sub := strings.ToUpper(args[0].Bulk()); {
+	case sub == "ID" && len(args) == 1:
+		return new(protocol.Value).SetInteger(int(c.id)), nil
+	case sub == "INFO" && len(args) == 1:
+		s.clientsMu.Lock()
+		defer s.clientsMu.Unlock()
+		return new(protocol.Value).SetBulk(s.clientInfo(c) + "\n"), nil
+	case sub == "LIST":
+		return s.clientList(args[1:])
+	case sub == "UNBLOCK" && (len(args) == 2 || len(args) == 3):
+		return s.clientUnblock(args[1:])
+	case sub == "HELP" && len(args) == 1:
+		return helpReply("CLIENT",
+			"ID",
+			"    Return the ID of the current connection.",
+			"INFO",
+			"    Return information about the current client connection.",
+			"LIST [options ...]",
+			"    Return information about client connections. Options:",
+			"    * ID <client-id> [<client-id> ...]",
+			"      Return clients with the specified IDs only.",
+			"UNBLOCK <clientid> [TIMEOUT|ERROR]",
+			"    Unblock the specified blocked client.",
+		), nil
+	}
+
+	return nil, errors.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", args[0].Bulk())
+}
+
+// clientList CLIENT LIST [ID client-id [client-id ...]] 按 id 升序输出
+func (s *KVStore) clientList(args []*protocol.Value) (*protocol.Value, error) {
+	var ids []int64
+	if len(args) > 0 {
+		if !strings.EqualFold(args[0].Bulk(), "ID") || len(args) < 2 {
+			return nil, errors.New("ERR syntax error")
+		}
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(arg.Bulk(), 10, 64)
+			if err != nil || id <= 0 {
+				return nil, errors.New("ERR Invalid client ID")
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	clients := make([]*Client, 0, len(s.clients))
+	for id, cl := range s.clients {
+		if ids == nil || slices.Contains(ids, id) {
+			clients = append(clients, cl)
+		}
+	}
+	slices.SortFunc(clients, func(a, b *Client) int {
+		return cmp.Compare(a.id, b.id)
+	})
+
+	var b strings.Builder
+	for _, cl := range clients {
+		b.WriteString(s.clientInfo(cl))
+		b.WriteByte('\n')
+	}
+	return new(protocol.Value).SetBulk(b.String()), nil
+}
+
+// clientInfo CLIENT LIST 中的一行 阻塞中的客户端带有 b 标记 并列出阻塞的 key
+// 外部必须持有 clientsMu
+func (s *KVStore) clientInfo(c *Client) string {
+	flags := "N"
+	blockedKeys := ""
+	if c.blocked != nil {
+		flags = "b"
+		blockedKeys = strings.Join(c.blocked.keys, ",")
+	}
+	age := int64(0)
+	if !c.ctime.IsZero() {
+		age = int64(s.clock.Now().Sub(c.ctime).Seconds())
+	}
+	return fmt.Sprintf("id=%d addr=%s age=%d flags=%s db=%d blocked-keys=%s",
+		c.id, c.addr, age, flags, c.db.id, blockedKeys)
+}
+
+// clientUnblock CLIENT UNBLOCK client-id [TIMEOUT|ERROR]
+// 默认按超时处理 ERROR 时被唤醒的客户端收到 UNBLOCKED 错误
+// 客户端存在并且正在阻塞时返回 1 否则返回 0
+func (s *KVStore) clientUnblock(args []*protocol.Value) (*protocol.Value, error) {
+	id, err := strconv.ParseInt(args[0].Bulk(), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	var reason error
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1].Bulk()) {
+		case "TIMEOUT":
+		case "ERROR":
+			reason = errUnblocked
+		default:
+			return nil, errors.New("ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR")
+		}
+	}
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	cl, ok := s.clients[id]
+	if !ok || cl.blocked == nil {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+	select {
+	case cl.blocked.unblock <- reason:
+		return new(protocol.Value).SetInteger(1), nil
+	default:
+		// 已经被唤醒过 还没来得及返回
+		return new(protocol.Value).SetInteger(0), nil
+	}
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/clock"
+)
+
+// 使用 clock.Fake 的测试 时间只在调用 Advance 时前进 结果与机器的快慢无关
+
+var fakeEpoch = time.UnixMilli(1700000000000)
+
+func TestFakeClockTTL(t *testing.T) {
+	clk := clock.NewFake(fakeEpoch)
+	s := newTestStore(t, "locked", Options{Clock: clk})
+
+	if err := s.Set("k", "v", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := s.TTL("k"); ttl != 10*time.Second {
+		t.Fatalf("TTL = %v, want 10s", ttl)
+	}
+
+	clk.Advance(4 * time.Second)
+	if ttl, _ := s.TTL("k"); ttl != 6*time.Second {
+		t.Fatalf("TTL = %v, want 6s", ttl)
+	}
+
+	clk.Advance(6 * time.Second)
+	if _, ok, _ := s.Get("k"); ok {
+		t.Fatal("key should have expired")
+	}
+}
+
+// 主动过期由时钟的 ticker 驱动 不访问 key 也会被删除
+func TestFakeClockActiveExpire(t *testing.T) {
+	clk := clock.NewFake(fakeEpoch)
+	s := newTestStore(t, "locked", Options{Clock: clk})
+
+	for i := range 10 {
+		if err := s.Set("k"+strconv.Itoa(i), "v", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.stats.expiredKeys.Load() < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired %d keys, want 10", s.stats.expiredKeys.Load())
+		}
+		clk.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClockBlockingTimeout(t *testing.T) {
+	for _, mode := range executionModes {
+		t.Run(mode, func(t *testing.T) {
+			clk := clock.NewFake(fakeEpoch)
+			s := newTestStore(t, mode, Options{Clock: clk})
+			c := s.NewClient()
+
+			type result struct {
+				null bool
+				err  error
+			}
+			ch := make(chan result, 1)
+			go func() {
+				res, err := c.call(s.HandleBLPOP, "list", "2")
+				ch <- result{null: err == nil && res.Array() == nil, err: err}
+			}()
+			waitBlocked(t, c)
+
+			// 超时前不返回
+			clk.Advance(time.Second)
+			select {
+			case res := <-ch:
+				t.Fatalf("BLPOP returned early: %+v", res)
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			// 定时器可能在阻塞之后才注册 一直推进到超时为止
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				clk.Advance(time.Second)
+				select {
+				case res := <-ch:
+					if res.err != nil || !res.null {
+						t.Fatalf("BLPOP = %+v, want null array", res)
+					}
+					return
+				case <-time.After(time.Millisecond):
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("BLPOP did not time out")
+				}
+			}
+		})
+	}
+}
+
+func TestFakeClockXAddAutoID(t *testing.T) {
+	clk := clock.NewFake(fakeEpoch)
+	s := newTestStore(t, "locked", Options{Clock: clk})
+	ms := strconv.FormatInt(fakeEpoch.UnixMilli(), 10)
+
+	want := []string{ms + "-0", ms + "-1"}
+	for _, w := range want {
+		id, err := s.XAdd("s", "*", "f", "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != w {
+			t.Fatalf("XADD * = %s, want %s", id, w)
+		}
+	}
+
+	clk.Advance(time.Millisecond)
+	id, err := s.XAdd("s", "*", "f", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := strconv.FormatInt(fakeEpoch.UnixMilli()+1, 10) + "-0"; id != w {
+		t.Fatalf("XADD * = %s, want %s", id, w)
+	}
+}
@@ -5,27 +5,35 @@ import (
 	"github.com/pkg/errors"
 )
 
-func (s *KVStore) HandleTYPE(args []*protocol.Value) (*protocol.Value, error) {
+func (s *KVStore) HandleTYPE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
 	if len(args) > 1 {
 		return nil, errors.New(emsgArgsNumber("type"))
 	}
 
 	key := args[0].Bulk()
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	entity, ok := s.store[key]
+	defer s.rlockKeys(c.db, key).unlock()
+	entity, ok := s.rawPeek(c.db, key)
 	if !ok {
 		return new(protocol.Value).SetStr("none"), nil
 	}
-	switch entity.Type {
+	name := entity.typeName()
+	if name == "" {
+		return nil, errors.New(emsgKeyType())
+	}
+
+	return new(protocol.Value).SetStr(name), nil
+}
+
+// typeName TYPE 命令返回的类型名称
+func (e *Entity) typeName() string {
+	switch e.Type {
 	case TypeString:
-		return new(protocol.Value).SetStr("string"), nil
+		return "string"
 	case TypeList:
-		return new(protocol.Value).SetStr("list"), nil
+		return "list"
 	case TypeStream:
-		return new(protocol.Value).SetStr("stream"), nil
+		return "stream"
 	}
-
-	return nil, errors.New(emsgKeyType())
+	return ""
 }
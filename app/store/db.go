@@ -0,0 +1,354 @@
+package store
+
+import (
+	"fmt"
+	"hash/maphash"
+	"log"
+	"math/bits"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/dict"
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/pkg/errors"
+)
+
+// database 单个逻辑数据库 与 redis 的 redisDb 对应
+// 通过 SELECT 切换 各数据库的键空间相互独立
+// 键空间按 key 的哈希值拆分为多个独立加锁的分片 见 shard.go
+type database struct {
+	id     int
+	shards []*shard
+	// seed 计算 key 所属分片的哈希种子 所有数据库共用同一个种子
+	// 因此同一个 key 在各数据库中位于相同下标的分片 SWAPDB 可以逐个分片交换数据
+	seed maphash.Seed
+}
+
+// newDatabase n 必须是 2 的幂
+func newDatabase(id, n int, seed maphash.Seed) *database {
+	db := &database{id: id, shards: make([]*shard, n), seed: seed}
+	for i := range db.shards {
+		db.shards[i] = newShard(id, i)
+	}
+	return db
+}
+
+// shard 返回 key 所在的分片
+func (db *database) shard(key string) *shard {
+	return db.shards[maphash.String(db.seed, key)&uint64(len(db.shards)-1)]
+}
+
+func (db *database) shardsOf(keys []string) []*shard {
+	shards := make([]*shard, len(keys))
+	for i, key := range keys {
+		shards[i] = db.shard(key)
+	}
+	return shards
+}
+
+// scan 与 redis 的 kvstoreScan 对应 游标的低位是分片下标 其余高位是分片内哈希表的游标
+// 一个分片遍历结束后从下一个非空分片的游标 0 继续 所有分片都遍历结束时返回 0
+// 外部必须持有所有分片的锁
+func (db *database) scan(cursor uint64, fn func(key string, entity *Entity)) uint64 {
+	n := uint64(len(db.shards))
+	shift := bits.TrailingZeros64(n)
+	idx := cursor & (n - 1)
+
+	cursor = db.shards[idx].store.Scan(cursor>>shift, fn)
+	if cursor == 0 {
+		for idx++; idx < n && db.shards[idx].store.Len() == 0; idx++ {
+		}
+		if idx == n {
+			return 0
+		}
+	}
+	return cursor<<shift | idx
+}
+
+// size 所有分片中 key 的数量之和(可能包含已过期但尚未删除的 key)
+// 外部必须持有全局写锁或所有分片的锁
+func (db *database) size() int {
+	n := 0
+	for _, sh := range db.shards {
+		n += sh.store.Len()
+	}
+	return n
+}
+
+// expiresSize 设置了过期时间的 key 的数量 加锁要求同 size
+func (db *database) expiresSize() int {
+	n := 0
+	for _, sh := range db.shards {
+		n += sh.expires.len()
+	}
+	return n
+}
+
+// parseDBIndex 解析数据库编号 超出范围时返回错误
+func (s *KVStore) parseDBIndex(arg *protocol.Value) (*database, error) {
+	id, err := arg.BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if id < 0 || id >= len(s.dbs) {
+		return nil, errors.New("ERR DB index is out of range")
+	}
+	return s.dbs[id], nil
+}
+
+// emptyDB 清空数据库 返回被删除的 key 的数量
+// async 时旧的键空间在后台释放
+// 外部必须持有全局写锁
+func (s *KVStore) emptyDB(db *database, async bool) int {
+	removed := 0
+	for _, sh := range db.shards {
+		old := sh.store
+		removed += old.Len()
+		sh.store = dict.New[*Entity]()
+		sh.expires = newExpireIndex()
+		s.usedMemory.Add(-sh.used)
+		sh.used = 0
+		for key := range sh.streamWaiters {
+			s.signalKeyAsReady(db, key)
+		}
+
+		if async && old.Len() > 0 {
+			s.lazyfreePending.Add(int64(old.Len()))
+			go func() {
+				old.Range(func(_ string, entity *Entity) bool {
+					entity.free()
+					s.lazyfreePending.Add(-1)
+					return true
+				})
+			}()
+		}
+	}
+	return removed
+}
+
+// parseFlushMode FLUSHDB/FLUSHALL 的 [ASYNC | SYNC] 选项 默认同步释放
+func parseFlushMode(name string, args []*protocol.Value) (bool, error) {
+	switch len(args) {
+	case 0:
+		return false, nil
+	case 1:
+		switch strings.ToUpper(args[0].Bulk()) {
+		case "ASYNC":
+			return true, nil
+		case "SYNC":
+			return false, nil
+		}
+		return false, errors.New("ERR syntax error")
+	}
+	return false, errors.New(emsgArgsNumber(name))
+}
+
+// HandleSELECT
+// SELECT index
+// 切换当前连接使用的数据库
+func (s *KVStore) HandleSELECT(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 1 {
+		return nil, errors.New(emsgArgsNumber("select"))
+	}
+
+	db, err := s.parseDBIndex(args[0])
+	if err != nil {
+		return nil, err
+	}
+	c.selectDB(db)
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleMOVE
+// MOVE key db
+// 将 key 移动到另一个数据库 过期时间随之转移
+// 移动成功返回 1 key 不存在或目标数据库中已存在同名 key 时返回 0
+func (s *KVStore) HandleMOVE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New(emsgArgsNumber("move"))
+	}
+
+	key := args[0].Bulk()
+	dst, err := s.parseDBIndex(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if dst == c.db {
+		return nil, errors.New("ERR source and destination objects are the same")
+	}
+
+	defer s.lockShards(true, c.db.shard(key), dst.shard(key)).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+	if _, exist := s.rawGet(dst, key); exist {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+
+	s.dbDelete(c.db, key)
+	s.rawSet(dst, key, entity)
+	s.dirty.Add(1)
+	s.propagate(c.db, "MOVE", key, strconv.Itoa(dst.id))
+
+	s.signalKeyAsReady(dst, key)
+	return new(protocol.Value).SetInteger(1), nil
+}
+
+// HandleSWAPDB
+// SWAPDB index1 index2
+// 交换两个数据库的数据 连接以及阻塞的客户端仍然留在原来的编号上 因此会立即看到另一个数据库的数据
+func (s *KVStore) HandleSWAPDB(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New(emsgArgsNumber("swapdb"))
+	}
+
+	id1, err := args[0].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR invalid first DB index")
+	}
+	id2, err := args[1].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR invalid second DB index")
+	}
+	if id1 < 0 || id1 >= len(s.dbs) || id2 < 0 || id2 >= len(s.dbs) {
+		return nil, errors.New("ERR DB index is out of range")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if id1 == id2 {
+		return new(protocol.Value).SetStr("OK"), nil
+	}
+
+	db1, db2 := s.dbs[id1], s.dbs[id2]
+	for i, sh1 := range db1.shards {
+		sh2 := db2.shards[i]
+		sh1.store, sh2.store = sh2.store, sh1.store
+		sh1.expires, sh2.expires = sh2.expires, sh1.expires
+		sh1.used, sh2.used = sh2.used, sh1.used
+	}
+	s.dirty.Add(1)
+	s.propagate(nil, "SWAPDB", strconv.Itoa(id1), strconv.Itoa(id2))
+
+	// 交换后等待中的 key 可能已经有数据了
+	for _, db := range []*database{db1, db2} {
+		for _, sh := range db.shards {
+			for key := range sh.listWaiters {
+				s.signalKeyAsReady(db, key)
+			}
+			for key := range sh.streamWaiters {
+				s.signalKeyAsReady(db, key)
+			}
+		}
+	}
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleDBSIZE
+// DBSIZE
+// 返回当前数据库中 key 的数量(可能包含已过期但尚未删除的 key)
+func (s *KVStore) HandleDBSIZE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 0 {
+		return nil, errors.New(emsgArgsNumber("dbsize"))
+	}
+
+	defer s.lockShards(false, c.db.shards...).unlock()
+
+	return new(protocol.Value).SetInteger(c.db.size()), nil
+}
+
+// HandleFLUSHDB
+// FLUSHDB [ASYNC | SYNC]
+// 清空当前数据库
+func (s *KVStore) HandleFLUSHDB(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	async, err := parseFlushMode("flushdb", args)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.dirty.Add(int64(s.emptyDB(c.db, async)))
+	s.propagate(c.db, "FLUSHDB")
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleFLUSHALL
+// FLUSHALL [ASYNC | SYNC]
+// 清空所有数据库 配置了 save 规则时与 redis 一致 立即保存一份空的 rdb
+func (s *KVStore) HandleFLUSHALL(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	async, err := parseFlushMode("flushall", args)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	for _, db := range s.dbs {
+		s.dirty.Add(int64(s.emptyDB(db, async)))
+	}
+	s.propagate(nil, "FLUSHALL")
+	dirty := s.dirty.Load()
+	s.mutex.Unlock()
+
+	if len(s.cfg.SaveParams) > 0 && s.saving.CompareAndSwap(false, true) {
+		defer s.saving.Store(false)
+		if err := s.rdbSaveSnapshot(nil, dirty, fmt.Sprintf("temp-%d.rdb", os.Getpid())); err != nil {
+			log.Printf("rdb: save after FLUSHALL failed: %+v", err)
+		}
+	}
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleRANDOMKEY
+// RANDOMKEY
+// 随机返回当前数据库中的一个 key 数据库为空时返回 nil
+func (s *KVStore) HandleRANDOMKEY(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 0 {
+		return nil, errors.New(emsgArgsNumber("randomkey"))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// 与 redis 一致 抽到已过期的 key 时删除后重试
+	now := s.clock.Now()
+	for {
+		key, entity, ok := c.db.randomKey()
+		if !ok {
+			return new(protocol.Value).SetNullBulk(), nil
+		}
+		if entity.isExpired(now) {
+			s.expireKey(c.db, key)
+			continue
+		}
+		return new(protocol.Value).SetBulk(key), nil
+	}
+}
+
+// randomKey 按各分片的 key 数量加权选择分片 再在分片中随机选择 key
+// 这样每个 key 被选中的概率与它所在的分片无关
+// 外部必须持有全局写锁
+func (db *database) randomKey() (string, *Entity, bool) {
+	total := db.size()
+	if total == 0 {
+		return "", nil, false
+	}
+	n := rand.IntN(total)
+	for _, sh := range db.shards {
+		if n < sh.store.Len() {
+			return sh.store.RandomKey()
+		}
+		n -= sh.store.Len()
+	}
+	return "", nil, false
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/pkg/errors"
+)
+
+// HandleDEBUG
+// DEBUG SET-ACTIVE-EXPIRE 0|1
+// DEBUG SLEEP seconds
+// 供测试使用的调试命令
+func (s *KVStore) HandleDEBUG(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("debug"))
+	}
+
+	sub := strings.ToUpper(args[0].Bulk())
+	switch {
+	case sub == "SET-ACTIVE-EXPIRE" && len(args) == 2:
+		// 关闭后过期的 key 只会在被访问时删除 便于测试惰性过期
+		enabled, err := args[1].BulkToInteger()
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+
+		s.mutex.Lock()
+		s.activeExpireDisabled = enabled == 0
+		s.mutex.Unlock()
+
+		return new(protocol.Value).SetStr("OK"), nil
+	case sub == "SLEEP" && len(args) == 2:
+		// 与 redis 一致 睡眠期间整个服务器都被阻塞
+		// 使用 clock.Fake 时只是把时钟向前推进 不会真正等待
+		seconds, err := strconv.ParseFloat(args[1].Bulk(), 64)
+		if err != nil {
+			return nil, errors.New("ERR value is not a valid float")
+		}
+
+		s.mutex.Lock()
+		s.clock.Sleep(time.Duration(seconds * float64(time.Second)))
+		s.mutex.Unlock()
+
+		return new(protocol.Value).SetStr("OK"), nil
+	}
+
+	return nil, errors.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try DEBUG HELP.", args[0].Bulk())
+}
@@ -0,0 +1,430 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/pkg/errors"
+)
+
+// createDumpPayload 序列化单个实体 格式与 redis 的 DUMP 一致
+// <type> <value> <rdb-version 2 字节小端> <crc64 8 字节小端>
+// 校验和覆盖前面的所有字节
+func (s *KVStore) createDumpPayload(entity *Entity) (string, error) {
+	var buf bytes.Buffer
+	enc := rdb.NewEncoder(&buf)
+	enc.Compress = s.cfg.RDBCompression
+
+	if err := enc.WriteByte(rdbObjectType(entity)); err != nil {
+		return "", err
+	}
+	if err := rdbSaveObject(enc, entity); err != nil {
+		return "", err
+	}
+
+	var footer [2]byte
+	binary.LittleEndian.PutUint16(footer[:], rdb.Version)
+	buf.Write(footer[:])
+
+	var crc [8]byte
+	binary.LittleEndian.PutUint64(crc[:], rdb.CRC64(0, buf.Bytes()))
+	buf.Write(crc[:])
+
+	return buf.String(), nil
+}
+
+// loadDumpPayload 校验版本和校验和后反序列化
+func (s *KVStore) loadDumpPayload(payload string) (*Entity, error) {
+	p := []byte(payload)
+	if len(p) < 10 {
+		return nil, errors.New("ERR DUMP payload version or checksum are wrong")
+	}
+
+	footer := p[len(p)-10:]
+	version := binary.LittleEndian.Uint16(footer)
+	crc := binary.LittleEndian.Uint64(footer[2:])
+	if version > rdb.MaxVersion || crc != rdb.CRC64(0, p[:len(p)-8]) {
+		return nil, errors.New("ERR DUMP payload version or checksum are wrong")
+	}
+
+	dec := rdb.NewDecoderSize(bytes.NewReader(p[:len(p)-10]), int64(len(p)-10))
+	typ, err := dec.ReadByte()
+	if err != nil {
+		return nil, errors.New("ERR Bad data format")
+	}
+	// 不支持的类型会被跳过 对 RESTORE 来说同样是无法使用的数据
+	entity, err := s.rdbLoadObject(dec, typ)
+	if err != nil || entity == nil {
+		return nil, errors.New("ERR Bad data format")
+	}
+	return entity, nil
+}
+
+// HandleDUMP
+// DUMP key
+// 返回 key 对应值的序列化结果 key 不存在时返回 nil
+func (s *KVStore) HandleDUMP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 1 {
+		return nil, errors.New(emsgArgsNumber("dump"))
+	}
+
+	key := args[0].Bulk()
+
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawLookup(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetNullBulk(), nil
+	}
+
+	payload, err := s.createDumpPayload(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(protocol.Value).SetBulk(payload), nil
+}
+
+// HandleRESTORE
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+// ttl 为 0 表示不过期 否则为毫秒级的相对时间 指定 ABSTTL 时为毫秒级的 unix 时间戳
+func (s *KVStore) HandleRESTORE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 3 {
+		return nil, errors.New(emsgArgsNumber("restore"))
+	}
+
+	key := args[0].Bulk()
+	payload := args[2].Bulk()
+
+	ttl, err := args[1].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return nil, errors.New("ERR Invalid TTL value, must be >= 0")
+	}
+
+	replace, absTTL := false, false
+	idle, freq := -1, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk()) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) || freq != -1 {
+				return nil, errors.New("ERR syntax error")
+			}
+			i++
+			v, err := args[i].BulkToInteger()
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if v < 0 {
+				return nil, errors.New("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			idle = v
+		case "FREQ":
+			if i+1 >= len(args) || idle != -1 {
+				return nil, errors.New("ERR syntax error")
+			}
+			i++
+			v, err := args[i].BulkToInteger()
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if v < 0 || v > 255 {
+				return nil, errors.New("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			freq = v
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	entity, err := s.loadDumpPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var expAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expAt = time.UnixMilli(int64(ttl))
+		} else {
+			expAt = s.clock.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+	entity.ExpiredAt = expAt
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	if _, exist := s.rawGet(c.db, key); exist && !replace {
+		return nil, errors.New("BUSYKEY Target key name already exists.")
+	}
+
+	// 已经过期的值无需写入 但 REPLACE 语义要求删除旧值
+	if entity.isExpired(s.clock.Now()) {
+		if s.rawDelete(c.db, key) {
+			s.dirty.Add(1)
+			s.propagate(c.db, "DEL", key)
+		}
+		return new(protocol.Value).SetStr("OK"), nil
+	}
+
+	s.rawSet(c.db, key, entity)
+	setLRUOrLFU(entity, int64(freq), int64(idle), s.clock.Now())
+	s.dirty.Add(1)
+
+	// 统一以绝对时间记录 重放时才不会产生偏差
+	propagateArgs := []string{"RESTORE", key, "0", payload, "REPLACE"}
+	if !expAt.IsZero() {
+		propagateArgs[2] = strconv.FormatInt(expAt.UnixMilli(), 10)
+		propagateArgs = append(propagateArgs, "ABSTTL")
+	}
+	s.propagate(c.db, propagateArgs...)
+
+	s.signalKeyAsReady(c.db, key)
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+type migrateOptions struct {
+	addr     string
+	db       int
+	timeout  time.Duration
+	keys     []string
+	copy     bool
+	replace  bool
+	username string
+	password string
+}
+
+func parseMigrateOptions(args []*protocol.Value) (*migrateOptions, error) {
+	if len(args) < 5 {
+		return nil, errors.New(emsgArgsNumber("migrate"))
+	}
+
+	opts := &migrateOptions{
+		addr: net.JoinHostPort(args[0].Bulk(), args[1].Bulk()),
+	}
+
+	db, err := args[3].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	opts.db = db
+
+	timeout, err := args[4].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	opts.timeout = time.Duration(timeout) * time.Millisecond
+
+	key := args[2].Bulk()
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk()) {
+		case "COPY":
+			opts.copy = true
+		case "REPLACE":
+			opts.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			i++
+			opts.password = args[i].Bulk()
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			opts.username = args[i+1].Bulk()
+			opts.password = args[i+2].Bulk()
+			i += 2
+		case "KEYS":
+			if key != "" {
+				return nil, errors.New("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, k := range args[i+1:] {
+				opts.keys = append(opts.keys, k.Bulk())
+			}
+			i = len(args)
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	if key != "" {
+		opts.keys = []string{key}
+	}
+	return opts, nil
+}
+
+// HandleMIGRATE
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+// 将 key 以 RESTORE 的形式发送到目标实例 目标实例确认后(未指定 COPY 时)再删除本地的 key
+// 只在序列化和删除时持有这些 key 所在分片的写锁 网络交互期间不阻塞其他命令
+// 迁移期间被修改过的 key 不会被删除 目标实例上是修改之前的值 此时返回错误 由调用方决定如何处理
+func (s *KVStore) HandleMIGRATE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	opts, err := parseMigrateOptions(args)
+	if err != nil {
+		return nil, err
+	}
+
+	type migrateItem struct {
+		key     string
+		ttl     int64
+		payload string
+		// entity 与 expiredAt 序列化时的值 删除前据此判断 key 是否被修改过
+		entity    *Entity
+		expiredAt time.Time
+	}
+
+	lk := s.lockKeys(c.db, opts.keys...)
+	now := s.clock.Now()
+	items := make([]migrateItem, 0, len(opts.keys))
+	for _, key := range opts.keys {
+		entity, ok := s.rawGet(c.db, key)
+		if !ok {
+			continue
+		}
+
+		payload, err := s.createDumpPayload(entity)
+		if err != nil {
+			lk.unlock()
+			return nil, err
+		}
+
+		var ttl int64
+		if !entity.ExpiredAt.IsZero() {
+			ttl = entity.ExpiredAt.Sub(now).Milliseconds()
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+		items = append(items, migrateItem{key: key, ttl: ttl, payload: payload, entity: entity, expiredAt: entity.ExpiredAt})
+	}
+	lk.unlock()
+
+	if len(items) == 0 {
+		return new(protocol.Value).SetStr("NOKEY"), nil
+	}
+
+	conn, err := net.DialTimeout("tcp", opts.addr, opts.timeout)
+	if err != nil {
+		return nil, errors.New("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	// 网络超时使用真实时间 不经过 s.clock
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+
+	// 先一次性写出所有命令 再依次读取回复
+	var buf bytes.Buffer
+	writeCmd := func(cmd ...string) {
+		values := make([]*protocol.Value, 0, len(cmd))
+		for _, c := range cmd {
+			values = append(values, new(protocol.Value).SetBulk(c))
+		}
+		buf.Write(new(protocol.Value).SetArray(values).Marshal())
+	}
+
+	replies := 0
+	if opts.password != "" {
+		if opts.username != "" {
+			writeCmd("AUTH", opts.username, opts.password)
+		} else {
+			writeCmd("AUTH", opts.password)
+		}
+		replies++
+	}
+	if opts.db != 0 {
+		writeCmd("SELECT", strconv.Itoa(opts.db))
+		replies++
+	}
+	for _, item := range items {
+		cmd := []string{"RESTORE", item.key, strconv.FormatInt(item.ttl, 10), item.payload}
+		if opts.replace {
+			cmd = append(cmd, "REPLACE")
+		}
+		writeCmd(cmd...)
+	}
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, errors.New("IOERR error or timeout writing to target instance")
+	}
+
+	resp := protocol.NewResp(conn)
+	for i := 0; i < replies; i++ {
+		reply, err := resp.Read()
+		if err != nil {
+			return nil, errors.New("IOERR error or timeout reading to target instance")
+		}
+		if e := reply.Error(); e != nil {
+			return nil, errors.Errorf("ERR Target instance replied with error: %s", e.Error())
+		}
+	}
+
+	// 只删除目标实例确认成功的 key
+	var firstErr error
+	migrated := make([]migrateItem, 0, len(items))
+	for _, item := range items {
+		reply, err := resp.Read()
+		if err != nil {
+			firstErr = errors.New("IOERR error or timeout reading to target instance")
+			break
+		}
+		if e := reply.Error(); e != nil {
+			if firstErr == nil {
+				firstErr = errors.Errorf("ERR Target instance replied with error: %s", e.Error())
+			}
+			continue
+		}
+		migrated = append(migrated, item)
+	}
+
+	if !opts.copy && len(migrated) > 0 {
+		lk := s.lockKeys(c.db, opts.keys...)
+		deleted := make([]string, 0, len(migrated))
+		for _, item := range migrated {
+			if !s.migrateUnchanged(c.db, item.key, item.entity, item.expiredAt, item.payload) {
+				if firstErr == nil {
+					firstErr = errors.Errorf("ERR Key '%s' was modified during MIGRATE and was not deleted", item.key)
+				}
+				continue
+			}
+			s.rawDelete(c.db, item.key)
+			deleted = append(deleted, item.key)
+		}
+		if len(deleted) > 0 {
+			s.dirty.Add(int64(len(deleted)))
+			s.propagate(c.db, append([]string{"DEL"}, deleted...)...)
+		}
+		lk.unlock()
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// migrateUnchanged key 的值和过期时间是否与迁移时序列化的相同
+// 列表、stream 会被原地修改 实体相同时还要重新序列化比较
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) migrateUnchanged(db *database, key string, entity *Entity, expiredAt time.Time, payload string) bool {
+	cur, ok := s.rawGet(db, key)
+	if !ok || cur != entity || !cur.ExpiredAt.Equal(expiredAt) {
+		return false
+	}
+	p, err := s.createDumpPayload(cur)
+	return err == nil && p == payload
+}
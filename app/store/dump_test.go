@@ -0,0 +1,173 @@
+package store
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+)
+
+// dumpPayload 在 body 后面补上版本号和校验和
+func dumpPayload(body []byte) string {
+	p := append([]byte{}, body...)
+	p = binary.LittleEndian.AppendUint16(p, rdb.Version)
+	p = binary.LittleEndian.AppendUint64(p, rdb.CRC64(0, p))
+	return string(p)
+}
+
+func TestRestoreRejectsOutOfRangeLength(t *testing.T) {
+	s := newTestStore(t, "locked", Options{})
+	c := s.NewClient()
+
+	cases := map[string][]byte{
+		// 字符串 64 位长度
+		"string": {rdb.TypeString, 0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		// 字符串 长度转为 int 后为负数
+		"negative": {rdb.TypeString, 0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		// LZF 压缩字符串 解压后的长度远大于压缩数据能展开的长度
+		"lzf": {rdb.TypeString, 0xc3, 0x01, 0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00},
+		// 列表元素数量
+		"list": {rdb.TypeList, 0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		// quicklist 节点数量
+		"quicklist": {rdb.TypeListQuicklist2, 0x80, 0xff, 0xff, 0xff, 0xff},
+		// stream 节点数量
+		"stream": {rdb.TypeStreamListpacks2, 0x80, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, body := range cases {
+		_, err := c.call(s.HandleRESTORE, "k", "0", dumpPayload(body))
+		if err == nil || err.Error() != "ERR Bad data format" {
+			t.Errorf("%s: got %v, want ERR Bad data format", name, err)
+		}
+	}
+
+	// 消费者组数量超出剩余数据
+	body := []byte{rdb.TypeStreamListpacks2, 0x00}
+	for i := 0; i < 3+5; i++ {
+		body = append(body, 0x00)
+	}
+	body = append(body, 0x81, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if _, err := c.call(s.HandleRESTORE, "k", "0", dumpPayload(body)); err == nil || err.Error() != "ERR Bad data format" {
+		t.Errorf("groups: got %v, want ERR Bad data format", err)
+	}
+}
+
+func TestDumpRestoreStream(t *testing.T) {
+	s := newTestStore(t, "locked", Options{})
+	c := s.NewClient()
+
+	if _, err := c.XAdd("s", "1-1", "f", "v"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.call(s.HandleDUMP, "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.call(s.HandleRESTORE, "s2", "0", res.Bulk()); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := c.XRange("s2", "-", "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != "1-1" {
+		t.Fatalf("got %v", entries)
+	}
+}
+
+// migrateTarget 模拟 MIGRATE 的目标实例 对每条命令回复 OK
+// 收到 RESTORE 时先调用 onRestore 再回复
+func migrateTarget(t *testing.T, onRestore func(key string)) (host, port string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		resp := protocol.NewResp(conn)
+		for {
+			cmd, err := resp.Read()
+			if err != nil {
+				return
+			}
+			if args := cmd.Array(); len(args) > 1 && args[0].Bulk() == "RESTORE" {
+				onRestore(args[1].Bulk())
+			}
+			if _, err := conn.Write([]byte("+OK\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), strconv.Itoa(addr.Port)
+}
+
+// 网络交互期间不持有锁 被修改过的 key 不会被删除 并且 MIGRATE 返回错误
+func TestMigrateReportsKeysModifiedDuringIO(t *testing.T) {
+	s := newTestStore(t, "locked", Options{})
+	c := s.NewClient()
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.RPush(key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	host, port := migrateTarget(t, func(key string) {
+		if key != "a" {
+			return
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.NewClient().RPush("a", "2")
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("RPUSH blocked while MIGRATE was waiting for the target")
+		}
+	})
+
+	_, err := c.call(s.HandleMIGRATE, host, port, "", "0", "5000", "KEYS", "a", "b")
+	if want := "ERR Key 'a' was modified during MIGRATE and was not deleted"; err == nil || err.Error() != want {
+		t.Fatalf("MIGRATE error = %v, want %q", err, want)
+	}
+	if got, _ := s.LRange("a", 0, -1); !slices.Equal(got, []string{"1", "2"}) {
+		t.Fatalf("LRANGE a = %v, want [1 2]", got)
+	}
+	if n, _ := s.Exists("b"); n != 0 {
+		t.Fatalf("EXISTS b = %d, want 0", n)
+	}
+}
+
+// 没有被修改的 key 迁移后从本地删除
+func TestMigrateDeletesMigratedKeys(t *testing.T) {
+	s := newTestStore(t, "locked", Options{})
+	c := s.NewClient()
+	if err := s.Set("a", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	host, port := migrateTarget(t, func(string) {})
+	if _, err := c.call(s.HandleMIGRATE, host, port, "a", "0", "5000"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Exists("a"); n != 0 {
+		t.Fatalf("EXISTS a = %d, want 0", n)
+	}
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// evictionPoolSize 淘汰池的容量 与 redis 的 EVPOOL_SIZE 一致
+const evictionPoolSize = 16
+
+// errOOM 内存超出 maxmemory 并且没有可以淘汰的 key
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// evictionCandidate 淘汰池中的候选 key
+type evictionCandidate struct {
+	// idle 越大越应该被淘汰
+	// LRU 为空闲时间 LFU 为 255 减去计数器 TTL 为过期时间取反
+	idle uint64
+	db   *database
+	key  string
+}
+
+// evictionState 在多次淘汰之间保留的状态 由 evictMu 保护
+type evictionState struct {
+	// pool 按 idle 升序排列 每次从末尾取出最应该被淘汰的 key
+	// 与 redis 一样在多次采样之间保留 使近似算法更接近真正的 LRU/LFU
+	pool []evictionCandidate
+	// nextDB random 策略下轮流从各个数据库中淘汰
+	nextDB int
+}
+
+// insert 与 redis 的 evictionPoolPopulate 中插入的部分对应
+// 池已满时丢弃 idle 最小的候选 新的候选比池中所有候选都小时不插入
+func (p *evictionState) insert(c evictionCandidate) {
+	if slices.ContainsFunc(p.pool, func(e evictionCandidate) bool {
+		return e.db == c.db && e.key == c.key
+	}) {
+		return
+	}
+
+	k := sort.Search(len(p.pool), func(i int) bool { return p.pool[i].idle >= c.idle })
+	if len(p.pool) < evictionPoolSize {
+		p.pool = slices.Insert(p.pool, k, c)
+		return
+	}
+	if k == 0 {
+		return
+	}
+	copy(p.pool[:k-1], p.pool[1:k])
+	p.pool[k-1] = c
+}
+
+// PerformEvictions 在执行可能增加内存占用的命令之前调用 与 redis 命令的 denyoom 标记对应
+// 内存不足且无法淘汰时返回 OOM 错误 命令不应再执行
+func (c *Client) PerformEvictions() error {
+	return c.s.performEvictions()
+}
+
+// performEvictions 与 redis 的 performEvictions 对应
+// 估算的内存占用超出 maxmemory 时按 maxmemory-policy 淘汰 key 直到回到上限以内
+// 策略为 noeviction 或者没有可以淘汰的 key 时返回 OOM 错误
+// 调用方不能持有任何锁
+func (s *KVStore) performEvictions() error {
+	limit := s.cfg.MaxMemory
+	if limit == 0 || s.usedMemory.Load() <= limit {
+		return nil
+	}
+	policy := s.cfg.MaxMemoryPolicy
+	if policy == "noeviction" {
+		return errOOM
+	}
+
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for s.usedMemory.Load() > limit {
+		if !s.evictOne(policy) {
+			return errOOM
+		}
+	}
+	return nil
+}
+
+// evictOne 按策略淘汰一个 key 没有可以淘汰的 key 时返回 false
+// 外部必须持有全局读锁以及 evictMu
+func (s *KVStore) evictOne(policy string) bool {
+	volatile := strings.HasPrefix(policy, "volatile-")
+
+	if strings.HasSuffix(policy, "-random") {
+		for range s.dbs {
+			db := s.dbs[s.evict.nextDB]
+			s.evict.nextDB = (s.evict.nextDB + 1) % len(s.dbs)
+
+			sh := s.sampleShard(db, volatile)
+			if sh == nil {
+				continue
+			}
+			key := s.sampleKey(sh, volatile)
+			sh.mu.RUnlock()
+			if s.evictKey(db, key, volatile) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for {
+		now := s.clock.Now()
+		sampled := 0
+		for _, db := range s.dbs {
+			sampled += s.evictionPoolPopulate(db, policy, volatile, now)
+		}
+		if sampled == 0 {
+			return false
+		}
+
+		// 从最应该被淘汰的开始 候选在采样之后可能已经被删除 跳过即可
+		for len(s.evict.pool) > 0 {
+			last := len(s.evict.pool) - 1
+			c := s.evict.pool[last]
+			s.evict.pool = s.evict.pool[:last]
+			if s.evictKey(c.db, c.key, volatile) {
+				return true
+			}
+		}
+	}
+}
+
+// evictionPoolPopulate 在 db 的一个分片中采样 maxmemory-samples 个 key 放入淘汰池
+// 返回采样的数量
+func (s *KVStore) evictionPoolPopulate(db *database, policy string, volatile bool, now time.Time) int {
+	sh := s.sampleShard(db, volatile)
+	if sh == nil {
+		return 0
+	}
+	defer sh.mu.RUnlock()
+
+	for i := 0; i < s.cfg.MaxMemorySamples; i++ {
+		key := s.sampleKey(sh, volatile)
+		entity, ok := sh.store.Get(key)
+		if !ok {
+			continue
+		}
+		s.evict.insert(evictionCandidate{
+			idle: s.evictionScore(policy, entity, now),
+			db:   db,
+			key:  key,
+		})
+	}
+	return s.cfg.MaxMemorySamples
+}
+
+// evictionScore 候选 key 的分数 越大越应该被淘汰
+func (s *KVStore) evictionScore(policy string, e *Entity, now time.Time) uint64 {
+	switch policy {
+	case "allkeys-lru", "volatile-lru":
+		return uint64(idleTime(e, now).Milliseconds())
+	case "allkeys-lfu", "volatile-lfu":
+		return 255 - uint64(s.lfuDecrAndReturn(e, now))
+	case "volatile-ttl":
+		// 越早过期越先淘汰
+		return math.MaxUint64 - uint64(e.ExpiredAt.UnixMilli())
+	}
+	return 0
+}
+
+// sampleShard 从随机的分片开始寻找一个有候选 key 的分片 返回时持有它的读锁
+// key 按哈希值均匀分布 各分片的大小大致相同 不需要按大小加权
+// 数据库中没有候选 key 时返回 nil
+func (s *KVStore) sampleShard(db *database, volatile bool) *shard {
+	n := len(db.shards)
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		sh := db.shards[(start+i)&(n-1)]
+		sh.mu.RLock()
+		if (volatile && sh.expires.len() > 0) || (!volatile && sh.store.Len() > 0) {
+			return sh
+		}
+		sh.mu.RUnlock()
+	}
+	return nil
+}
+
+// sampleKey 随机选择分片中的一个 key volatile 时只在设置了过期时间的 key 中选择
+// 外部必须持有分片的锁 且分片中有候选 key
+func (s *KVStore) sampleKey(sh *shard, volatile bool) string {
+	if volatile {
+		return sh.expires.random()
+	}
+	key, _, _ := sh.store.RandomKey()
+	return key
+}
+
+// evictKey 删除被淘汰的 key 并传播为 DEL
+// key 已经不存在 或 volatile 策略下已经没有过期时间时返回 false
+// 外部必须持有全局读锁
+func (s *KVStore) evictKey(db *database, key string, volatile bool) bool {
+	sh := db.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	entity, ok := sh.store.Get(key)
+	if !ok || (volatile && entity.ExpiredAt.IsZero()) {
+		return false
+	}
+
+	s.dbDelete(db, key)
+	s.stats.evictedKeys.Add(1)
+	s.dirty.Add(1)
+	s.propagate(db, "DEL", key)
+	return true
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/pkg/errors"
+)
+
+// errParked 阻塞命令在事件循环模式下没有立即得到结果 客户端已被挂起 稍后再回复
+var errParked = errors.New("client parked")
+
+// execResult 命令的执行结果
+type execResult struct {
+	value *protocol.Value
+	err   error
+}
+
+// executor 事件循环执行模式 与 redis 的线程模型一致
+// 连接的 goroutine 只负责解析请求和读写网络 所有命令以及后台任务(主动过期、rehash、自动保存)
+// 都通过 tasks 交给唯一的执行 goroutine 串行执行 因此按 key 的命令不需要加锁
+// 阻塞命令不会阻塞执行 goroutine 而是把客户端挂起 在之后的命令产生数据或超时时再回复
+type executor struct {
+	s     *KVStore
+	tasks chan func()
+	// parked 按挂起的先后顺序排列
+	parked []*parkedClient
+	// reply 当前正在执行的命令的回复通道 挂起客户端时需要保存下来
+	reply chan<- execResult
+}
+
+// parkedClient 被挂起的阻塞命令
+type parkedClient struct {
+	reply chan<- execResult
+	// ready 在每条命令执行后调用 客户端可以被服务时返回回复
+	ready func() (*protocol.Value, bool)
+	// onTimeout 超时时的回复
+	onTimeout *protocol.Value
+	// cleanup 无论是被服务还是超时 都要把客户端从等待队列中移除
+	cleanup func()
+	// done 客户端不再挂起时关闭 通知超时的 goroutine 退出
+	done chan struct{}
+}
+
+func newExecutor(s *KVStore) *executor {
+	return &executor{s: s, tasks: make(chan func(), 1024)}
+}
+
+// run 执行 goroutine 的主循环
+func (e *executor) run() {
+	for {
+		// 与 redis 的 beforeSleep 对应 没有待执行的任务时执行一次快速过期周期
+		if len(e.tasks) == 0 {
+			e.s.beforeSleep()
+		}
+
+		select {
+		case <-e.s.done:
+			return
+		case task := <-e.tasks:
+			task()
+			// 被服务的阻塞命令(例如 BLMOVE)也可能写入有客户端等待的 key
+			for {
+				e.s.handleReadyKeys()
+				e.serveParked()
+				if !e.s.hasReadyKeys() {
+					break
+				}
+			}
+		}
+	}
+}
+
+// submit 把任务交给执行 goroutine 存储已关闭时返回 false
+func (e *executor) submit(task func()) bool {
+	select {
+	case e.tasks <- task:
+		return true
+	case <-e.s.done:
+		return false
+	}
+}
+
+// park 挂起当前命令的客户端 只能在执行 goroutine 中调用
+// timeout 为 0 表示一直等待
+func (e *executor) park(ready func() (*protocol.Value, bool), onTimeout *protocol.Value, cleanup func(), timeout time.Duration) {
+	p := &parkedClient{
+		reply:     e.reply,
+		ready:     ready,
+		onTimeout: onTimeout,
+		cleanup:   cleanup,
+		done:      make(chan struct{}),
+	}
+	e.parked = append(e.parked, p)
+
+	if timeout > 0 {
+		timer := e.s.clock.After(timeout)
+		go func() {
+			select {
+			case <-timer:
+				e.submit(func() {
+					e.unpark(p, execResult{value: p.onTimeout})
+				})
+			case <-p.done:
+			case <-e.s.done:
+			}
+		}()
+	}
+}
+
+// unpark 回复并移除挂起的客户端 已经不再挂起时什么也不做
+func (e *executor) unpark(p *parkedClient, res execResult) {
+	i := 0
+	for i < len(e.parked) && e.parked[i] != p {
+		i++
+	}
+	if i == len(e.parked) {
+		return
+	}
+	e.parked = append(e.parked[:i], e.parked[i+1:]...)
+
+	p.cleanup()
+	close(p.done)
+	p.reply <- res
+}
+
+// cancel 客户端断开连接时移除它被挂起的命令 命令没有被挂起时什么也不做
+func (e *executor) cancel(reply chan<- execResult) {
+	for _, p := range e.parked {
+		if p.reply == reply {
+			e.unpark(p, execResult{err: context.Canceled})
+			return
+		}
+	}
+}
+
+// serveParked 每条命令执行后按挂起的顺序检查客户端能否被服务
+func (e *executor) serveParked() {
+	for i := 0; i < len(e.parked); {
+		p := e.parked[i]
+		value, ok := p.ready()
+		if !ok {
+			i++
+			continue
+		}
+		e.unpark(p, execResult{value: value})
+	}
+}
+
+// Execute 执行一条命令 命令结束后服务因它而就绪的阻塞客户端
+// 加锁模式下直接在调用方的 goroutine 中执行 事件循环模式下交给执行 goroutine 并等待回复
+// fn 只能通过 c 访问存储
+func (s *KVStore) Execute(c *Client, fn func() (*protocol.Value, error)) (*protocol.Value, error) {
+	if s.exec == nil {
+		value, err := fn()
+		s.handleReadyKeys()
+		return value, err
+	}
+
+	reply := make(chan execResult, 1)
+	ok := s.exec.submit(func() {
+		s.exec.reply = reply
+		value, err := fn()
+		s.exec.reply = nil
+		if errors.Is(err, errParked) {
+			return
+		}
+		reply <- execResult{value: value, err: err}
+	})
+	if !ok {
+		return nil, errors.New("ERR server is shutting down")
+	}
+
+	select {
+	case res := <-reply:
+		return res.value, res.err
+	case <-c.ctx.Done():
+		// 连接已经断开 命令如果被挂起了就把它移除 回复 context.Canceled
+		// 没有被挂起的命令照常执行完成
+		s.exec.submit(func() {
+			s.exec.cancel(reply)
+		})
+		select {
+		case res := <-reply:
+			return res.value, res.err
+		case <-s.done:
+			return nil, errors.New("ERR server is shutting down")
+		}
+	case <-s.done:
+		return nil, errors.New("ERR server is shutting down")
+	}
+}
+
+// runInLoop 后台任务的入口 事件循环模式下交给执行 goroutine 异步执行
+func (s *KVStore) runInLoop(fn func()) {
+	if s.exec == nil {
+		fn()
+		return
+	}
+	s.exec.submit(fn)
+}
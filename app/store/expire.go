@@ -0,0 +1,232 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/pkg/errors"
+)
+
+// expireFlags EXPIRE 系列命令的条件选项
+type expireFlags struct {
+	nx, xx, gt, lt bool
+}
+
+func parseExpireFlags(args []*protocol.Value) (expireFlags, error) {
+	var f expireFlags
+	for _, arg := range args {
+		switch strings.ToUpper(arg.Bulk()) {
+		case "NX":
+			f.nx = true
+		case "XX":
+			f.xx = true
+		case "GT":
+			f.gt = true
+		case "LT":
+			f.lt = true
+		default:
+			return f, errors.Errorf("ERR Unsupported option %s", arg.Bulk())
+		}
+	}
+
+	if f.nx && (f.xx || f.gt || f.lt) {
+		return f, errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if f.gt && f.lt {
+		return f, errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+	return f, nil
+}
+
+// allow 判断在当前过期时间 current 下能否设置新的过期时间 when
+// 没有过期时间的 key 视为 TTL 无穷大
+func (f expireFlags) allow(current, when time.Time) bool {
+	switch {
+	case f.nx:
+		return current.IsZero()
+	case f.xx && current.IsZero():
+		return false
+	case f.gt:
+		return !current.IsZero() && when.After(current)
+	case f.lt:
+		return current.IsZero() || when.Before(current)
+	}
+	return true
+}
+
+// expireGeneric EXPIRE/PEXPIRE/EXPIREAT/PEXPIREAT 的公共实现
+// unit 为时间单位 absolute 表示参数是 unix 时间戳而非相对时间
+// 统一改写为 PEXPIREAT 传播 避免重放时产生偏差
+func (s *KVStore) expireGeneric(c *Client, name string, args []*protocol.Value, unit time.Duration, absolute bool) (*protocol.Value, error) {
+	if len(args) < 2 {
+		return nil, errors.New(emsgArgsNumber(name))
+	}
+
+	key := args[0].Bulk()
+
+	num, err := strconv.ParseInt(args[1].Bulk(), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+
+	flags, err := parseExpireFlags(args[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	// 换算为毫秒时检查溢出
+	scale := int64(unit / time.Millisecond)
+	if num > math.MaxInt64/scale || num < math.MinInt64/scale {
+		return nil, errors.Errorf("ERR invalid expire time in '%s' command", name)
+	}
+	ms := num * scale
+
+	now := s.clock.Now()
+	if !absolute {
+		if ms > math.MaxInt64-now.UnixMilli() {
+			return nil, errors.Errorf("ERR invalid expire time in '%s' command", name)
+		}
+		ms += now.UnixMilli()
+	}
+	when := time.UnixMilli(ms)
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+
+	if !flags.allow(entity.ExpiredAt, when) {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+
+	// 过期时间已经过去 直接删除
+	if !when.After(now) {
+		s.rawDelete(c.db, key)
+		s.dirty.Add(1)
+		s.propagate(c.db, "DEL", key)
+		return new(protocol.Value).SetInteger(1), nil
+	}
+
+	s.setExpire(c.db, key, entity, when)
+	s.dirty.Add(1)
+	s.propagate(c.db, "PEXPIREAT", key, strconv.FormatInt(ms, 10))
+
+	return new(protocol.Value).SetInteger(1), nil
+}
+
+// HandleEXPIRE
+// EXPIRE key seconds [NX | XX | GT | LT]
+// 设置成功返回 1 key 不存在或条件不满足返回 0
+func (s *KVStore) HandleEXPIRE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.expireGeneric(c, "expire", args, time.Second, false)
+}
+
+// HandlePEXPIRE
+// PEXPIRE key milliseconds [NX | XX | GT | LT]
+func (s *KVStore) HandlePEXPIRE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.expireGeneric(c, "pexpire", args, time.Millisecond, false)
+}
+
+// HandleEXPIREAT
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
+func (s *KVStore) HandleEXPIREAT(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.expireGeneric(c, "expireat", args, time.Second, true)
+}
+
+// HandlePEXPIREAT
+// PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+func (s *KVStore) HandlePEXPIREAT(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.expireGeneric(c, "pexpireat", args, time.Millisecond, true)
+}
+
+// ttlGeneric TTL/PTTL/EXPIRETIME/PEXPIRETIME 的公共实现
+// key 不存在返回 -2 没有过期时间返回 -1
+func (s *KVStore) ttlGeneric(c *Client, name string, args []*protocol.Value, unit time.Duration, absolute bool) (*protocol.Value, error) {
+	if len(args) != 1 {
+		return nil, errors.New(emsgArgsNumber(name))
+	}
+
+	key := args[0].Bulk()
+
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawLookup(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetInteger(-2), nil
+	}
+	if entity.ExpiredAt.IsZero() {
+		return new(protocol.Value).SetInteger(-1), nil
+	}
+
+	if absolute {
+		ms := entity.ExpiredAt.UnixMilli()
+		return new(protocol.Value).SetInteger(int(ms / int64(unit/time.Millisecond))), nil
+	}
+
+	ttl := entity.ExpiredAt.Sub(s.clock.Now()).Milliseconds()
+	if ttl < 0 {
+		ttl = 0
+	}
+	if unit == time.Second {
+		// 与 redis 一致 四舍五入到秒
+		return new(protocol.Value).SetInteger(int((ttl + 500) / 1000)), nil
+	}
+	return new(protocol.Value).SetInteger(int(ttl)), nil
+}
+
+// HandleTTL
+// TTL key
+// 返回剩余的秒数
+func (s *KVStore) HandleTTL(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.ttlGeneric(c, "ttl", args, time.Second, false)
+}
+
+// HandlePTTL
+// PTTL key
+// 返回剩余的毫秒数
+func (s *KVStore) HandlePTTL(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.ttlGeneric(c, "pttl", args, time.Millisecond, false)
+}
+
+// HandleEXPIRETIME
+// EXPIRETIME key
+// 返回过期时刻的 unix 时间戳(秒)
+func (s *KVStore) HandleEXPIRETIME(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.ttlGeneric(c, "expiretime", args, time.Second, true)
+}
+
+// HandlePEXPIRETIME
+// PEXPIRETIME key
+// 返回过期时刻的 unix 时间戳(毫秒)
+func (s *KVStore) HandlePEXPIRETIME(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.ttlGeneric(c, "pexpiretime", args, time.Millisecond, true)
+}
+
+// HandlePERSIST
+// PERSIST key
+// 移除 key 的过期时间 成功返回 1 key 不存在或没有过期时间返回 0
+func (s *KVStore) HandlePERSIST(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 1 {
+		return nil, errors.New(emsgArgsNumber("persist"))
+	}
+
+	key := args[0].Bulk()
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok || entity.ExpiredAt.IsZero() {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+
+	s.setExpire(c.db, key, entity, time.Time{})
+	s.dirty.Add(1)
+	s.propagate(c.db, "PERSIST", key)
+
+	return new(protocol.Value).SetInteger(1), nil
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// activeExpireCycleKeysPerLoop 每轮采样的 key 数量
+	activeExpireCycleKeysPerLoop = 20
+	// activeExpireCycleFastDuration 快速周期的时间预算
+	activeExpireCycleFastDuration = 1000 * time.Microsecond
+	// activeExpireCycleSlowTimePerc 慢速周期最多占用每个 tick 的百分比
+	activeExpireCycleSlowTimePerc = 25
+	// activeExpireCycleAcceptableStale 估算的过期 key 比例低于该值时不执行快速周期
+	activeExpireCycleAcceptableStale = 10
+)
+
+// expireIndex 设置了过期时间的 key 的集合
+// 用切片保存 key 以便 O(1) 随机采样 pos 记录每个 key 在切片中的下标
+type expireIndex struct {
+	keys []string
+	pos  map[string]int
+}
+
+func newExpireIndex() *expireIndex {
+	return &expireIndex{pos: make(map[string]int)}
+}
+
+func (x *expireIndex) add(key string) {
+	if _, ok := x.pos[key]; ok {
+		return
+	}
+	x.pos[key] = len(x.keys)
+	x.keys = append(x.keys, key)
+}
+
+// remove 用最后一个元素填补空位
+func (x *expireIndex) remove(key string) {
+	i, ok := x.pos[key]
+	if !ok {
+		return
+	}
+	last := len(x.keys) - 1
+	x.keys[i] = x.keys[last]
+	x.pos[x.keys[i]] = i
+	x.keys[last] = ""
+	x.keys = x.keys[:last]
+	delete(x.pos, key)
+}
+
+func (x *expireIndex) random() string {
+	return x.keys[rand.IntN(len(x.keys))]
+}
+
+func (x *expireIndex) len() int {
+	return len(x.keys)
+}
+
+// expireCycleState 主动过期在多次调用之间需要保留的状态
+type expireCycleState struct {
+	// timelimitExit 上一次周期是否因为超出时间预算而退出
+	timelimitExit bool
+	// lastFastCycle 上一次快速周期的开始时间
+	lastFastCycle time.Time
+	// currentDB 下一次周期从该数据库开始 保证时间预算不足时各数据库轮流得到处理
+	currentDB int
+}
+
+// handleActiveExpire 以 hz 的频率执行慢速过期周期
+func (s *KVStore) handleActiveExpire() {
+	ticker := s.clock.NewTicker(time.Second / time.Duration(s.cfg.Hz))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C():
+		}
+
+		s.runInLoop(func() {
+			s.mutex.RLock()
+			s.expireMu.Lock()
+			s.activeExpireCycle(false)
+			s.expireMu.Unlock()
+			s.rehashStep()
+			s.mutex.RUnlock()
+		})
+	}
+}
+
+// rehashStep 与 redis 的 databasesCron 一致 每个 tick 花 1ms 推进一个分片的 rehash
+// 外部必须持有全局读锁
+func (s *KVStore) rehashStep() {
+	for _, db := range s.dbs {
+		for _, sh := range db.shards {
+			sh.mu.Lock()
+			rehashing := sh.store.Rehashing()
+			if rehashing {
+				sh.store.RehashFor(time.Millisecond)
+			}
+			sh.mu.Unlock()
+			if rehashing {
+				return
+			}
+		}
+	}
+}
+
+// BeforeSleep 连接即将阻塞等待下一条命令前调用
+// 在过期 key 积压时执行一次快速过期周期 已经有其他连接在执行过期周期时直接跳过
+// 事件循环模式下由执行 goroutine 在空闲时调用 连接的调用被忽略
+func (s *KVStore) BeforeSleep() {
+	if s.exec != nil {
+		return
+	}
+	s.beforeSleep()
+}
+
+func (s *KVStore) beforeSleep() {
+	if !s.mutex.TryRLock() {
+		return
+	}
+	defer s.mutex.RUnlock()
+	if !s.expireMu.TryLock() {
+		return
+	}
+	defer s.expireMu.Unlock()
+	s.activeExpireCycle(true)
+}
+
+// activeExpireCycle 与 redis 的 activeExpireCycle 对应
+// 每轮从过期索引中随机采样 20 个 key 删除其中已过期的
+// 若过期比例超过 25% 说明还有大量过期 key 继续下一轮 直到用完时间预算
+// 各分片依次加写锁处理 快速周期跳过正被其他命令占用的分片
+// 外部必须持有全局读锁以及 expireMu
+func (s *KVStore) activeExpireCycle(fast bool) {
+	if s.activeExpireDisabled {
+		return
+	}
+
+	start := s.clock.Now()
+
+	timelimit := time.Second * activeExpireCycleSlowTimePerc / 100 / time.Duration(s.cfg.Hz)
+	if fast {
+		// 上次慢速周期正常结束且过期 key 不多时 没有必要执行快速周期
+		if !s.expire.timelimitExit && s.stats.expiredStalePerc < activeExpireCycleAcceptableStale {
+			return
+		}
+		// 两次快速周期之间至少间隔两倍的预算时间
+		if start.Before(s.expire.lastFastCycle.Add(2 * activeExpireCycleFastDuration)) {
+			return
+		}
+		s.expire.lastFastCycle = start
+		timelimit = activeExpireCycleFastDuration
+	}
+
+	s.expire.timelimitExit = false
+	totalSampled, totalExpired := 0, 0
+
+	iteration := 0
+	for range s.dbs {
+		db := s.dbs[s.expire.currentDB%len(s.dbs)]
+		s.expire.currentDB++
+
+		for _, sh := range db.shards {
+			if fast {
+				if !sh.mu.TryLock() {
+					continue
+				}
+			} else {
+				sh.mu.Lock()
+			}
+
+			for sh.expires.len() > 0 {
+				iteration++
+				now := s.clock.Now()
+				sampled, expired := 0, 0
+				for n := min(sh.expires.len(), activeExpireCycleKeysPerLoop); n > 0 && sh.expires.len() > 0; n-- {
+					key := sh.expires.random()
+					sampled++
+					if entity, _ := sh.store.Get(key); entity.isExpired(now) {
+						s.expireKey(db, key)
+						expired++
+					}
+				}
+				totalSampled += sampled
+				totalExpired += expired
+
+				// 获取时间有开销 每 16 轮检查一次
+				if iteration%16 == 0 && s.clock.Since(start) > timelimit {
+					s.expire.timelimitExit = true
+					s.stats.expiredTimeCapReached++
+					break
+				}
+
+				if expired*4 <= sampled {
+					break
+				}
+			}
+			sh.mu.Unlock()
+
+			if s.expire.timelimitExit {
+				break
+			}
+		}
+
+		if s.expire.timelimitExit {
+			break
+		}
+	}
+
+	elapsed := s.clock.Since(start)
+	s.stats.expireCycleTime += elapsed
+
+	// 以指数移动平均估算当前过期 key 的比例
+	current := 0.0
+	if totalSampled > 0 {
+		current = float64(totalExpired) * 100 / float64(totalSampled)
+	}
+	s.stats.expiredStalePerc = current*0.05 + s.stats.expiredStalePerc*0.95
+}
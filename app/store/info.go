@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// infoSections INFO 支持的节 按输出顺序排列
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "keyspace"}
+
+// HandleINFO
+// INFO [section [section ...]]
+// 不带参数或参数为 all/default/everything 时返回全部节
+func (s *KVStore) HandleINFO(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(arg.Bulk())] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		s.writeInfoSection(&b, section)
+	}
+
+	return new(protocol.Value).SetBulk(b.String()), nil
+}
+
+// writeInfoSection 外部必须持有全局写锁
+func (s *KVStore) writeInfoSection(b *strings.Builder, section string) {
+	field := func(name string, value any) {
+		fmt.Fprintf(b, "%s:%v\r\n", name, value)
+	}
+	boolInt := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	switch section {
+	case "server":
+		b.WriteString("# Server\r\n")
+		field("redis_version", "7.4.0")
+		field("process_id", os.Getpid())
+		field("tcp_port", s.cfg.Port)
+		field("uptime_in_seconds", int64(s.clock.Now().Sub(s.startTime).Seconds()))
+		field("hz", s.cfg.Hz)
+	case "clients":
+		b.WriteString("# Clients\r\n")
+		connected, blocked := s.clientCounts()
+		field("connected_clients", connected)
+		field("blocked_clients", blocked)
+		field("total_blocking_keys", s.blockingKeys())
+	case "memory":
+		b.WriteString("# Memory\r\n")
+		used := s.usedMemory.Load()
+		field("used_memory", used)
+		field("used_memory_human", bytesToHuman(used))
+		field("used_memory_peak", s.peakMemory.Load())
+		field("used_memory_peak_human", bytesToHuman(s.peakMemory.Load()))
+		field("maxmemory", s.cfg.MaxMemory)
+		field("maxmemory_human", bytesToHuman(s.cfg.MaxMemory))
+		field("maxmemory_policy", s.cfg.MaxMemoryPolicy)
+	case "persistence":
+		b.WriteString("# Persistence\r\n")
+		field("rdb_changes_since_last_save", s.dirty.Load())
+		field("rdb_bgsave_in_progress", boolInt(s.saving.Load()))
+		field("rdb_last_save_time", s.lastSave.Unix())
+		field("aof_enabled", boolInt(s.aof != nil))
+		field("aof_rewrite_in_progress", boolInt(s.aof != nil && s.aof.Rewriting()))
+	case "stats":
+		b.WriteString("# Stats\r\n")
+		field("expired_keys", s.stats.expiredKeys.Load())
+		field("evicted_keys", s.stats.evictedKeys.Load())
+		field("expired_stale_perc", fmt.Sprintf("%.2f", s.stats.expiredStalePerc))
+		field("expired_time_cap_reached_count", s.stats.expiredTimeCapReached)
+		field("expire_cycle_cpu_milliseconds", s.stats.expireCycleTime.Milliseconds())
+		field("lazyfree_pending_objects", s.lazyfreePending.Load())
+	case "keyspace":
+		b.WriteString("# Keyspace\r\n")
+		for _, db := range s.dbs {
+			if keys := db.size(); keys > 0 {
+				field(fmt.Sprintf("db%d", db.id), fmt.Sprintf("keys=%d,expires=%d,avg_ttl=0", keys, db.expiresSize()))
+			}
+		}
+	}
+}
+
+// bytesToHuman 与 redis 的 bytesToHuman 一致 例如 1.50M
+func bytesToHuman(n int64) string {
+	units := []string{"K", "M", "G", "T", "P"}
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	v := float64(n)
+	for _, unit := range units {
+		v /= 1024
+		if v < 1024 || unit == units[len(units)-1] {
+			return fmt.Sprintf("%.2f%s", v, unit)
+		}
+	}
+	return ""
+}
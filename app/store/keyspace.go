@@ -0,0 +1,388 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/quicklist"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+	"github.com/pkg/errors"
+)
+
+// lazyfreeThreshold 释放代价超过该值的实体会交给后台 goroutine 处理
+const lazyfreeThreshold = 64
+
+// freeEffort 估算释放实体的代价 与 redis 的 lazyfreeGetFreeEffort 对应
+func (e *Entity) freeEffort() int {
+	switch e.Type {
+	case TypeList:
+		// 与 redis 一致 列表按节点数量计算
+		return e.Data.(*quicklist.Quicklist).Nodes()
+	case TypeStream:
+		return len(e.Data.(*Stream).entities)
+	}
+	return 1
+}
+
+// free 逐个清空容器中的元素 断开对底层数据的引用
+func (e *Entity) free() {
+	switch e.Type {
+	case TypeList:
+		e.Data.(*quicklist.Quicklist).Release()
+	case TypeStream:
+		clear(e.Data.(*Stream).entities)
+	}
+	e.Data = nil
+}
+
+// freeEntityAsync 大对象在后台释放 小对象直接交给 GC
+// 实体此时已经从 store 中移除 不会再被其他命令访问
+func (s *KVStore) freeEntityAsync(entity *Entity) {
+	if entity.freeEffort() <= lazyfreeThreshold {
+		return
+	}
+
+	s.lazyfreePending.Add(1)
+	go func() {
+		defer s.lazyfreePending.Add(-1)
+		entity.free()
+	}()
+}
+
+// HandleDEL
+// DEL key [key ...]
+// 返回被删除的 key 的数量
+func (s *KVStore) HandleDEL(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("del"))
+	}
+
+	return s.delGeneric(c, args, false)
+}
+
+// HandleUNLINK
+// UNLINK key [key ...]
+// 与 DEL 相同 但 key 会立即从键空间移除 而释放大对象的工作在后台进行
+func (s *KVStore) HandleUNLINK(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("unlink"))
+	}
+
+	return s.delGeneric(c, args, true)
+}
+
+func (s *KVStore) delGeneric(c *Client, args []*protocol.Value, lazy bool) (*protocol.Value, error) {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.Bulk()
+	}
+
+	defer s.lockKeys(c.db, keys...).unlock()
+
+	deleted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entity, ok := s.rawRemove(c.db, key)
+		if !ok {
+			continue
+		}
+		if lazy {
+			s.freeEntityAsync(entity)
+		}
+		deleted = append(deleted, key)
+	}
+
+	if len(deleted) > 0 {
+		s.dirty.Add(int64(len(deleted)))
+		cmd := "DEL"
+		if lazy {
+			cmd = "UNLINK"
+		}
+		s.propagate(c.db, append([]string{cmd}, deleted...)...)
+	}
+
+	return new(protocol.Value).SetInteger(len(deleted)), nil
+}
+
+// HandleEXISTS
+// EXISTS key [key ...]
+// 返回存在的 key 的数量 同一个 key 出现多次会被重复计数
+func (s *KVStore) HandleEXISTS(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("exists"))
+	}
+
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.Bulk()
+	}
+
+	defer s.rlockKeys(c.db, keys...).unlock()
+
+	count := 0
+	for _, key := range keys {
+		if _, ok := s.rawLookup(c.db, key); ok {
+			count++
+		}
+	}
+
+	return new(protocol.Value).SetInteger(count), nil
+}
+
+// HandleTOUCH
+// TOUCH key [key ...]
+// 更新 key 的最近访问时间 返回存在的 key 的数量
+func (s *KVStore) HandleTOUCH(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("touch"))
+	}
+
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.Bulk()
+	}
+
+	defer s.rlockKeys(c.db, keys...).unlock()
+
+	count := 0
+	for _, key := range keys {
+		if _, ok := s.rawLookup(c.db, key); ok {
+			count++
+		}
+	}
+
+	return new(protocol.Value).SetInteger(count), nil
+}
+
+// HandleRENAME
+// RENAME key newkey
+// 将 key 重命名为 newkey 过期时间随之转移 newkey 已存在时会被覆盖
+func (s *KVStore) HandleRENAME(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New(emsgArgsNumber("rename"))
+	}
+
+	if _, err := s.renameGeneric(c, args[0].Bulk(), args[1].Bulk(), false); err != nil {
+		return nil, err
+	}
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleRENAMENX
+// RENAMENX key newkey
+// 仅当 newkey 不存在时才重命名 成功返回 1 否则返回 0
+func (s *KVStore) HandleRENAMENX(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New(emsgArgsNumber("renamenx"))
+	}
+
+	renamed, err := s.renameGeneric(c, args[0].Bulk(), args[1].Bulk(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	if renamed {
+		return new(protocol.Value).SetInteger(1), nil
+	}
+	return new(protocol.Value).SetInteger(0), nil
+}
+
+func (s *KVStore) renameGeneric(c *Client, src, dst string, nx bool) (bool, error) {
+	defer s.lockKeys(c.db, src, dst).unlock()
+
+	entity, ok := s.rawGet(c.db, src)
+	if !ok {
+		return false, errors.New("ERR no such key")
+	}
+
+	// 与 redis 一致 源和目标相同时直接视为成功(NX 时视为目标已存在)
+	if src == dst {
+		return !nx, nil
+	}
+
+	if _, exist := s.rawGet(c.db, dst); exist {
+		if nx {
+			return false, nil
+		}
+		s.rawDelete(c.db, dst)
+	}
+
+	s.rawDelete(c.db, src)
+	s.rawSet(c.db, dst, entity)
+	s.dirty.Add(1)
+
+	if nx {
+		s.propagate(c.db, "RENAMENX", src, dst)
+	} else {
+		s.propagate(c.db, "RENAME", src, dst)
+	}
+
+	s.signalKeyAsReady(c.db, dst)
+	return true, nil
+}
+
+// HandleCOPY
+// COPY source destination [DB destination-db] [REPLACE]
+// 复制成功返回 1 目标已存在且未指定 REPLACE 时返回 0
+func (s *KVStore) HandleCOPY(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 2 {
+		return nil, errors.New(emsgArgsNumber("copy"))
+	}
+
+	src := args[0].Bulk()
+	dst := args[1].Bulk()
+
+	replace := false
+	dstDB := c.db
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk()) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			i++
+			db, err := s.parseDBIndex(args[i])
+			if err != nil {
+				return nil, err
+			}
+			dstDB = db
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	if src == dst && dstDB == c.db {
+		return nil, errors.New("ERR source and destination objects are the same")
+	}
+
+	defer s.lockShards(true, c.db.shard(src), dstDB.shard(dst)).unlock()
+
+	entity, ok := s.rawGet(c.db, src)
+	if !ok {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+
+	if _, exist := s.rawGet(dstDB, dst); exist {
+		if !replace {
+			return new(protocol.Value).SetInteger(0), nil
+		}
+		s.rawDelete(dstDB, dst)
+	}
+
+	s.rawSet(dstDB, dst, entity.clone())
+	s.dirty.Add(1)
+	s.propagate(c.db, "COPY", src, dst, "DB", strconv.Itoa(dstDB.id), "REPLACE")
+
+	s.signalKeyAsReady(dstDB, dst)
+	return new(protocol.Value).SetInteger(1), nil
+}
+
+// HandleKEYS
+// KEYS pattern
+// 返回所有匹配 glob 风格 pattern 的 key
+func (s *KVStore) HandleKEYS(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 1 {
+		return nil, errors.New(emsgArgsNumber("keys"))
+	}
+
+	pattern := args[0].Bulk()
+	all := pattern == "*"
+
+	defer s.lockShards(false, c.db.shards...).unlock()
+
+	now := s.clock.Now()
+	result := new(protocol.Value).SetEmptyArray()
+	for _, sh := range c.db.shards {
+		sh.store.Range(func(key string, entity *Entity) bool {
+			if entity.isExpired(now) {
+				return true
+			}
+			if all || utils.GlobMatch(pattern, key, false) {
+				result.Append(new(protocol.Value).SetBulk(key))
+			}
+			return true
+		})
+	}
+
+	return result, nil
+}
+
+// HandleSCAN
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// 返回下一次调用的游标以及本次遍历到的 key 游标为 0 表示遍历结束
+// 整个遍历期间一直存在的 key 至少会被返回一次 但同一个 key 可能被返回多次
+func (s *KVStore) HandleSCAN(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("scan"))
+	}
+
+	cursor, err := strconv.ParseUint(args[0].Bulk(), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR invalid cursor")
+	}
+
+	pattern, typ, count := "", "", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, errors.New("ERR syntax error")
+		}
+		value := args[i+1].Bulk()
+		switch strings.ToUpper(args[i].Bulk()) {
+		case "MATCH":
+			pattern = value
+		case "COUNT":
+			count, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return nil, errors.New("ERR syntax error")
+			}
+		case "TYPE":
+			typ = strings.ToLower(value)
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+	if pattern == "*" {
+		pattern = ""
+	}
+
+	defer s.lockShards(false, c.db.shards...).unlock()
+
+	// 与 redis 一致 最多遍历 count*10 个桶 避免在稀疏的表上耗时过长
+	keys := make([]string, 0, count)
+	collect := func(key string, _ *Entity) {
+		keys = append(keys, key)
+	}
+	for maxIterations := count * 10; ; maxIterations-- {
+		cursor = c.db.scan(cursor, collect)
+		if cursor == 0 || maxIterations == 0 || len(keys) >= count {
+			break
+		}
+	}
+
+	// 只持有读锁 已过期的 key 只是被跳过而不会被删除
+	items := new(protocol.Value).SetEmptyArray()
+	for _, key := range keys {
+		if pattern != "" && !utils.GlobMatch(pattern, key, false) {
+			continue
+		}
+		entity, ok := s.rawLookup(c.db, key)
+		if !ok {
+			continue
+		}
+		if typ != "" && entity.typeName() != typ {
+			continue
+		}
+		items.Append(new(protocol.Value).SetBulk(key))
+	}
+
+	return new(protocol.Value).SetArray([]*protocol.Value{
+		new(protocol.Value).SetBulk(strconv.FormatUint(cursor, 10)),
+		items,
+	}), nil
+}
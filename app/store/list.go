@@ -1,88 +1,192 @@
 package store
 
 import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/quicklist"
 	"github.com/codecrafters-io/redis-starter-go/app/utils"
 	"github.com/pkg/errors"
 )
 
+// ListPayload 交给阻塞客户端的数据 values 为已经从 key 中弹出的元素
+// err 不为 nil 时没有弹出任何元素 例如阻塞的 BLMOVE 被服务时目标已经不是列表
 type ListPayload struct {
-	key   string
-	value string
+	key    string
+	values []string
+	err    error
 }
 
-// HandleLPUSH
-// 将所有指定的值插入到存储在 key 的列表头部。如果 key 不存在，则在执行推送操作之前将其创建为空列表。当 key 包含的值不是列表时，将返回错误。
-// 可以使用单个命令调用，在命令末尾指定多个参数来推送多个元素。元素会依次插入到列表头部，从最左边的元素到最右边的元素。所以例如，命令 LPUSH mylist a b c 将会生成一个列表，其中 c 是第一个元素， b 是第二个元素， a 是第三个元素。
-// 整数回复：推送操作后列表的长度。
-// 遵循等待者优先原则 即push时若有blpop这种消费者的话 那么将直接消费数据
-// for example:
-// blpop list_key 0
-// lpush list_key val
-// 这个时候lpush的返回结构将为0而不是1
-func (s *KVStore) HandleLPUSH(args []*protocol.Value) (*protocol.Value, error) {
-	if len(args) < 2 {
-		return nil, errors.New(emsgArgsNumber("lpush"))
+// listWaiter 阻塞在列表上的客户端 阻塞在多个 key 上时每个 key 的等待队列中都是同一个 listWaiter
+type listWaiter struct {
+	// ch 容量为 1 被服务时恰好写入一次
+	ch chan ListPayload
+	// done 客户端已经被服务或者已经超时 先把它从 false 改为 true 的一方拥有这个客户端
+	// 阻塞在多个 key 上时各 key 在不同的分片上并发服务 由它保证客户端只拿到一次数据
+	done atomic.Bool
+	// tail 从表尾弹出
+	tail bool
+	// count 最多弹出的元素数量
+	count int
+	// move 为 true 时是阻塞的 BLMOVE/BRPOPLPUSH 弹出的元素在同一步中写入 dst 的一端(toTail)
+	move   bool
+	dst    string
+	toTail bool
+}
+
+// lockKeys waiter 服务时需要写锁的 key BLMOVE 还包括目标列表
+func (w *listWaiter) lockKeys(keys []string) []string {
+	if !w.move {
+		return keys
 	}
+	return append(slices.Clone(keys), w.dst)
+}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// newList 按 list-max-listpack-size 和 list-compress-depth 创建空列表
+func (s *KVStore) newList() *quicklist.Quicklist {
+	return quicklist.New(s.cfg.ListMaxListpackSize, s.cfg.ListCompressDepth)
+}
 
-	key := args[0].Bulk()
+// listPush 通过 push 把元素写入列表 entity 为 nil 时创建新的列表
+// 已有的列表原地修改 只需要重新计算内存占用
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) listPush(db *database, key string, entity *Entity, push func(list *quicklist.Quicklist)) {
+	if entity == nil {
+		entity = &Entity{Type: TypeList, Data: s.newList()}
+		push(entity.Data.(*quicklist.Quicklist))
+		s.rawSet(db, key, entity)
+		return
+	}
+	push(entity.Data.(*quicklist.Quicklist))
+	s.updateSize(db, key, entity)
+}
 
-	entity, exist := s.store[key]
-	var list []string
-	if exist {
-		if entity.Type != TypeList {
-			return nil, errors.New(emsgKeyType())
-		}
-		list = entity.Data.([]string)
+// listPeek 返回表头(tail 为 true 时为表尾)开始的最多 n 个元素 不修改列表
+func listPeek(list *quicklist.Quicklist, n int, tail bool) []string {
+	n = min(n, list.Len())
+	values := make([]string, 0, n)
+	it := list.Iterator(0, true)
+	if tail {
+		it = list.Iterator(-1, false)
 	}
-	resLen := len(list) + len(args) - 1
+	for range n {
+		v, _ := it.Next()
+		values = append(values, v)
+	}
+	return values
+}
 
-	valuesToPush := make([]string, 0, len(args)-1)
-	for i := len(args); i > 1; i-- {
-		valuesToPush = append(valuesToPush, args[i-1].Bulk())
+// listPop 从表头(tail 为 true 时从表尾)弹出最多 n 个元素 列表变空时删除 key
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) listPop(db *database, key string, entity *Entity, n int, tail bool) []string {
+	list := entity.Data.(*quicklist.Quicklist)
+	values := listPeek(list, n, tail)
+	s.listTrim(db, key, entity, len(values), tail)
+	return values
+}
+
+// listTrim 从表头(tail 为 true 时从表尾)删除 n 个元素 列表变空时删除 key
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) listTrim(db *database, key string, entity *Entity, n int, tail bool) {
+	list := entity.Data.(*quicklist.Quicklist)
+	if n >= list.Len() {
+		s.rawDelete(db, key)
+		return
 	}
+	if tail {
+		list.DelRange(list.Len()-n, n)
+	} else {
+		list.DelRange(0, n)
+	}
+	s.updateSize(db, key, entity)
+}
 
-	// remainingValues 用于收集没有被 waiter 消费掉的值
-	remainingValue := make([]string, 0, len(valuesToPush))
+// propagatePop 把弹出操作记录为等价的 LPOP/RPOP
+// 阻塞命令在重放时没有意义 只能改写为非阻塞命令
+func (s *KVStore) propagatePop(db *database, key string, n int, tail bool, withCount bool) {
+	name := "LPOP"
+	if tail {
+		name = "RPOP"
+	}
+	s.dirty.Add(int64(n))
+	if withCount {
+		s.propagate(db, name, key, strconv.Itoa(n))
+	} else {
+		s.propagate(db, name, key)
+	}
+}
 
-	// 需要对每个值都进行是否消费处理
-	for _, val := range valuesToPush {
-		// 存在waiter 则需要让其优先消费 不做后续存储
-		if waiters, ok := s.listWaiters[key]; ok && len(waiters) > 0 {
-			waiter := waiters[0]
-			newWaiter := waiters[1:]
-			s.listWaiters[key] = newWaiter
+// bulkArray 把字符串切片转为批量字符串数组回复
+func bulkArray(values []string) *protocol.Value {
+	res := make([]*protocol.Value, 0, len(values))
+	for _, v := range values {
+		res = append(res, new(protocol.Value).SetBulk(v))
+	}
+	return new(protocol.Value).SetArray(res)
+}
 
-			waiter <- ListPayload{
-				key:   key,
-				value: val,
-			}
+// listServe 按 waiter 的方向和数量从 key 弹出元素
+// BLMOVE 的 waiter 与 LMOVE 完全相同 弹出和写入目标列表在同一步完成 只传播一条 LMOVE
+// 外部必须持有 waiter.lockKeys 中所有 key 所在分片的写锁
+func (s *KVStore) listServe(db *database, key string, entity *Entity, waiter *listWaiter) ListPayload {
+	if waiter.move {
+		v, _, err := s.lmove(db, key, waiter.dst, waiter.tail, waiter.toTail)
+		if err != nil {
+			return ListPayload{key: key, err: err}
+		}
+		return ListPayload{key: key, values: []string{v}}
+	}
+	values := s.listPop(db, key, entity, waiter.count, waiter.tail)
+	s.propagatePop(db, key, len(values), waiter.tail, waiter.count > 1)
+	return ListPayload{key: key, values: values}
+}
 
-			continue
+// serveListWaiters 当 key 变为非空列表时 按 FIFO 顺序唤醒阻塞在该 key 上的客户端
+// 每个客户端按自己的方向和数量弹出元素
+// 一个客户端可能同时阻塞在多个 key 上 已经被其他 key 服务过或者已经超时的直接跳过
+// 只有抢到客户端之后才真正删除元素 不会丢失数据
+// 外部必须持有 key 以及其中 BLMOVE 目标列表所在分片的写锁 见 serveReadyKey
+func (s *KVStore) serveListWaiters(db *database, key string) {
+	sh := db.shard(key)
+	waiters := sh.listWaiters[key]
+	for len(waiters) > 0 {
+		entity, ok := s.rawGet(db, key)
+		if !ok || entity.Type != TypeList {
+			break
 		}
 
-		remainingValue = append(remainingValue, val)
-	}
+		waiter := waiters[0]
+		waiters = waiters[1:]
 
-	resList := append(remainingValue, list...)
+		if !waiter.done.CompareAndSwap(false, true) {
+			continue
+		}
 
-	if len(resList) == 0 {
-		delete(s.store, key)
+		waiter.ch <- s.listServe(db, key, entity, waiter)
+	}
+	if len(waiters) == 0 {
+		delete(sh.listWaiters, key)
 	} else {
-		s.rawSet(key, &Entity{
-			Type: TypeList,
-			// TODO
-			// ExpiredAt: ,
-			Data: resList,
-		})
+		sh.listWaiters[key] = waiters
 	}
+}
 
-	return new(protocol.Value).SetInteger(resLen), nil
+// HandleLPUSH
+// 将所有指定的值插入到存储在 key 的列表头部。如果 key 不存在，则在执行推送操作之前将其创建为空列表。当 key 包含的值不是列表时，将返回错误。
+// 可以使用单个命令调用，在命令末尾指定多个参数来推送多个元素。元素会依次插入到列表头部，从最左边的元素到最右边的元素。所以例如，命令 LPUSH mylist a b c 将会生成一个列表，其中 c 是第一个元素， b 是第二个元素， a 是第三个元素。
+// 整数回复：推送操作后列表的长度。
+// 与 redis 一致 先把所有值写入列表 命令结束后再按各自的方向和数量服务阻塞的客户端 见 blocking.go
+// for example:
+// blpop list_key 0
+// lpush list_key val
+// lpush 返回 1 之后 blpop 弹出 val 列表被删除
+func (s *KVStore) HandleLPUSH(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.pushCommand(c, args, "LPUSH", false)
 }
 
 // HandleRPUSH
@@ -90,66 +194,54 @@ func (s *KVStore) HandleLPUSH(args []*protocol.Value) (*protocol.Value, error) {
 // 如果 key 不存在，则在执行推送操作之前将其创建为空列表。
 // 当 key 包含的值不是列表时，将返回错误。
 // 整数回复：推送操作后列表的长度。
-// RPUSH 同样 遵循等待者优先原则
-func (s *KVStore) HandleRPUSH(args []*protocol.Value) (*protocol.Value, error) {
+// 与 LPUSH 一样 写入之后服务阻塞的客户端
+func (s *KVStore) HandleRPUSH(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.pushCommand(c, args, "RPUSH", true)
+}
+
+// pushCommand LPUSH/RPUSH 的公共实现
+func (s *KVStore) pushCommand(c *Client, args []*protocol.Value, name string, tail bool) (*protocol.Value, error) {
 	if len(args) < 2 {
-		return nil, errors.New(emsgArgsNumber("rpush"))
+		return nil, errors.New(emsgArgsNumber(strings.ToLower(name)))
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	key := args[0].Bulk()
 
-	entity, exist := s.store[key]
+	defer s.lockKeys(c.db, key).unlock()
 
-	var list []string
-	if exist {
-		if entity.Type != TypeList {
-			return nil, errors.New(emsgKeyType())
-		}
-		list = entity.Data.([]string)
+	entity, exist := s.rawGet(c.db, key)
+	if exist && entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
 	}
 
-	resLen := len(list) + len(args) - 1
-
-	valuesToPush := make([]string, 0, len(args)-1)
-	for i := range args[1:] {
-		valuesToPush = append(valuesToPush, args[1+i].Bulk())
+	values := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		values = append(values, arg.Bulk())
 	}
-	remainingValues := make([]string, 0, len(valuesToPush))
-
-	for _, v := range valuesToPush {
-		if waiters, ok := s.listWaiters[key]; ok && len(waiters) > 0 {
-			waiter := waiters[0]
-			newWaiters := waiters[1:]
-			waiter <- ListPayload{
-				key:   key,
-				value: v,
+	var length int
+	s.listPush(c.db, key, entity, func(list *quicklist.Quicklist) {
+		for _, v := range values {
+			if tail {
+				list.PushTail(v)
+			} else {
+				list.PushHead(v)
 			}
-			s.listWaiters[key] = newWaiters
-			continue
 		}
-		remainingValues = append(remainingValues, v)
-	}
-
-	resList := append(list, remainingValues...)
-
-	s.rawSet(key, &Entity{
-		Type: TypeList,
-		// TODO
-		// ExpiredAt: ,
-		Data: resList,
+		length = list.Len()
 	})
+	s.dirty.Add(int64(len(values)))
+	s.propagate(c.db, append([]string{name, key}, values...)...)
+
+	s.signalKeyAsReady(c.db, key)
 
-	return new(protocol.Value).SetInteger(resLen), nil
+	return new(protocol.Value).SetInteger(length), nil
 }
 
 // HandleLRange
 // 返回存储在 key 中的列表的指定元素。偏移量 start 和 stop 是零基索引， 0 是列表的第一个元素（列表的头部）， 1 是下一个元素，以此类推。
 // 这些偏移量也可以是负数，表示从列表末尾开始的偏移量。例如， -1 是列表的最后一个元素， -2 是倒数第二个，以此类推。
 // 有count的时候始终返回array，否则返回str
-func (s *KVStore) HandleLRANGE(args []*protocol.Value) (*protocol.Value, error) {
+func (s *KVStore) HandleLRANGE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
 	// lrange key start stop
 	if len(args) != 3 {
 		return nil, errors.New(emsgArgsNumber("lrange"))
@@ -157,10 +249,9 @@ func (s *KVStore) HandleLRANGE(args []*protocol.Value) (*protocol.Value, error)
 
 	key := args[0].Bulk()
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.rlockKeys(c.db, key).unlock()
 
-	entity, ok := s.store[key]
+	entity, ok := s.rawLookup(c.db, key)
 	if !ok {
 		return new(protocol.Value).SetEmptyArray(), nil
 	}
@@ -169,7 +260,7 @@ func (s *KVStore) HandleLRANGE(args []*protocol.Value) (*protocol.Value, error)
 		return nil, errors.New(emsgKeyType())
 	}
 
-	list := entity.Data.([]string)
+	list := entity.Data.(*quicklist.Quicklist)
 
 	startArg, err := args[1].BulkToInteger()
 	if err != nil {
@@ -181,28 +272,29 @@ func (s *KVStore) HandleLRANGE(args []*protocol.Value) (*protocol.Value, error)
 		return nil, errors.WithStack(err)
 	}
 
-	safeStart, safeStop := utils.NormalizeRange(startArg, stopArg, len(list))
-	subList := list[safeStart:safeStop]
+	safeStart, safeStop := utils.NormalizeRange(startArg, stopArg, list.Len())
 
-	resList := make([]*protocol.Value, 0, len(subList))
-	for i := range subList {
-		resList = append(resList, new(protocol.Value).SetBulk(subList[i]))
+	// 只定位一次起点 之后顺序迭代 不需要每个元素都从头查找
+	resList := make([]*protocol.Value, 0, safeStop-safeStart)
+	it := list.Iterator(safeStart, true)
+	for i := safeStart; i < safeStop; i++ {
+		v, _ := it.Next()
+		resList = append(resList, new(protocol.Value).SetBulk(v))
 	}
 
 	return new(protocol.Value).SetArray(resList), nil
 }
 
-func (s *KVStore) HandleLLEN(args []*protocol.Value) (*protocol.Value, error) {
+func (s *KVStore) HandleLLEN(c *Client, args []*protocol.Value) (*protocol.Value, error) {
 	if len(args) != 1 {
 		return nil, errors.New(emsgArgsNumber("llen"))
 	}
 
 	key := args[0].Bulk()
 
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	defer s.rlockKeys(c.db, key).unlock()
 
-	entity, ok := s.store[key]
+	entity, ok := s.rawLookup(c.db, key)
 	if !ok {
 		return new(protocol.Value).SetInteger(0), nil
 	}
@@ -211,17 +303,28 @@ func (s *KVStore) HandleLLEN(args []*protocol.Value) (*protocol.Value, error) {
 		return nil, errors.New(emsgKeyType())
 	}
 
-	list := entity.Data.([]string)
-
-	return new(protocol.Value).SetInteger(len(list)), nil
+	return new(protocol.Value).SetInteger(entity.Data.(*quicklist.Quicklist).Len()), nil
 }
 
 // HandleLpop
 // 移除并返回存储在 key 中的列表的第一个元素。
 // 默认情况下，该命令从列表的开头弹出一个元素。当提供可选的 count 参数时，回复将包含最多 count 个元素，具体取决于列表的长度。
-func (s *KVStore) HandleLPOP(args []*protocol.Value) (*protocol.Value, error) {
+func (s *KVStore) HandleLPOP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.popCommand(c, args, "LPOP", false)
+}
+
+// HandleRPOP
+// RPOP key [count]
+// 与 LPOP 相同 只是从列表的尾部弹出
+func (s *KVStore) HandleRPOP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.popCommand(c, args, "RPOP", true)
+}
+
+// popCommand LPOP/RPOP 的公共实现
+// 没有 count 参数时返回单个元素 否则始终返回数组
+func (s *KVStore) popCommand(c *Client, args []*protocol.Value, name string, tail bool) (*protocol.Value, error) {
 	if len(args) != 1 && len(args) != 2 {
-		return nil, errors.New(emsgArgsNumber("lpop"))
+		return nil, errors.New(emsgArgsNumber(strings.ToLower(name)))
 	}
 
 	key := args[0].Bulk()
@@ -238,11 +341,13 @@ func (s *KVStore) HandleLPOP(args []*protocol.Value) (*protocol.Value, error) {
 		}
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.lockKeys(c.db, key).unlock()
 
-	entity, ok := s.rawGet(key)
+	entity, ok := s.rawGet(c.db, key)
 	if !ok {
+		if hasCountParam {
+			return new(protocol.Value).SetNullArray(), nil
+		}
 		return new(protocol.Value).SetNullBulk(), nil
 	}
 
@@ -250,48 +355,384 @@ func (s *KVStore) HandleLPOP(args []*protocol.Value) (*protocol.Value, error) {
 		return nil, errors.New(emsgKeyType())
 	}
 
-	list := entity.Data.([]string)
-	length := len(list)
+	// 1.没有count参数
+	if !hasCountParam {
+		v := s.listPop(c.db, key, entity, 1, tail)[0]
+		s.dirty.Add(1)
+		s.propagate(c.db, name, key)
+
+		return new(protocol.Value).SetBulk(v), nil
+	}
+
+	// 2.有count参数
+	values := s.listPop(c.db, key, entity, count, tail)
+	if len(values) > 0 {
+		s.dirty.Add(int64(len(values)))
+		s.propagate(c.db, name, key, strconv.Itoa(len(values)))
+	}
+
+	return bulkArray(values), nil
+}
+
+// HandleLPUSHX
+// LPUSHX key element [element ...]
+// 只有 key 已经存在并且是列表时才插入到头部 否则不做任何操作
+// 整数回复：推送操作后列表的长度 key 不存在时为 0
+func (s *KVStore) HandleLPUSHX(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.pushxCommand(c, args, "LPUSHX", false)
+}
+
+// HandleRPUSHX
+// RPUSHX key element [element ...]
+// 与 LPUSHX 相同 只是插入到尾部
+func (s *KVStore) HandleRPUSHX(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.pushxCommand(c, args, "RPUSHX", true)
+}
+
+// pushxCommand LPUSHX/RPUSHX 的公共实现
+// 列表已经存在时不可能有阻塞的客户端 不需要考虑 waiter
+func (s *KVStore) pushxCommand(c *Client, args []*protocol.Value, name string, tail bool) (*protocol.Value, error) {
+	if len(args) < 2 {
+		return nil, errors.New(emsgArgsNumber(strings.ToLower(name)))
+	}
+
+	key := args[0].Bulk()
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+	if entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
+	}
+
+	values := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		values = append(values, arg.Bulk())
+	}
+	list := entity.Data.(*quicklist.Quicklist)
+	s.listPush(c.db, key, entity, func(list *quicklist.Quicklist) {
+		for _, v := range values {
+			if tail {
+				list.PushTail(v)
+			} else {
+				list.PushHead(v)
+			}
+		}
+	})
+	s.dirty.Add(int64(len(values)))
+	s.propagate(c.db, append([]string{name, key}, values...)...)
 
-	if length == 0 {
+	return new(protocol.Value).SetInteger(list.Len()), nil
+}
+
+// HandleLINDEX
+// LINDEX key index
+// 返回列表中下标为 index 的元素 负数表示从尾部开始 越界时返回 nil
+func (s *KVStore) HandleLINDEX(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New(emsgArgsNumber("lindex"))
+	}
+
+	key := args[0].Bulk()
+	index, err := args[1].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawLookup(c.db, key)
+	if !ok {
 		return new(protocol.Value).SetNullBulk(), nil
 	}
+	if entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
+	}
 
-	disposeList := func(resLength int) {
-		// 当前键已被全部删除
-		if resLength == length {
-			delete(s.store, key)
-		} else {
-			s.rawSet(key, &Entity{
-				Type: TypeList,
-				Data: list[count:],
-			})
+	v, ok := entity.Data.(*quicklist.Quicklist).Index(index)
+	if !ok {
+		return new(protocol.Value).SetNullBulk(), nil
+	}
+	return new(protocol.Value).SetBulk(v), nil
+}
+
+// HandleLSET
+// LSET key index element
+// 把下标为 index 的元素设置为 element
+// key 不存在时返回 no such key 错误 下标越界时返回 index out of range 错误
+func (s *KVStore) HandleLSET(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 3 {
+		return nil, errors.New(emsgArgsNumber("lset"))
+	}
+
+	key := args[0].Bulk()
+	index, err := args[1].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	value := args[2].Bulk()
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok {
+		return nil, errors.New("ERR no such key")
+	}
+	if entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
+	}
+
+	if !entity.Data.(*quicklist.Quicklist).Replace(index, value) {
+		return nil, errors.New("ERR index out of range")
+	}
+	s.updateSize(c.db, key, entity)
+	s.dirty.Add(1)
+	s.propagate(c.db, "LSET", key, args[1].Bulk(), value)
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleLINSERT
+// LINSERT key BEFORE|AFTER pivot element
+// 在从头部开始第一个等于 pivot 的元素之前或之后插入 element
+// 整数回复：插入后列表的长度 没有找到 pivot 时为 -1 key 不存在时为 0
+func (s *KVStore) HandleLINSERT(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 4 {
+		return nil, errors.New(emsgArgsNumber("linsert"))
+	}
+
+	key := args[0].Bulk()
+	var after bool
+	switch strings.ToUpper(args[1].Bulk()) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return nil, errors.New("ERR syntax error")
+	}
+	pivot, value := args[2].Bulk(), args[3].Bulk()
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+	if entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
+	}
+
+	list := entity.Data.(*quicklist.Quicklist)
+	it := list.Iterator(0, true)
+	for i := 0; ; i++ {
+		v, ok := it.Next()
+		if !ok {
+			return new(protocol.Value).SetInteger(-1), nil
+		}
+		if v == pivot {
+			list.Insert(i, value, after)
+			break
 		}
 	}
+	s.updateSize(c.db, key, entity)
+	s.dirty.Add(1)
+	s.propagate(c.db, "LINSERT", key, args[1].Bulk(), pivot, value)
 
-	// 处理返回
-	// 1.没有count参数
-	if !hasCountParam {
-		disposeList(1)
+	return new(protocol.Value).SetInteger(list.Len()), nil
+}
 
-		return new(protocol.Value).SetBulk(list[0]), nil
+// HandleLREM
+// LREM key count element
+// 删除等于 element 的元素
+// count > 0 从头部开始最多删除 count 个 count < 0 从尾部开始最多删除 -count 个 count = 0 删除所有
+// 整数回复：删除的元素数量
+func (s *KVStore) HandleLREM(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 3 {
+		return nil, errors.New(emsgArgsNumber("lrem"))
 	}
-	// 2.有count参数
-	if count > length {
-		count = length
+
+	key := args[0].Bulk()
+	count, err := args[1].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	element := args[2].Bulk()
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+	if entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
 	}
 
-	resList := make([]*protocol.Value, 0, count)
+	list := entity.Data.(*quicklist.Quicklist)
+	removed := list.DeleteIf(count < 0, max(count, -count), func(v string) bool {
+		return v == element
+	})
+	if removed == 0 {
+		return new(protocol.Value).SetInteger(0), nil
+	}
 
-	for i := 0; i < count; i++ {
-		v := new(protocol.Value).SetBulk(list[i])
-		resList = append(resList, v)
+	if list.Len() == 0 {
+		s.rawDelete(c.db, key)
+	} else {
+		s.updateSize(c.db, key, entity)
 	}
+	s.dirty.Add(int64(removed))
+	s.propagate(c.db, "LREM", key, args[1].Bulk(), element)
 
-	// 当前键已被全部删除
-	disposeList(len(resList))
+	return new(protocol.Value).SetInteger(removed), nil
+}
 
-	return new(protocol.Value).SetArray(resList), nil
+// HandleLTRIM
+// LTRIM key start stop
+// 只保留下标在 [start, stop] 之间的元素 下标的含义与 LRANGE 相同
+// 区间为空时删除 key
+func (s *KVStore) HandleLTRIM(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 3 {
+		return nil, errors.New(emsgArgsNumber("ltrim"))
+	}
+
+	key := args[0].Bulk()
+	start, err := args[1].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	stop, err := args[2].BulkToInteger()
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawGet(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetStr("OK"), nil
+	}
+	if entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
+	}
+
+	list := entity.Data.(*quicklist.Quicklist)
+	length := list.Len()
+	safeStart, safeStop := utils.NormalizeRange(start, stop, length)
+	if safeStart == safeStop {
+		s.rawDelete(c.db, key)
+	} else {
+		// 先删除尾部 头部的下标不受影响
+		list.DelRange(safeStop, length-safeStop)
+		list.DelRange(0, safeStart)
+		s.updateSize(c.db, key, entity)
+	}
+
+	if removed := length - (safeStop - safeStart); removed > 0 {
+		s.dirty.Add(int64(removed))
+		s.propagate(c.db, "LTRIM", key, args[1].Bulk(), args[2].Bulk())
+	}
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleLPOS
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+// 返回等于 element 的元素的下标
+// RANK 表示从第几个匹配开始 负数表示从尾部开始向头部查找
+// COUNT 表示返回的匹配数量 0 表示所有匹配 指定 COUNT 时始终返回数组
+// MAXLEN 表示最多比较的元素数量 0 表示不限制
+func (s *KVStore) HandleLPOS(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 2 {
+		return nil, errors.New(emsgArgsNumber("lpos"))
+	}
+
+	key, element := args[0].Bulk(), args[1].Bulk()
+	rank, count, maxlen := 1, 1, 0
+	hasCount := false
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, errors.New("ERR syntax error")
+		}
+		n, err := args[i+1].BulkToInteger()
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(args[i].Bulk()) {
+		case "RANK":
+			if n == 0 || n == math.MinInt64 {
+				return nil, errors.New("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return nil, errors.New("ERR COUNT can't be negative")
+			}
+			count, hasCount = n, true
+		case "MAXLEN":
+			if n < 0 {
+				return nil, errors.New("ERR MAXLEN can't be negative")
+			}
+			maxlen = n
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawLookup(c.db, key)
+	if !ok {
+		if hasCount {
+			return new(protocol.Value).SetEmptyArray(), nil
+		}
+		return new(protocol.Value).SetNullBulk(), nil
+	}
+	if entity.Type != TypeList {
+		return nil, errors.New(emsgKeyType())
+	}
+
+	list := entity.Data.(*quicklist.Quicklist)
+	forward := rank > 0
+	it := list.Iterator(0, true)
+	if !forward {
+		it = list.Iterator(-1, false)
+		rank = -rank
+	}
+
+	matches := make([]*protocol.Value, 0)
+	for i := 0; maxlen == 0 || i < maxlen; i++ {
+		v, ok := it.Next()
+		if !ok {
+			break
+		}
+		if v != element {
+			continue
+		}
+		if rank > 1 {
+			rank--
+			continue
+		}
+		index := i
+		if !forward {
+			index = list.Len() - 1 - i
+		}
+		matches = append(matches, new(protocol.Value).SetInteger(index))
+		if count != 0 && len(matches) == count {
+			break
+		}
+	}
+
+	if hasCount {
+		return new(protocol.Value).SetArray(matches), nil
+	}
+	if len(matches) == 0 {
+		return new(protocol.Value).SetNullBulk(), nil
+	}
+	return matches[0], nil
 }
 
 // HandleBLPOP
@@ -304,9 +745,21 @@ func (s *KVStore) HandleLPOP(args []*protocol.Value) (*protocol.Value, error) {
 // 当 BLPOP 导致客户端阻塞且指定了非零超时时，如果超时到期前没有至少一个指定的键执行推送操作，客户端将解阻塞并返回一个 nil 多批量值。
 // 超时参数timeout被解释为一个双精度值，指定最大阻塞秒数。零超时可用于无限期阻塞。
 // blop key1 key2 ... timeout
-func (s *KVStore) HandleBLPOP(args []*protocol.Value) (*protocol.Value, error) {
+func (s *KVStore) HandleBLPOP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.bpopCommand(c, args, "blpop", false)
+}
+
+// HandleBRPOP
+// BRPOP key [key ...] timeout
+// 与 BLPOP 相同 只是从列表的尾部弹出
+func (s *KVStore) HandleBRPOP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	return s.bpopCommand(c, args, "brpop", true)
+}
+
+// bpopCommand BLPOP/BRPOP 的公共实现 回复 [key, value]
+func (s *KVStore) bpopCommand(c *Client, args []*protocol.Value, name string, tail bool) (*protocol.Value, error) {
 	if len(args) < 2 {
-		return nil, errors.New(emsgArgsNumber("blpop"))
+		return nil, errors.New(emsgArgsNumber(name))
 	}
 
 	keys := make([]string, 0, len(args)-1)
@@ -314,86 +767,385 @@ func (s *KVStore) HandleBLPOP(args []*protocol.Value) (*protocol.Value, error) {
 		keys = append(keys, args[i].Bulk())
 	}
 
-	timeout, err := args[len(args)-1].BulkToDouble()
+	timeout, err := parseBlockTimeout(args[len(args)-1])
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
+	}
+
+	return s.blockingPop(c, keys, timeout, &listWaiter{tail: tail, count: 1}, func(res ListPayload) *protocol.Value {
+		return new(protocol.Value).
+			SetArray([]*protocol.Value{
+				new(protocol.Value).SetBulk(res.key),
+				new(protocol.Value).SetBulk(res.values[0]),
+			})
+	})
+}
+
+// HandleLMPOP
+// LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+// 从第一个非空列表的指定方向弹出最多 count 个元素 默认为 1 个
+// 回复 [key, [element ...]] 所有列表都为空时返回 nil
+func (s *KVStore) HandleLMPOP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	keys, tail, count, err := parseMPopArgs(args, "lmpop")
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.lockKeys(c.db, keys...).unlock()
+
+	for _, key := range keys {
+		entity, ok := s.rawGet(c.db, key)
+		if !ok {
+			continue
+		}
+		if entity.Type != TypeList {
+			return nil, errors.New(emsgKeyType())
+		}
+		values := s.listPop(c.db, key, entity, count, tail)
+		s.propagatePop(c.db, key, len(values), tail, true)
+		return mpopReply(ListPayload{key: key, values: values}), nil
+	}
+	return new(protocol.Value).SetNullArray(), nil
+}
+
+// HandleBLMPOP
+// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+// LMPOP 的阻塞版本 所有列表都为空时阻塞 超时后返回 nil
+func (s *KVStore) HandleBLMPOP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("blmpop"))
+	}
+	timeout, err := parseBlockTimeout(args[0])
+	if err != nil {
+		return nil, err
+	}
+	keys, tail, count, err := parseMPopArgs(args[1:], "blmpop")
+	if err != nil {
+		return nil, err
+	}
+
+	return s.blockingPop(c, keys, timeout, &listWaiter{tail: tail, count: count}, mpopReply)
+}
+
+// parseMPopArgs 解析 numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func parseMPopArgs(args []*protocol.Value, name string) ([]string, bool, int, error) {
+	if len(args) < 3 {
+		return nil, false, 0, errors.New(emsgArgsNumber(name))
+	}
+	numkeys, err := args[0].BulkToInteger()
+	if err != nil || numkeys <= 0 {
+		return nil, false, 0, errors.New("ERR numkeys should be greater than 0")
+	}
+	if numkeys > len(args)-2 {
+		return nil, false, 0, errors.New("ERR syntax error")
+	}
+
+	keys := make([]string, 0, numkeys)
+	for _, arg := range args[1 : 1+numkeys] {
+		keys = append(keys, arg.Bulk())
+	}
+
+	var tail bool
+	switch strings.ToUpper(args[1+numkeys].Bulk()) {
+	case "LEFT":
+	case "RIGHT":
+		tail = true
+	default:
+		return nil, false, 0, errors.New("ERR syntax error")
+	}
+
+	count := 1
+	rest := args[2+numkeys:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.EqualFold(rest[0].Bulk(), "COUNT"):
+		if count, err = rest[1].BulkToInteger(); err != nil || count <= 0 {
+			return nil, false, 0, errors.New("ERR count should be greater than 0")
+		}
+	default:
+		return nil, false, 0, errors.New("ERR syntax error")
 	}
+	return keys, tail, count, nil
+}
 
+// mpopReply LMPOP/BLMPOP 的回复 [key, [element ...]]
+func mpopReply(res ListPayload) *protocol.Value {
+	return new(protocol.Value).SetArray([]*protocol.Value{
+		new(protocol.Value).SetBulk(res.key),
+		bulkArray(res.values),
+	})
+}
+
+// parseBlockTimeout 解析阻塞命令以秒为单位的超时时间 0 表示无限期阻塞
+func parseBlockTimeout(v *protocol.Value) (time.Duration, error) {
+	timeout, err := v.BulkToDouble()
+	if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+		return 0, errors.New("ERR timeout is not a float or out of range")
+	}
+	if timeout < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	// 1. 把 time.Second (整数) 转成 float64
+	// 2. 乘以 timeout (float64)
+	// 3. 最后把结果转回 time.Duration
+	return time.Duration(timeout * float64(time.Second)), nil
+}
+
+// blockingPop 阻塞弹出的公共部分
+// 按顺序检查 keys 第一个非空列表直接按 waiter 的方向和数量弹出
+// 都为空时把 waiter 注册到所有 key 上 等待 serveListWaiters 送来数据或者超时
+func (s *KVStore) blockingPop(c *Client, keys []string, timeout time.Duration, waiter *listWaiter, reply func(ListPayload) *protocol.Value) (*protocol.Value, error) {
 	// 1.直接可以拿到数据时
 	// 非阻塞处理
 	// 先直接遍历key 以确保按顺寻
-	s.mutex.Lock()
+	// 所有 key 所在的分片一次性按顺序加锁 检查与注册等待者之间不会有其他命令插入
+	lk := s.lockKeys(c.db, waiter.lockKeys(keys)...)
 	for _, key := range keys {
-		if entity, ok := s.store[key]; ok && entity.Type == TypeList {
-			list := entity.Data.([]string)
-			popVal := list[0]
-			if len(list) == 1 {
-				delete(s.store, key)
-			} else {
-				s.store[key].Data = list[1:]
-			}
-			s.mutex.Unlock()
-			return new(protocol.Value).
-					SetArray([]*protocol.Value{
-						new(protocol.Value).SetBulk(key),
-						new(protocol.Value).SetBulk(popVal),
-					}),
-				nil
+		entity, ok := s.rawGet(c.db, key)
+		if !ok {
+			continue
 		}
+		if entity.Type != TypeList {
+			lk.unlock()
+			return nil, errors.New(emsgKeyType())
+		}
+		// 阻塞命令在重放时没有意义 改写为等价的非阻塞命令
+		res := s.listServe(c.db, key, entity, waiter)
+		lk.unlock()
+		if res.err != nil {
+			return nil, res.err
+		}
+		return reply(res), nil
 	}
 
 	// 2.不可拿到数据时
 	// 阻塞处理
-	var timeoutCh <-chan time.Time
-	if timeout > 0 {
-		// 1. 把 time.Second (整数) 转成 float64
-		// 2. 乘以 timeout (float64)
-		// 3. 最后把结果转回 time.Duration
-		duration := time.Duration(timeout * float64(time.Second))
-		timeoutCh = time.After(duration)
-	}
-
-	pendingCh := make(chan ListPayload, 1)
+	db := c.db
+	waiter.ch = make(chan ListPayload, 1)
 	for _, key := range keys {
-		// 向listWaiters中添加pendingCh
-		s.listWaiters[key] = append(s.listWaiters[key], pendingCh)
+		// 向listWaiters中添加waiter
+		sh := db.shard(key)
+		sh.listWaiters[key] = append(sh.listWaiters[key], waiter)
 	}
-	s.mutex.Unlock()
+	bs := s.blockClient(c, keys)
+	lk.unlock()
 
 	// 清理函数
-	// 无论是超时还是拿到数据，最后都要把这个 chan 从 map 里删掉
+	// 无论是超时还是拿到数据，最后都要把这个 waiter 从 map 里删掉
 	// 否则 map 会无限膨胀
 	cleanup := func() {
-		s.mutex.Lock()
-		defer s.mutex.Unlock()
+		defer s.lockKeys(db, keys...).unlock()
 		for _, key := range keys {
-			listWaiters := s.listWaiters[key]
+			sh := db.shard(key)
+			listWaiters := sh.listWaiters[key]
 
 			if len(listWaiters) == 0 {
 				continue
 			}
 
-			newWaiters := make([]chan ListPayload, 0, len(listWaiters))
-			for _, waiter := range listWaiters {
-				if pendingCh != waiter {
-					newWaiters = append(newWaiters, waiter)
+			newWaiters := make([]*listWaiter, 0, len(listWaiters))
+			for _, w := range listWaiters {
+				if w != waiter {
+					newWaiters = append(newWaiters, w)
 				}
 			}
-			s.listWaiters[key] = newWaiters
+			if len(newWaiters) == 0 {
+				delete(sh.listWaiters, key)
+			} else {
+				sh.listWaiters[key] = newWaiters
+			}
 		}
 	}
-	defer cleanup()
 
-	select {
-	case res := <-pendingCh:
-		return new(protocol.Value).
-				SetArray([]*protocol.Value{
-					new(protocol.Value).SetBulk(res.key),
-					new(protocol.Value).SetBulk(res.value),
-				}),
-			nil
-	case <-timeoutCh:
-		// 超时处理
-		return new(protocol.Value).SetNullArray(), nil
+	return awaitBlocked(s, c, bs, blockedWait[ListPayload]{
+		ch:      waiter.ch,
+		done:    &waiter.done,
+		timeout: timeout,
+		cleanup: cleanup,
+		reply:   reply,
+		// 弹出的元素没有人接收 放回原处
+		// BLMOVE 的元素已经写入目标列表 与客户端是否还在无关
+		restore: func(res ListPayload) {
+			if waiter.move || res.err != nil {
+				return
+			}
+			s.listUnpop(db, res, waiter.tail)
+		},
+	})
+}
+
+// listUnpop 把已经弹出但没能交给客户端的元素按原来的顺序放回列表的同一端
+// key 已经被其他类型覆盖时元素无处可放 只能丢弃
+func (s *KVStore) listUnpop(db *database, res ListPayload, tail bool) {
+	defer s.lockKeys(db, res.key).unlock()
+
+	entity, ok := s.rawGet(db, res.key)
+	if ok && entity.Type != TypeList {
+		return
+	}
+	values := make([]string, 0, len(res.values))
+	for i := len(res.values) - 1; i >= 0; i-- {
+		values = append(values, res.values[i])
+	}
+	s.listPush(db, res.key, entity, func(list *quicklist.Quicklist) {
+		for _, v := range values {
+			if tail {
+				list.PushTail(v)
+			} else {
+				list.PushHead(v)
+			}
+		}
+	})
+	name := "LPUSH"
+	if tail {
+		name = "RPUSH"
+	}
+	s.dirty.Add(int64(len(values)))
+	s.propagate(db, append([]string{name, res.key}, values...)...)
+	s.signalKeyAsReady(db, res.key)
+}
+
+// parseListEnd 解析 LEFT|RIGHT RIGHT 表示表尾
+func parseListEnd(v *protocol.Value) (bool, error) {
+	switch strings.ToUpper(v.Bulk()) {
+	case "LEFT":
+		return false, nil
+	case "RIGHT":
+		return true, nil
+	}
+	return false, errors.New("ERR syntax error")
+}
+
+// listEndName parseListEnd 的逆操作 用于传播命令
+func listEndName(tail bool) string {
+	if tail {
+		return "RIGHT"
+	}
+	return "LEFT"
+}
+
+// lmove 把 src 一端的元素移动到 dst 的一端 src 和 dst 可以是同一个 key(轮转)
+// src 不存在时返回 false 任意一个 key 不是列表时返回错误且不做任何修改
+// 写入 dst 之后把它标记为就绪 阻塞在 dst 上的客户端在命令结束后被服务
+// 外部必须持有 src 和 dst 所在分片的写锁
+func (s *KVStore) lmove(db *database, src, dst string, fromTail, toTail bool) (string, bool, error) {
+	srcEntity, ok := s.rawGet(db, src)
+	if !ok {
+		return "", false, nil
+	}
+	if srcEntity.Type != TypeList {
+		return "", false, errors.New(emsgKeyType())
+	}
+	if dstEntity, ok := s.rawGet(db, dst); ok && dstEntity.Type != TypeList {
+		return "", false, errors.New(emsgKeyType())
+	}
+
+	v := s.listPop(db, src, srcEntity, 1, fromTail)[0]
+	// src 与 dst 相同且只有一个元素时 弹出后 key 已被删除 需要重新查找
+	dstEntity, _ := s.rawGet(db, dst)
+	s.listPush(db, dst, dstEntity, func(list *quicklist.Quicklist) {
+		if toTail {
+			list.PushTail(v)
+		} else {
+			list.PushHead(v)
+		}
+	})
+	s.dirty.Add(1)
+	s.propagate(db, "LMOVE", src, dst, listEndName(fromTail), listEndName(toTail))
+
+	s.signalKeyAsReady(db, dst)
+	return v, true, nil
+}
+
+// HandleLMOVE
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+// 原子地从 source 的一端弹出元素并插入到 destination 的一端 返回该元素
+// source 不存在时返回 nil
+func (s *KVStore) HandleLMOVE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 4 {
+		return nil, errors.New(emsgArgsNumber("lmove"))
+	}
+	fromTail, err := parseListEnd(args[2])
+	if err != nil {
+		return nil, err
+	}
+	toTail, err := parseListEnd(args[3])
+	if err != nil {
+		return nil, err
+	}
+	return s.moveCommand(c, args[0].Bulk(), args[1].Bulk(), fromTail, toTail)
+}
+
+// HandleRPOPLPUSH
+// RPOPLPUSH source destination
+// 等价于 LMOVE source destination RIGHT LEFT
+func (s *KVStore) HandleRPOPLPUSH(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New(emsgArgsNumber("rpoplpush"))
+	}
+	return s.moveCommand(c, args[0].Bulk(), args[1].Bulk(), true, false)
+}
+
+// moveCommand LMOVE/RPOPLPUSH 的公共实现
+func (s *KVStore) moveCommand(c *Client, src, dst string, fromTail, toTail bool) (*protocol.Value, error) {
+	defer s.lockKeys(c.db, src, dst).unlock()
+
+	v, ok, err := s.lmove(c.db, src, dst, fromTail, toTail)
+	if err != nil {
+		return nil, err
 	}
+	if !ok {
+		return new(protocol.Value).SetNullBulk(), nil
+	}
+	return new(protocol.Value).SetBulk(v), nil
+}
+
+// HandleBLMOVE
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+// LMOVE 的阻塞版本 source 为空时阻塞 超时后返回 nil
+func (s *KVStore) HandleBLMOVE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 5 {
+		return nil, errors.New(emsgArgsNumber("blmove"))
+	}
+	fromTail, err := parseListEnd(args[2])
+	if err != nil {
+		return nil, err
+	}
+	toTail, err := parseListEnd(args[3])
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseBlockTimeout(args[4])
+	if err != nil {
+		return nil, err
+	}
+	return s.blockingMove(c, args[0].Bulk(), args[1].Bulk(), fromTail, toTail, timeout)
+}
+
+// HandleBRPOPLPUSH
+// BRPOPLPUSH source destination timeout
+// 等价于 BLMOVE source destination RIGHT LEFT timeout
+func (s *KVStore) HandleBRPOPLPUSH(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 3 {
+		return nil, errors.New(emsgArgsNumber("brpoplpush"))
+	}
+	timeout, err := parseBlockTimeout(args[2])
+	if err != nil {
+		return nil, err
+	}
+	return s.blockingMove(c, args[0].Bulk(), args[1].Bulk(), true, false, timeout)
+}
+
+// blockingMove BLMOVE/BRPOPLPUSH 的公共实现
+// source 有数据时与 LMOVE 完全相同 否则作为一个只弹出一个元素的 waiter 阻塞在 source 上
+// 被服务时在同时持有 source 和 destination 的锁的情况下完成移动 见 listServe
+// 此时 destination 已经不是列表的话不做任何修改 返回 WRONGTYPE
+func (s *KVStore) blockingMove(c *Client, src, dst string, fromTail, toTail bool, timeout time.Duration) (*protocol.Value, error) {
+	waiter := &listWaiter{tail: fromTail, count: 1, move: true, dst: dst, toTail: toTail}
+	return s.blockingPop(c, []string{src}, timeout, waiter, func(res ListPayload) *protocol.Value {
+		if res.err != nil {
+			return new(protocol.Value).SetError(res.err.Error())
+		}
+		return new(protocol.Value).SetBulk(res.values[0])
+	})
 }
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+)
+
+// blmove 在新的客户端上执行 BLMOVE 阻塞后返回 回复通过 channel 送出
+func blmove(t *testing.T, s *KVStore, src, dst string) <-chan string {
+	ch := make(chan string, 1)
+	c := s.NewClient()
+	go func() {
+		res, err := c.call(s.HandleBLMOVE, src, dst, "RIGHT", "LEFT", "0")
+		if err != nil {
+			ch <- err.Error()
+			return
+		}
+		ch <- res.Bulk()
+	}()
+	waitBlocked(t, c)
+	return ch
+}
+
+func TestBlockedBLMOVEMovesAtomically(t *testing.T) {
+	for _, mode := range executionModes {
+		t.Run(mode, func(t *testing.T) {
+			s := newTestStore(t, mode, Options{})
+			ch := blmove(t, s, "src", "dst")
+
+			if _, err := s.RPush("src", "a"); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-ch; got != "a" {
+				t.Fatalf("BLMOVE = %q, want a", got)
+			}
+			if n, _ := s.LLen("src"); n != 0 {
+				t.Fatalf("LLEN src = %d, want 0", n)
+			}
+			if got, _ := s.LRange("dst", 0, -1); !slices.Equal(got, []string{"a"}) {
+				t.Fatalf("LRANGE dst = %v, want [a]", got)
+			}
+		})
+	}
+}
+
+func TestBlockedBLMOVEWrongTypeDestination(t *testing.T) {
+	for _, mode := range executionModes {
+		t.Run(mode, func(t *testing.T) {
+			s := newTestStore(t, mode, Options{})
+			ch := blmove(t, s, "src", "dst")
+
+			if err := s.Set("dst", "x", 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.RPush("src", "a", "b"); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-ch; got != emsgKeyType() {
+				t.Fatalf("BLMOVE = %q, want WRONGTYPE", got)
+			}
+			// 目标不是列表时不做任何修改
+			if got, _ := s.LRange("src", 0, -1); !slices.Equal(got, []string{"a", "b"}) {
+				t.Fatalf("LRANGE src = %v, want [a b]", got)
+			}
+		})
+	}
+}
+
+// blpopWithContext 在 ctx 控制的客户端上执行 BLPOP 阻塞后返回 命令的错误通过 channel 送出
+func blpopWithContext(t *testing.T, s *KVStore, ctx context.Context, key string) <-chan error {
+	ch := make(chan error, 1)
+	c := s.NewClientWithContext(ctx)
+	go func() {
+		_, err := c.call(s.HandleBLPOP, key, "0")
+		ch <- err
+	}()
+	waitBlocked(t, c)
+	return ch
+}
+
+func TestBlockedClientDisconnectKeepsPushedValue(t *testing.T) {
+	for _, mode := range executionModes {
+		t.Run(mode, func(t *testing.T) {
+			s := newTestStore(t, mode, Options{})
+			ctx, cancel := context.WithCancel(context.Background())
+			ch := blpopWithContext(t, s, ctx, "list")
+
+			cancel()
+			if err := <-ch; !errors.Is(err, context.Canceled) {
+				t.Fatalf("BLPOP error = %v, want context.Canceled", err)
+			}
+
+			if _, err := s.LPush("list", "v"); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := s.LRange("list", 0, -1); !slices.Equal(got, []string{"v"}) {
+				t.Fatalf("LRANGE = %v, want [v]", got)
+			}
+		})
+	}
+}
+
+// 断开连接与写入同时发生时 已经交给客户端的元素必须被放回列表
+func TestBlockedClientDisconnectRacingPush(t *testing.T) {
+	for _, mode := range executionModes {
+		t.Run(mode, func(t *testing.T) {
+			s := newTestStore(t, mode, Options{})
+			for i := 0; i < 200; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				ch := blpopWithContext(t, s, ctx, "list")
+
+				done := make(chan struct{})
+				go func() {
+					cancel()
+					close(done)
+				}()
+				if _, err := s.LPush("list", "v"); err != nil {
+					t.Fatal(err)
+				}
+				<-done
+
+				// 要么 BLPOP 拿到了元素 要么元素还在列表中
+				err := <-ch
+				n, _ := s.LLen("list")
+				if (err == nil) == (n == 1) {
+					t.Fatalf("iteration %d: BLPOP error = %v, LLEN = %d", i, err, n)
+				}
+				if _, _, err := s.LPop("list"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// 加锁模式下写命令释放锁之前阻塞的客户端就已经被服务
+// 其他客户端的 LPOP 不能在写入与服务之间取走元素
+func TestBlockedClientServedBeforeLockRelease(t *testing.T) {
+	s := newTestStore(t, "locked", Options{})
+	ch := make(chan error, 1)
+	c := s.NewClient()
+	go func() {
+		_, err := c.call(s.HandleBLPOP, "list", "0")
+		ch <- err
+	}()
+	waitBlocked(t, c)
+
+	w := s.NewClient()
+	var llen int
+	_, err := s.Execute(w, func() (*protocol.Value, error) {
+		if _, err := s.HandleLPUSH(w, []*protocol.Value{new(protocol.Value).SetBulk("list"), new(protocol.Value).SetBulk("v")}); err != nil {
+			return nil, err
+		}
+		// LPUSH 已经释放了锁 Execute 还没有处理就绪的 key
+		res, err := s.HandleLLEN(w, []*protocol.Value{new(protocol.Value).SetBulk("list")})
+		if err != nil {
+			return nil, err
+		}
+		llen = res.Integer()
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if llen != 0 {
+		t.Fatalf("LLEN after LPUSH = %d, want 0", llen)
+	}
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+}
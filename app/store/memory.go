@@ -0,0 +1,345 @@
+package store
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/quicklist"
+	"github.com/pkg/errors"
+)
+
+// 内存占用的估算值 与 redis 实际分配的字节数不同 只用于 maxmemory 以及各个 key 之间的相对比较
+const (
+	// entryOverhead 键空间中每个 key 的固定开销: 哈希表节点、Entity 以及 key 的字符串头
+	entryOverhead = 64
+	// stringOverhead 字符串值的字符串头 int 编码的字符串直接保存在实体中 没有这部分开销
+	stringOverhead = 16
+	// streamEntryOverhead stream 中每个条目的 ID 以及字段切片头
+	streamEntryOverhead = 40
+	// streamGroupOverhead 消费者组以及消费者的固定开销
+	streamGroupOverhead = 64
+	// streamNACKOverhead 待确认条目 包括组与消费者 PEL 中的 ID 以及 streamNACK
+	streamNACKOverhead = 72
+)
+
+// memoryUsage 估算 key 以及实体占用的内存
+// 列表的 quicklist 以及 stream 的字段字节数都在修改时累计 不需要遍历
+// stream 的消费者组与消费者数量通常很少 直接遍历
+func (e *Entity) memoryUsage(key string) int64 {
+	n := int64(entryOverhead + len(key))
+	switch e.Type {
+	case TypeString:
+		str := e.Data.(string)
+		if _, ok := isIntString(str); !ok {
+			n += int64(stringOverhead + len(str))
+		}
+	case TypeList:
+		n += e.Data.(*quicklist.Quicklist).MemoryUsage()
+	case TypeStream:
+		st := e.Data.(*Stream)
+		n += st.bytes + int64(len(st.entities))*streamEntryOverhead
+		for name, g := range st.groups {
+			n += int64(streamGroupOverhead+len(name)) + int64(g.pel.len())*streamNACKOverhead
+			for consumer := range g.consumers {
+				n += int64(streamGroupOverhead + len(consumer))
+			}
+		}
+	}
+	return n
+}
+
+// account 把实体计入 used_memory
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) account(sh *shard, key string, entity *Entity) {
+	entity.size = entity.memoryUsage(key)
+	sh.used += entity.size
+	used := s.usedMemory.Add(entity.size)
+	for {
+		peak := s.peakMemory.Load()
+		if used <= peak || s.peakMemory.CompareAndSwap(peak, used) {
+			break
+		}
+	}
+}
+
+// unaccount 从 used_memory 中减去实体在写入时计入的大小
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) unaccount(sh *shard, entity *Entity) {
+	sh.used -= entity.size
+	s.usedMemory.Add(-entity.size)
+}
+
+// updateSize 容器在原地修改之后重新计算内存占用
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) updateSize(db *database, key string, entity *Entity) {
+	sh := db.shard(key)
+	s.unaccount(sh, entity)
+	s.account(sh, key, entity)
+}
+
+// ---------------------------------------------------------
+// LRU/LFU
+// 与 redis 的 redisObject.lru 字段对应 只是把 LRU 时钟与 LFU 计数器分成了两个字段 LRU 时钟精确到毫秒
+// 两者始终都会维护 淘汰时按 maxmemory-policy 使用其中之一
+// 只读命令持有读锁时也会更新 因此通过原子操作读写
+// ---------------------------------------------------------
+
+// lfuInitVal 新写入的 key 的 LFU 计数器初始值 避免刚写入就被淘汰
+const lfuInitVal = 5
+
+// lfuMinutes LFU 字段高位保存的时间 单位为分钟 只保留低 16 位
+func lfuMinutes(now time.Time) uint32 {
+	return uint32(now.Unix()/60) & 0xffff
+}
+
+// lfuTimeElapsed 距离上次衰减经过的分钟数 处理 16 位时间回绕的情况
+func lfuTimeElapsed(ldt uint32, now time.Time) uint32 {
+	m := lfuMinutes(now)
+	if m >= ldt {
+		return m - ldt
+	}
+	return 0xffff - ldt + m
+}
+
+// initAccess 新实体写入键空间时初始化访问信息
+func initAccess(e *Entity, now time.Time) {
+	atomic.StoreInt64(&e.lru, now.UnixMilli())
+	atomic.StoreUint32(&e.lfu, lfuMinutes(now)<<8|lfuInitVal)
+}
+
+// touch 记录一次访问 与 redis 的 updateLFU 以及更新 LRU 时钟对应
+func (s *KVStore) touch(e *Entity, now time.Time) {
+	atomic.StoreInt64(&e.lru, now.UnixMilli())
+	counter := s.lfuLogIncr(s.lfuDecrAndReturn(e, now))
+	atomic.StoreUint32(&e.lfu, lfuMinutes(now)<<8|uint32(counter))
+}
+
+// lfuDecrAndReturn 按照距离上次衰减经过的时间衰减计数器 每 lfu-decay-time 分钟减一
+// 只计算衰减后的值 不修改实体
+func (s *KVStore) lfuDecrAndReturn(e *Entity, now time.Time) uint8 {
+	lfu := atomic.LoadUint32(&e.lfu)
+	counter := uint8(lfu & 0xff)
+	if s.cfg.LFUDecayTime == 0 {
+		return counter
+	}
+	periods := lfuTimeElapsed(lfu>>8, now) / uint32(s.cfg.LFUDecayTime)
+	if periods >= uint32(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+// lfuLogIncr 对数计数器 计数器越大增长的概率越低 lfu-log-factor 越大增长越慢
+func (s *KVStore) lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return 255
+	}
+	baseval := max(float64(counter)-lfuInitVal, 0)
+	p := 1.0 / (baseval*float64(s.cfg.LFULogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// idleTime 距离上次访问经过的时间
+func idleTime(e *Entity, now time.Time) time.Duration {
+	return max(time.Duration(now.UnixMilli()-atomic.LoadInt64(&e.lru))*time.Millisecond, 0)
+}
+
+// setLRUOrLFU 与 redis 的 objectSetLRUOrLFU 对应 RESTORE 以及加载 rdb 时恢复访问信息
+// freq/idle 为 -1 表示没有提供
+func setLRUOrLFU(e *Entity, freq, idle int64, now time.Time) {
+	if freq >= 0 {
+		atomic.StoreUint32(&e.lfu, lfuMinutes(now)<<8|uint32(min(freq, 255)))
+	}
+	if idle >= 0 {
+		atomic.StoreInt64(&e.lru, now.UnixMilli()-idle*1000)
+	}
+}
+
+// expireEntryOverhead 过期索引中每个 key 的开销 不计入 used_memory 只在 MEMORY STATS 中展示
+const expireEntryOverhead = 32
+
+// HandleMEMORY
+// MEMORY USAGE key [SAMPLES count]
+// MEMORY STATS
+// MEMORY DOCTOR
+// MEMORY PURGE
+// MEMORY HELP
+func (s *KVStore) HandleMEMORY(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("memory"))
+	}
+
+	switch sub := strings.ToUpper(args[0].Bulk()); {
+	case sub == "USAGE" && (len(args) == 2 || len(args) == 4):
+		return s.memoryUsageCommand(c, args[1:])
+	case sub == "STATS" && len(args) == 1:
+		return s.memoryStats(), nil
+	case sub == "DOCTOR" && len(args) == 1:
+		return new(protocol.Value).SetBulk(s.memoryDoctor()), nil
+	case sub == "PURGE" && len(args) == 1:
+		// 把空闲的堆内存归还给操作系统 与 redis 让 jemalloc 释放脏页对应
+		debug.FreeOSMemory()
+		return new(protocol.Value).SetStr("OK"), nil
+	case sub == "HELP" && len(args) == 1:
+		return helpReply("MEMORY",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"PURGE",
+			"    Attempt to purge dirty pages for reclamation by the allocator.",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+		), nil
+	}
+
+	return nil, errors.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try MEMORY HELP.", args[0].Bulk())
+}
+
+// memoryUsageCommand MEMORY USAGE key [SAMPLES count]
+// key 不存在时返回 nil 不会记录为一次访问
+// 所有类型的大小都在修改时维护 不需要采样 SAMPLES 只做参数校验
+func (s *KVStore) memoryUsageCommand(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	key := args[0].Bulk()
+	if len(args) == 3 {
+		if !strings.EqualFold(args[1].Bulk(), "SAMPLES") {
+			return nil, errors.New("ERR syntax error")
+		}
+		n, err := args[2].BulkToInteger()
+		if err != nil || n < 0 {
+			return nil, errors.New("ERR value is out of range, must be positive")
+		}
+	}
+
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawPeek(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetNullBulk(), nil
+	}
+	return new(protocol.Value).SetInteger(int(entity.memoryUsage(key))), nil
+}
+
+// memoryStats MEMORY STATS 与 redis 一样以字段名、值交替的数组返回
+// allocator.* 来自 Go 运行时 其余字段基于估算的 used_memory
+func (s *KVStore) memoryStats() *protocol.Value {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var values []*protocol.Value
+	field := func(name string, value *protocol.Value) {
+		values = append(values, new(protocol.Value).SetBulk(name), value)
+	}
+	integer := func(name string, n int64) {
+		field(name, new(protocol.Value).SetInteger(int(n)))
+	}
+	// 与 redis 在 RESP2 下一样 浮点数以字符串返回
+	double := func(name string, f float64) {
+		field(name, new(protocol.Value).SetBulk(strconv.FormatFloat(f, 'f', 2, 64)))
+	}
+	percentage := func(part, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(part) * 100 / float64(total)
+	}
+
+	used, peak := s.usedMemory.Load(), s.peakMemory.Load()
+	integer("peak.allocated", peak)
+	integer("total.allocated", used)
+
+	overhead, keys := int64(0), int64(0)
+	for _, db := range s.dbs {
+		size := db.size()
+		if size == 0 {
+			continue
+		}
+		main := int64(size) * entryOverhead
+		expires := int64(db.expiresSize()) * expireEntryOverhead
+		field("db."+strconv.Itoa(db.id), new(protocol.Value).SetArray([]*protocol.Value{
+			new(protocol.Value).SetBulk("overhead.hashtable.main"), new(protocol.Value).SetInteger(int(main)),
+			new(protocol.Value).SetBulk("overhead.hashtable.expires"), new(protocol.Value).SetInteger(int(expires)),
+		}))
+		overhead += main
+		keys += int64(size)
+	}
+	integer("overhead.total", overhead)
+	integer("keys.count", keys)
+	bytesPerKey := int64(0)
+	if keys > 0 {
+		bytesPerKey = used / keys
+	}
+	integer("keys.bytes-per-key", bytesPerKey)
+	integer("dataset.bytes", used-overhead)
+	double("dataset.percentage", percentage(used-overhead, used))
+	double("peak.percentage", percentage(used, peak))
+
+	integer("allocator.allocated", int64(ms.HeapAlloc))
+	integer("allocator.active", int64(ms.HeapInuse))
+	integer("allocator.resident", int64(ms.Sys))
+	double("allocator-fragmentation.ratio", fragmentationRatio(&ms))
+	integer("allocator-fragmentation.bytes", int64(ms.HeapInuse)-int64(ms.HeapAlloc))
+
+	return new(protocol.Value).SetArray(values)
+}
+
+func fragmentationRatio(ms *runtime.MemStats) float64 {
+	if ms.HeapAlloc == 0 {
+		return 1
+	}
+	return float64(ms.HeapInuse) / float64(ms.HeapAlloc)
+}
+
+// memoryDoctor 与 redis 的 getMemoryDoctorReport 对应 检查常见的内存问题
+func (s *KVStore) memoryDoctor() string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	used, peak := s.usedMemory.Load(), s.peakMemory.Load()
+
+	if used < 5<<20 {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data. The new Sam and I will be back to our programming as soon as I finished rebooting."
+	}
+
+	var issues []string
+	if float64(peak) > float64(used)*1.5 {
+		issues = append(issues, "Peak memory: In the past this instance used more than 150% the memory that is currently using. "+
+			"The Go runtime returns freed memory to the OS lazily, so the process may still look big after a peak. "+
+			"If you want to try to reclaim memory now, please try the MEMORY PURGE command.")
+	}
+	if ratio := fragmentationRatio(&ms); ratio > 1.4 && ms.HeapInuse-ms.HeapAlloc > 10<<20 {
+		issues = append(issues, fmt.Sprintf("High allocator fragmentation: This instance has an allocator fragmentation ratio of %.2f (%s of in-use heap spans are free). "+
+			"This is usually harmless and goes away as the heap is reused, MEMORY PURGE may help.", ratio, bytesToHuman(int64(ms.HeapInuse-ms.HeapAlloc))))
+	}
+	if limit := s.cfg.MaxMemory; limit > 0 && float64(used) > float64(limit)*0.9 {
+		if s.cfg.MaxMemoryPolicy == "noeviction" {
+			issues = append(issues, fmt.Sprintf("Maxmemory reached: The estimated memory usage (%s) is close to maxmemory (%s) and the policy is noeviction, "+
+				"write commands will soon be rejected with -OOM. Consider raising maxmemory or selecting an eviction policy.", bytesToHuman(used), bytesToHuman(limit)))
+		}
+	}
+
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. I can only account for what occurs on this base."
+	}
+	var b strings.Builder
+	b.WriteString("Sam, I detected a few issues in this Redis instance memory implants:\n\n")
+	for _, issue := range issues {
+		b.WriteString(" * " + issue + "\n\n")
+	}
+	b.WriteString("I'm here to keep you safe, Sam. I want to help you.\n")
+	return b.String()
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/quicklist"
+	"github.com/pkg/errors"
+)
+
+const (
+	// embstrSizeLimit 不超过该长度的字符串使用 embstr 编码 与 redis 的 OBJ_ENCODING_EMBSTR_SIZE_LIMIT 一致
+	embstrSizeLimit = 44
+	// sharedIntegers 小于该值的整数字符串在 redis 中共享同一个对象 与 OBJ_SHARED_INTEGERS 一致
+	sharedIntegers = 10000
+)
+
+// isIntString 字符串能否以 int 编码保存 只有整数的规范形式才可以 例如 "012" 不行
+func isIntString(str string) (int64, bool) {
+	if len(str) == 0 || len(str) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != str {
+		return 0, false
+	}
+	return n, true
+}
+
+// encoding OBJECT ENCODING 返回的编码名称 与 redis 选择编码的规则一致
+func (e *Entity) encoding() string {
+	switch e.Type {
+	case TypeString:
+		str := e.Data.(string)
+		if _, ok := isIntString(str); ok {
+			return "int"
+		}
+		if len(str) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case TypeList:
+		// 与 redis 一样 只有一个节点的列表报告为 listpack
+		if e.Data.(*quicklist.Quicklist).Nodes() > 1 {
+			return "quicklist"
+		}
+		return "listpack"
+	case TypeStream:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// HandleOBJECT
+// OBJECT ENCODING|IDLETIME|FREQ|REFCOUNT key
+// OBJECT HELP
+// 查看 key 的内部信息 不会记录为一次访问
+func (s *KVStore) HandleOBJECT(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("object"))
+	}
+
+	sub := strings.ToUpper(args[0].Bulk())
+	if sub == "HELP" && len(args) == 1 {
+		return helpReply("OBJECT",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified",
+			"    <key>.",
+		), nil
+	}
+	if len(args) != 2 || !slices.Contains([]string{"ENCODING", "IDLETIME", "FREQ", "REFCOUNT"}, sub) {
+		return nil, errors.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try OBJECT HELP.", args[0].Bulk())
+	}
+
+	key := args[1].Bulk()
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawPeek(c.db, key)
+	if !ok {
+		return new(protocol.Value).SetNullBulk(), nil
+	}
+
+	switch sub {
+	case "ENCODING":
+		return new(protocol.Value).SetBulk(entity.encoding()), nil
+	case "IDLETIME":
+		if s.policyLFU() {
+			return nil, errors.New("ERR An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+		}
+		return new(protocol.Value).SetInteger(int(idleTime(entity, s.clock.Now()) / time.Second)), nil
+	case "FREQ":
+		if !s.policyLFU() {
+			return nil, errors.New("ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+		}
+		return new(protocol.Value).SetInteger(int(s.lfuDecrAndReturn(entity, s.clock.Now()))), nil
+	default:
+		// REFCOUNT
+		// redis 在没有使用 LRU/LFU 策略时共享小整数对象 引用计数固定为 INT_MAX
+		if entity.Type == TypeString && s.sharesIntegers() {
+			if n, ok := isIntString(entity.Data.(string)); ok && n >= 0 && n < sharedIntegers {
+				return new(protocol.Value).SetInteger(math.MaxInt32), nil
+			}
+		}
+	}
+	return new(protocol.Value).SetInteger(1), nil
+}
+
+// policyLFU 是否使用 LFU 淘汰策略 此时 OBJECT FREQ 才有意义
+func (s *KVStore) policyLFU() bool {
+	return strings.HasSuffix(s.cfg.MaxMemoryPolicy, "-lfu")
+}
+
+// sharesIntegers 与 redis 一致 设置了 maxmemory 且使用 LRU/LFU 策略时每个 key 需要独立的访问信息 不能共享整数对象
+func (s *KVStore) sharesIntegers() bool {
+	p := s.cfg.MaxMemoryPolicy
+	return s.cfg.MaxMemory == 0 || !(strings.HasSuffix(p, "-lru") || strings.HasSuffix(p, "-lfu"))
+}
+
+// helpReply HELP 子命令的回复 与 redis 的 addReplyHelp 格式一致
+func helpReply(cmd string, lines ...string) *protocol.Value {
+	values := make([]*protocol.Value, 0, len(lines)+2)
+	values = append(values, new(protocol.Value).SetStr(cmd+" <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"))
+	for _, line := range lines {
+		values = append(values, new(protocol.Value).SetStr(line))
+	}
+	values = append(values, new(protocol.Value).SetStr("HELP"), new(protocol.Value).SetStr("    Print this help."))
+	return new(protocol.Value).SetArray(values)
+}
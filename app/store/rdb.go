@@ -0,0 +1,1155 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/listpack"
+	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/quicklist"
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// streamNodeMaxEntries 写出 rdb 时每个 listpack 节点最多容纳的条目数 近似裁剪同样按它划分节点
+	streamNodeMaxEntries = 100
+
+	streamItemFlagNone       = 0
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// snapshotEntry 快照中的单个键
+type snapshotEntry struct {
+	db     int
+	key    string
+	entity *Entity
+}
+
+// snapshot 对当前数据集做一份时间点副本
+// 只在复制期间持有全局写锁 序列化以及写盘都在锁外进行
+// 返回快照以及快照时刻的 dirty 计数
+func (s *KVStore) snapshot() ([]snapshotEntry, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.snapshotLocked()
+}
+
+// snapshotLocked 外部必须持有全局写锁
+// 返回的条目按数据库编号排列
+func (s *KVStore) snapshotLocked() ([]snapshotEntry, int64) {
+	now := s.clock.Now()
+	size := 0
+	for _, db := range s.dbs {
+		size += db.size()
+	}
+
+	entries := make([]snapshotEntry, 0, size)
+	for _, db := range s.dbs {
+		for _, sh := range db.shards {
+			sh.store.Range(func(key string, entity *Entity) bool {
+				if !entity.isExpired(now) {
+					entries = append(entries, snapshotEntry{db: db.id, key: key, entity: entity.clone()})
+				}
+				return true
+			})
+		}
+	}
+
+	return entries, s.dirty.Load()
+}
+
+// rdbPath 返回 rdb 文件的完整路径
+func (s *KVStore) rdbPath() string {
+	return filepath.Join(s.cfg.Dir, s.cfg.DBFilename)
+}
+
+// rdbSaveFile 将快照写入临时文件 刷盘后再原子地重命名为目标文件
+// 保证任何时刻磁盘上的 rdb 都是完整的
+func (s *KVStore) rdbSaveFile(entries []snapshotEntry, tmpName string) error {
+	tmp := filepath.Join(s.cfg.Dir, tmpName)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	w := bufio.NewWriter(f)
+	if err := s.rdbWrite(w, entries, false); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+
+	if err := os.Rename(tmp, s.rdbPath()); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// rdbWrite 按照 rdb 格式写出完整的数据集
+// aofBase 表示写出的文件将作为 AOF 的 base 文件
+func (s *KVStore) rdbWrite(w io.Writer, entries []snapshotEntry, aofBase bool) error {
+	enc := rdb.NewEncoder(w)
+	enc.Compress = s.cfg.RDBCompression
+	enc.Checksum = s.cfg.RDBChecksum
+	now := s.clock.Now()
+
+	if err := enc.WriteHeader(); err != nil {
+		return err
+	}
+
+	aux := [][2]string{
+		{"redis-ver", "7.0.0"},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(now.Unix(), 10)},
+		{"used-mem", "0"},
+		{"aof-base", "0"},
+	}
+	if aofBase {
+		aux[len(aux)-1][1] = "1"
+	}
+	for _, kv := range aux {
+		if err := enc.WriteAux(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	for i, e := range entries {
+		// 每个数据库的第一个 key 之前写入 SELECTDB 和 RESIZEDB
+		if i == 0 || entries[i-1].db != e.db {
+			keys, expires := 0, 0
+			for _, next := range entries[i:] {
+				if next.db != e.db {
+					break
+				}
+				keys++
+				if !next.entity.ExpiredAt.IsZero() {
+					expires++
+				}
+			}
+			if err := enc.WriteSelectDB(e.db); err != nil {
+				return err
+			}
+			if err := enc.WriteResizeDB(keys, expires); err != nil {
+				return err
+			}
+		}
+
+		if !e.entity.ExpiredAt.IsZero() {
+			if err := enc.WriteExpireMS(e.entity.ExpiredAt.UnixMilli()); err != nil {
+				return err
+			}
+		}
+		// 与 redis 一致 按淘汰策略保存空闲时间或 LFU 计数器 加载后淘汰顺序保持不变
+		switch s.cfg.MaxMemoryPolicy {
+		case "allkeys-lru", "volatile-lru":
+			if err := enc.WriteByte(rdb.OpIdle); err != nil {
+				return err
+			}
+			if err := enc.WriteLength(uint64(idleTime(e.entity, now) / time.Second)); err != nil {
+				return err
+			}
+		case "allkeys-lfu", "volatile-lfu":
+			if err := enc.WriteByte(rdb.OpFreq); err != nil {
+				return err
+			}
+			if err := enc.WriteByte(s.lfuDecrAndReturn(e.entity, now)); err != nil {
+				return err
+			}
+		}
+		if err := enc.WriteByte(rdbObjectType(e.entity)); err != nil {
+			return err
+		}
+		if err := enc.WriteString(e.key); err != nil {
+			return err
+		}
+		if err := rdbSaveObject(enc, e.entity); err != nil {
+			return err
+		}
+	}
+
+	return enc.WriteEOF()
+}
+
+// rdbObjectType 返回实体在 rdb 中对应的类型
+func rdbObjectType(entity *Entity) byte {
+	switch entity.Type {
+	case TypeList:
+		return rdb.TypeListQuicklist2
+	case TypeStream:
+		return rdb.TypeStreamListpacks2
+	default:
+		return rdb.TypeString
+	}
+}
+
+// rdbSaveObject 写出实体的值部分(不包含类型和 key)
+func rdbSaveObject(enc *rdb.Encoder, entity *Entity) error {
+	switch entity.Type {
+	case TypeString:
+		return enc.WriteString(entity.Data.(string))
+	case TypeList:
+		// 与 redis 一致 按 quicklist 的节点写出 每个节点为一个完整的 listpack
+		list := entity.Data.(*quicklist.Quicklist)
+		if err := enc.WriteLength(uint64(list.Nodes())); err != nil {
+			return err
+		}
+		return list.ForEachNode(func(lp []byte) error {
+			if err := enc.WriteLength(rdb.QuicklistNodePacked); err != nil {
+				return err
+			}
+			return enc.WriteString(string(lp))
+		})
+	case TypeStream:
+		return rdbSaveStream(enc, entity.Data.(*Stream))
+	}
+
+	return errors.Errorf("unknown entity type %d", entity.Type)
+}
+
+// encodeStreamID 16 字节大端 与 redis 中 rax 的 key 格式一致
+func encodeStreamID(timestamp, seq int64) string {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(timestamp))
+	binary.BigEndian.PutUint64(buf[8:], uint64(seq))
+	return string(buf[:])
+}
+
+func decodeStreamID(raw string) (int64, int64, error) {
+	if len(raw) != 16 {
+		return 0, 0, errors.New("invalid stream ID length")
+	}
+	return int64(binary.BigEndian.Uint64([]byte(raw[:8]))), int64(binary.BigEndian.Uint64([]byte(raw[8:]))), nil
+}
+
+// rdbSaveStream 按照 RDB_TYPE_STREAM_LISTPACKS_2 写出 stream
+// 条目按 streamNodeMaxEntries 分组 每组一个 listpack 节点 节点的 key 为首个条目的 ID
+// listpack 内部布局:
+// master entry: count deleted num-fields field_1 ... field_N 0
+// 普通 entry:   flags ms-diff seq-diff [num-fields field_1 value_1 ...| value_1 ...] lp-count
+func rdbSaveStream(enc *rdb.Encoder, stream *Stream) error {
+	entities := stream.entities
+	nodes := (len(entities) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	if err := enc.WriteLength(uint64(nodes)); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(entities); start += streamNodeMaxEntries {
+		end := start + streamNodeMaxEntries
+		if end > len(entities) {
+			end = len(entities)
+		}
+		node := entities[start:end]
+		master := node[0]
+
+		masterFields := make([]string, 0, len(master.Fields)/2)
+		for i := 0; i < len(master.Fields); i += 2 {
+			masterFields = append(masterFields, master.Fields[i])
+		}
+
+		lp := listpack.New()
+		lp.AppendInt(int64(len(node)))
+		lp.AppendInt(0)
+		lp.AppendInt(int64(len(masterFields)))
+		for _, f := range masterFields {
+			lp.AppendString(f)
+		}
+		lp.AppendInt(0)
+
+		for _, e := range node {
+			numFields := len(e.Fields) / 2
+			sameFields := numFields == len(masterFields)
+			for i := 0; sameFields && i < numFields; i++ {
+				sameFields = e.Fields[i*2] == masterFields[i]
+			}
+
+			if sameFields {
+				lp.AppendInt(streamItemFlagSameFields)
+			} else {
+				lp.AppendInt(streamItemFlagNone)
+			}
+			lp.AppendInt(e.timestamp - master.timestamp)
+			lp.AppendInt(e.seq - master.seq)
+
+			if sameFields {
+				for i := 1; i < len(e.Fields); i += 2 {
+					lp.AppendString(e.Fields[i])
+				}
+				lp.AppendInt(int64(numFields + 3))
+				continue
+			}
+
+			lp.AppendInt(int64(numFields))
+			for _, f := range e.Fields {
+				lp.AppendString(f)
+			}
+			lp.AppendInt(int64(numFields*2 + 4))
+		}
+
+		if err := enc.WriteString(encodeStreamID(master.timestamp, master.seq)); err != nil {
+			return err
+		}
+		if err := enc.WriteString(string(lp.Bytes())); err != nil {
+			return err
+		}
+	}
+
+	var firstTimestamp, firstSeq int64
+	if len(entities) > 0 {
+		firstTimestamp, firstSeq = entities[0].timestamp, entities[0].seq
+	}
+
+	lens := []int64{
+		int64(len(entities)),
+		stream.lastTimestamp, stream.lastSeq,
+		firstTimestamp, firstSeq,
+		// max-deleted-entry-id
+		stream.maxDeletedID.timestamp, stream.maxDeletedID.seq,
+		// entries-added
+		stream.entriesAdded,
+	}
+	for _, l := range lens {
+		if err := enc.WriteLength(uint64(l)); err != nil {
+			return err
+		}
+	}
+
+	return rdbSaveStreamGroups(enc, stream)
+}
+
+// rdbSaveStreamGroups 写出消费者组 组与消费者按名称排序
+// 每个组: name last_id entries_read PEL(id delivery_time delivery_count) consumers
+// 每个消费者: name seen_time PEL(id) 消费者 PEL 中的条目必须出现在组的 PEL 中
+func rdbSaveStreamGroups(enc *rdb.Encoder, stream *Stream) error {
+	if err := enc.WriteLength(uint64(len(stream.groups))); err != nil {
+		return err
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(stream.groups)) {
+		g := stream.groups[name]
+		if err := enc.WriteString(name); err != nil {
+			return err
+		}
+		// entries_read 为 -1 时按 uint64 写出 读取时还原
+		for _, l := range []int64{g.lastID.timestamp, g.lastID.seq, g.entriesRead, int64(g.pel.len())} {
+			if err := enc.WriteLength(uint64(l)); err != nil {
+				return err
+			}
+		}
+		for _, id := range g.pel.ids {
+			nack := g.pel.nacks[id]
+			if err := enc.WriteRaw([]byte(encodeStreamID(id.timestamp, id.seq))); err != nil {
+				return err
+			}
+			if err := enc.WriteMillisecondTime(nack.deliveryTime.UnixMilli()); err != nil {
+				return err
+			}
+			if err := enc.WriteLength(uint64(nack.deliveryCount)); err != nil {
+				return err
+			}
+		}
+
+		if err := enc.WriteLength(uint64(len(g.consumers))); err != nil {
+			return err
+		}
+		for _, cname := range slices.Sorted(maps.Keys(g.consumers)) {
+			consumer := g.consumers[cname]
+			if err := enc.WriteString(cname); err != nil {
+				return err
+			}
+			if err := enc.WriteMillisecondTime(consumer.seenTime.UnixMilli()); err != nil {
+				return err
+			}
+			if err := enc.WriteLength(uint64(consumer.pel.len())); err != nil {
+				return err
+			}
+			for _, id := range consumer.pel.ids {
+				if err := enc.WriteRaw([]byte(encodeStreamID(id.timestamp, id.seq))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// LoadRDB 启动时从磁盘加载 rdb 文件 文件不存在时视为空数据集
+func (s *KVStore) LoadRDB() error {
+	f, err := os.Open(s.rdbPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	start := s.clock.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.rdbLoad(f); err != nil {
+		return err
+	}
+
+	s.lastSave = s.clock.Now()
+	log.Printf("DB loaded from disk: %.3f seconds", s.clock.Since(start).Seconds())
+	return nil
+}
+
+// rdbLoad 外部必须持有写锁
+func (s *KVStore) rdbLoad(r io.Reader) error {
+	dec := rdb.NewDecoder(r)
+	if err := dec.ReadHeader(); err != nil {
+		return err
+	}
+
+	now := s.clock.Now()
+	db := 0
+	var expiredAt time.Time
+	// lruIdle/lfuFreq 下一个 key 的空闲时间和 LFU 计数器 -1 表示没有提供
+	lruIdle, lfuFreq := int64(-1), int64(-1)
+
+	for {
+		typ, err := dec.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case rdb.OpEOF:
+			return dec.VerifyChecksum()
+		case rdb.OpSelectDB:
+			n, err := dec.ReadLen()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+			continue
+		case rdb.OpResizeDB:
+			if _, err := dec.ReadLen(); err != nil {
+				return err
+			}
+			if _, err := dec.ReadLen(); err != nil {
+				return err
+			}
+			continue
+		case rdb.OpAux:
+			if _, err := dec.ReadString(); err != nil {
+				return err
+			}
+			if _, err := dec.ReadString(); err != nil {
+				return err
+			}
+			continue
+		case rdb.OpExpireTimeMS:
+			ms, err := dec.ReadMillisecondTime()
+			if err != nil {
+				return err
+			}
+			expiredAt = time.UnixMilli(ms)
+			continue
+		case rdb.OpExpireTime:
+			sec, err := dec.ReadSecondTime()
+			if err != nil {
+				return err
+			}
+			expiredAt = time.Unix(sec, 0)
+			continue
+		case rdb.OpIdle:
+			n, err := dec.ReadLen()
+			if err != nil {
+				return err
+			}
+			lruIdle = int64(n)
+			continue
+		case rdb.OpFreq:
+			b, err := dec.ReadByte()
+			if err != nil {
+				return err
+			}
+			lfuFreq = int64(b)
+			continue
+		case rdb.OpSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := dec.ReadLen(); err != nil {
+					return err
+				}
+			}
+			continue
+		case rdb.OpFunction2:
+			if _, err := dec.ReadString(); err != nil {
+				return err
+			}
+			continue
+		case rdb.OpModuleAux, rdb.OpFunctionPre:
+			return errors.Errorf("unsupported rdb opcode %d", typ)
+		}
+
+		key, err := dec.ReadString()
+		if err != nil {
+			return err
+		}
+		entity, err := s.rdbLoadObject(dec, typ)
+		if err != nil {
+			return errors.WithMessagef(err, "load key '%s'", key)
+		}
+		freq, idle := lfuFreq, lruIdle
+		lfuFreq, lruIdle = -1, -1
+		if entity == nil {
+			expiredAt = time.Time{}
+			log.Printf("rdb: skip key '%s' of unsupported type %d", key, typ)
+			continue
+		}
+		entity.ExpiredAt = expiredAt
+		expiredAt = time.Time{}
+
+		if db >= len(s.dbs) {
+			log.Printf("rdb: skip key '%s' in db %d", key, db)
+			continue
+		}
+		// 已经过期的 key 直接丢弃
+		if entity.isExpired(now) {
+			continue
+		}
+		s.rawSet(s.dbs[db], key, entity)
+		setLRUOrLFU(entity, freq, idle, now)
+	}
+}
+
+// rdbLoadObject 读取实体的值部分
+// 哈希、集合、有序集合等还不支持的类型只读取并丢弃它们的数据 返回 nil 见 rdbSkipObject
+func (s *KVStore) rdbLoadObject(dec *rdb.Decoder, typ byte) (*Entity, error) {
+	switch typ {
+	case rdb.TypeString:
+		str, err := dec.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		return &Entity{Type: TypeString, Data: str}, nil
+	case rdb.TypeList, rdb.TypeListZiplist, rdb.TypeListQuicklist, rdb.TypeListQuicklist2:
+		list := s.newList()
+		if err := rdbLoadList(dec, typ, list); err != nil {
+			return nil, err
+		}
+		return &Entity{Type: TypeList, Data: list}, nil
+	case rdb.TypeStreamListpacks, rdb.TypeStreamListpacks2, rdb.TypeStreamListpacks3:
+		stream, err := rdbLoadStream(dec, typ)
+		if err != nil {
+			return nil, err
+		}
+		return &Entity{Type: TypeStream, Data: stream}, nil
+	}
+
+	return nil, rdbSkipObject(dec, typ)
+}
+
+// rdbSkipObject 按 redis 的格式读取不支持的类型的值 使后面的数据仍然能够正确解析
+// 模块类型等无法确定长度的类型返回错误
+func rdbSkipObject(dec *rdb.Decoder, typ byte) error {
+	// skipItems 读取元素数量 然后对每个元素调用一次 skip
+	skipItems := func(skip func() error) error {
+		n, err := dec.ReadCount()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := skip(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	skipStrings := func(n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := dec.ReadString(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch typ {
+	case rdb.TypeSet:
+		return skipItems(func() error { return skipStrings(1) })
+	case rdb.TypeHash:
+		return skipItems(func() error { return skipStrings(2) })
+	case rdb.TypeZSet:
+		// member + 字符串形式的分数 长度为 253/254/255 时表示 nan/+inf/-inf 没有后续字节
+		return skipItems(func() error {
+			if err := skipStrings(1); err != nil {
+				return err
+			}
+			n, err := dec.ReadByte()
+			if err != nil || n >= 253 {
+				return err
+			}
+			_, err = dec.ReadRaw(int(n))
+			return err
+		})
+	case rdb.TypeZSet2:
+		// member + 8 字节的二进制 double
+		return skipItems(func() error {
+			if err := skipStrings(1); err != nil {
+				return err
+			}
+			_, err := dec.ReadRaw(8)
+			return err
+		})
+	case rdb.TypeHashMetadataPreGA:
+		// 每个字段: 过期时间 field value
+		return skipItems(func() error {
+			if _, err := dec.ReadMillisecondTime(); err != nil {
+				return err
+			}
+			return skipStrings(2)
+		})
+	case rdb.TypeHashMetadata:
+		// 最小过期时间 每个字段: 相对过期时间 field value
+		if _, err := dec.ReadMillisecondTime(); err != nil {
+			return err
+		}
+		return skipItems(func() error {
+			if _, err := dec.ReadLen(); err != nil {
+				return err
+			}
+			return skipStrings(2)
+		})
+	case rdb.TypeHashListpackEx:
+		// 最小过期时间 + listpack
+		if _, err := dec.ReadMillisecondTime(); err != nil {
+			return err
+		}
+		return skipStrings(1)
+	case rdb.TypeHashZipmap, rdb.TypeSetIntset, rdb.TypeZSetZiplist, rdb.TypeHashZiplist,
+		rdb.TypeHashListpack, rdb.TypeZSetListpack, rdb.TypeSetListpack, rdb.TypeHashListpackExPreGA:
+		// 整个值序列化为一个字符串
+		return skipStrings(1)
+	}
+
+	return errors.Errorf("unsupported rdb object type %d", typ)
+}
+
+// rdbLoadList 读取各个版本的列表格式 元素按顺序追加到 list
+// 节点按当前的 list-max-listpack-size 重新划分 不沿用 rdb 中的节点
+func rdbLoadList(dec *rdb.Decoder, typ byte, list *quicklist.Quicklist) error {
+	pushAll := func(items []string, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, v := range items {
+			list.PushTail(v)
+		}
+		return nil
+	}
+
+	switch typ {
+	case rdb.TypeList:
+		n, err := dec.ReadCount()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			v, err := dec.ReadString()
+			if err != nil {
+				return err
+			}
+			list.PushTail(v)
+		}
+		return nil
+	case rdb.TypeListZiplist:
+		blob, err := dec.ReadString()
+		if err != nil {
+			return err
+		}
+		return pushAll(rdb.ParseZiplist([]byte(blob)))
+	}
+
+	// quicklist: 节点数量 + 每个节点
+	nodes, err := dec.ReadCount()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < nodes; i++ {
+		container := uint64(rdb.QuicklistNodePacked)
+		if typ == rdb.TypeListQuicklist2 {
+			if container, err = dec.ReadLen(); err != nil {
+				return err
+			}
+		}
+		blob, err := dec.ReadString()
+		if err != nil {
+			return err
+		}
+
+		if container == rdb.QuicklistNodePlain {
+			list.PushTail(blob)
+			continue
+		}
+
+		if typ == rdb.TypeListQuicklist {
+			err = pushAll(rdb.ParseZiplist([]byte(blob)))
+		} else {
+			err = pushAll(listpack.Parse([]byte(blob)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rdbLoadStream 读取 RDB_TYPE_STREAM_LISTPACKS(_2/_3)
+func rdbLoadStream(dec *rdb.Decoder, typ byte) (*Stream, error) {
+	stream := &Stream{entities: make([]StreamEntity, 0)}
+
+	nodes, err := dec.ReadCount()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < nodes; i++ {
+		rawID, err := dec.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		masterTimestamp, masterSeq, err := decodeStreamID(rawID)
+		if err != nil {
+			return nil, err
+		}
+
+		blob, err := dec.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		items, err := listpack.Parse([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+
+		entities, err := parseStreamNode(items, masterTimestamp, masterSeq)
+		if err != nil {
+			return nil, err
+		}
+		stream.append(entities...)
+	}
+
+	// length last_id
+	vals, err := readLens(dec, 3)
+	if err != nil {
+		return nil, err
+	}
+	stream.lastTimestamp, stream.lastSeq = int64(vals[1]), int64(vals[2])
+
+	// first_id max_deleted_entry_id entries_added
+	// RDB_TYPE_STREAM_LISTPACKS 没有这些字段 视为没有删除过条目
+	stream.entriesAdded = int64(len(stream.entities))
+	if typ >= rdb.TypeStreamListpacks2 {
+		vals, err := readLens(dec, 5)
+		if err != nil {
+			return nil, err
+		}
+		stream.maxDeletedID = streamID{timestamp: int64(vals[2]), seq: int64(vals[3])}
+		stream.entriesAdded = int64(vals[4])
+	}
+
+	if err := rdbLoadStreamGroups(dec, typ, stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// rdbLoadStreamGroups 读取消费者组 格式见 rdbSaveStreamGroups
+// RDB_TYPE_STREAM_LISTPACKS 没有 entries_read RDB_TYPE_STREAM_LISTPACKS_3 的消费者多了 active_time
+func rdbLoadStreamGroups(dec *rdb.Decoder, typ byte, stream *Stream) error {
+	groups, err := dec.ReadCount()
+	if err != nil {
+		return err
+	}
+	if groups > 0 {
+		stream.groups = make(map[string]*consumerGroup, groups)
+	}
+
+	for i := 0; i < groups; i++ {
+		name, err := dec.ReadString()
+		if err != nil {
+			return err
+		}
+		vals, err := readLens(dec, 2)
+		if err != nil {
+			return err
+		}
+		entriesRead := int64(-1)
+		if typ >= rdb.TypeStreamListpacks2 {
+			n, err := dec.ReadLen()
+			if err != nil {
+				return err
+			}
+			entriesRead = int64(n)
+		}
+		g := newConsumerGroup(streamID{timestamp: int64(vals[0]), seq: int64(vals[1])}, entriesRead)
+
+		pel, err := dec.ReadCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < pel; j++ {
+			id, err := readStreamID(dec)
+			if err != nil {
+				return err
+			}
+			ms, err := dec.ReadMillisecondTime()
+			if err != nil {
+				return err
+			}
+			count, err := dec.ReadLen()
+			if err != nil {
+				return err
+			}
+			// 所属的消费者在读取消费者时设置
+			g.pel.add(id, &streamNACK{deliveryTime: time.UnixMilli(ms), deliveryCount: int64(count)})
+		}
+
+		consumers, err := dec.ReadCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < consumers; j++ {
+			cname, err := dec.ReadString()
+			if err != nil {
+				return err
+			}
+			seen, err := dec.ReadMillisecondTime()
+			if err != nil {
+				return err
+			}
+			if typ >= rdb.TypeStreamListpacks3 {
+				if _, err := dec.ReadMillisecondTime(); err != nil {
+					return err
+				}
+			}
+			consumer, _ := g.lookupConsumer(cname, true, time.UnixMilli(seen))
+
+			npel, err := dec.ReadCount()
+			if err != nil {
+				return err
+			}
+			for k := 0; k < npel; k++ {
+				id, err := readStreamID(dec)
+				if err != nil {
+					return err
+				}
+				nack, ok := g.pel.get(id)
+				if !ok {
+					return errors.Errorf("stream consumer PEL entry %s not found in group PEL", id)
+				}
+				nack.consumer = consumer
+				consumer.pel.add(id, nack)
+			}
+		}
+
+		for _, id := range g.pel.ids {
+			if g.pel.nacks[id].consumer == nil {
+				return errors.Errorf("stream group PEL entry %s has no consumer", id)
+			}
+		}
+		stream.groups[name] = g
+	}
+	return nil
+}
+
+// readStreamID 读取 16 字节的 stream ID
+func readStreamID(dec *rdb.Decoder) (streamID, error) {
+	raw, err := dec.ReadRaw(16)
+	if err != nil {
+		return streamID{}, err
+	}
+	timestamp, seq, err := decodeStreamID(string(raw))
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{timestamp: timestamp, seq: seq}, nil
+}
+
+// parseStreamNode 解析单个 listpack 节点中的所有有效条目
+func parseStreamNode(items []string, masterTimestamp, masterSeq int64) ([]StreamEntity, error) {
+	p := 0
+	next := func() (string, error) {
+		if p >= len(items) {
+			return "", errors.New("stream listpack truncated")
+		}
+		p++
+		return items[p-1], nil
+	}
+	nextInt := func() (int64, error) {
+		s, err := next()
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, errors.New("stream listpack: invalid integer")
+		}
+		return v, nil
+	}
+	// nextCount 读取后续元素的数量 不能超过节点中剩余的元素
+	nextCount := func() (int, error) {
+		v, err := nextInt()
+		if err != nil {
+			return 0, err
+		}
+		if v < 0 || v > int64(len(items)-p) {
+			return 0, errors.New("stream listpack: count out of range")
+		}
+		return int(v), nil
+	}
+
+	// master entry
+	count, err := nextCount()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	numMaster, err := nextCount()
+	if err != nil {
+		return nil, err
+	}
+	masterFields := make([]string, 0, numMaster)
+	for i := 0; i < numMaster; i++ {
+		f, err := next()
+		if err != nil {
+			return nil, err
+		}
+		masterFields = append(masterFields, f)
+	}
+	if _, err := next(); err != nil {
+		return nil, err
+	}
+
+	entities := make([]StreamEntity, 0, count)
+	for p < len(items) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+
+		var fields []string
+		if flags&streamItemFlagSameFields != 0 {
+			fields = make([]string, 0, len(masterFields)*2)
+			for _, f := range masterFields {
+				v, err := next()
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, f, v)
+			}
+		} else {
+			n, err := nextCount()
+			if err != nil {
+				return nil, err
+			}
+			fields = make([]string, 0, n*2)
+			for i := 0; i < n*2; i++ {
+				v, err := next()
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, v)
+			}
+		}
+
+		// lp-count
+		if _, err := next(); err != nil {
+			return nil, err
+		}
+
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		entities = append(entities, StreamEntity{
+			timestamp: masterTimestamp + msDiff,
+			seq:       masterSeq + seqDiff,
+			Fields:    fields,
+		})
+	}
+
+	return entities, nil
+}
+
+func readLens(dec *rdb.Decoder, n int) ([]uint64, error) {
+	vals := make([]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := dec.ReadLen()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+// HandleSAVE 同步保存 期间阻塞调用方
+func (s *KVStore) HandleSAVE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 0 {
+		return nil, errors.New(emsgArgsNumber("save"))
+	}
+
+	if !s.saving.CompareAndSwap(false, true) {
+		return nil, errors.New("ERR Background save already in progress")
+	}
+	defer s.saving.Store(false)
+
+	if err := s.rdbSave(fmt.Sprintf("temp-%d.rdb", os.Getpid())); err != nil {
+		log.Printf("rdb: save failed: %+v", err)
+		return nil, errors.New("ERR")
+	}
+
+	return new(protocol.Value).SetStr("OK"), nil
+}
+
+// HandleBGSAVE 在后台 goroutine 中保存
+// 快照在返回前完成 因此保存的数据就是命令执行时刻的数据
+func (s *KVStore) HandleBGSAVE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	// BGSAVE [SCHEDULE]
+	if len(args) > 1 {
+		return nil, errors.New(emsgArgsNumber("bgsave"))
+	}
+
+	if err := s.bgsave(); err != nil {
+		return nil, err
+	}
+
+	return new(protocol.Value).SetStr("Background saving started"), nil
+}
+
+func (s *KVStore) HandleLASTSAVE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) != 0 {
+		return nil, errors.New(emsgArgsNumber("lastsave"))
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return new(protocol.Value).SetInteger(int(s.lastSave.Unix())), nil
+}
+
+func (s *KVStore) bgsave() error {
+	if !s.saving.CompareAndSwap(false, true) {
+		return errors.New("ERR Background save already in progress")
+	}
+
+	entries, dirty := s.snapshot()
+	s.background(func() {
+		defer s.saving.Store(false)
+
+		if err := s.rdbSaveSnapshot(entries, dirty, fmt.Sprintf("temp-bg-%d.rdb", os.Getpid())); err != nil {
+			log.Printf("rdb: background saving error: %+v", err)
+			return
+		}
+		log.Println("rdb: background saving terminated with success")
+	})
+
+	return nil
+}
+
+// rdbSave 快照并写盘
+func (s *KVStore) rdbSave(tmpName string) error {
+	entries, dirty := s.snapshot()
+	return s.rdbSaveSnapshot(entries, dirty, tmpName)
+}
+
+// rdbSaveSnapshot 写盘成功后扣除快照时刻之前的修改计数
+func (s *KVStore) rdbSaveSnapshot(entries []snapshotEntry, dirty int64, tmpName string) error {
+	if err := s.rdbSaveFile(entries, tmpName); err != nil {
+		s.mutex.Lock()
+		s.lastSaveFailed = s.clock.Now()
+		s.mutex.Unlock()
+		return err
+	}
+
+	s.mutex.Lock()
+	s.dirty.Add(-dirty)
+	s.lastSave = s.clock.Now()
+	s.mutex.Unlock()
+	return nil
+}
+
+// handleAutoSave 检查 save <seconds> <changes> 规则 满足任一规则即触发 BGSAVE
+// 与 redis 一致 上次保存失败后需要间隔一段时间才重试
+func (s *KVStore) handleAutoSave() {
+	ticker := s.clock.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	const retryDelay = 5 * time.Second
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C():
+		}
+
+		if s.saving.Load() {
+			continue
+		}
+
+		s.mutex.RLock()
+		dirty, lastSave, lastFailed := s.dirty.Load(), s.lastSave, s.lastSaveFailed
+		s.mutex.RUnlock()
+
+		now := s.clock.Now()
+		if now.Sub(lastFailed) < retryDelay {
+			continue
+		}
+
+		for _, param := range s.cfg.SaveParams {
+			if dirty >= int64(param.Changes) && dirty > 0 &&
+				now.Sub(lastSave) >= time.Duration(param.Seconds)*time.Second {
+				log.Printf("%d changes in %d seconds. Saving...", param.Changes, param.Seconds)
+				s.runInLoop(func() {
+					if err := s.bgsave(); err != nil {
+						log.Printf("rdb: %v", err)
+					}
+				})
+				break
+			}
+		}
+	}
+}
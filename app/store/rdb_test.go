@@ -0,0 +1,96 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+)
+
+// 哈希、集合、有序集合被跳过 前后的 key 照常加载
+func TestRDBLoadSkipsUnsupportedTypes(t *testing.T) {
+	var buf bytes.Buffer
+	enc := rdb.NewEncoder(&buf)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKey := func(typ byte, key string, value func()) {
+		t.Helper()
+		must(enc.WriteByte(typ))
+		must(enc.WriteString(key))
+		value()
+	}
+	writeStrings := func(values ...string) {
+		t.Helper()
+		for _, v := range values {
+			must(enc.WriteString(v))
+		}
+	}
+
+	must(enc.WriteHeader())
+	must(enc.WriteSelectDB(0))
+	writeKey(rdb.TypeString, "before", func() { writeStrings("1") })
+	writeKey(rdb.TypeSet, "set", func() {
+		must(enc.WriteLength(2))
+		writeStrings("a", "b")
+	})
+	writeKey(rdb.TypeHash, "hash", func() {
+		must(enc.WriteLength(1))
+		writeStrings("f", "v")
+	})
+	writeKey(rdb.TypeZSet, "zset", func() {
+		must(enc.WriteLength(2))
+		writeStrings("a")
+		must(enc.WriteRaw([]byte{3, '1', '.', '5'}))
+		writeStrings("b")
+		// +inf 没有后续字节
+		must(enc.WriteByte(254))
+	})
+	writeKey(rdb.TypeZSet2, "zset2", func() {
+		must(enc.WriteLength(1))
+		writeStrings("a")
+		must(enc.WriteRaw(binary.LittleEndian.AppendUint64(nil, math.Float64bits(1.5))))
+	})
+	writeKey(rdb.TypeSetListpack, "setlp", func() { writeStrings("opaque listpack") })
+	// 被跳过的 key 的过期时间不能留给下一个 key
+	must(enc.WriteExpireMS(1))
+	writeKey(rdb.TypeHashListpackEx, "hashex", func() {
+		must(enc.WriteMillisecondTime(1))
+		writeStrings("opaque listpack")
+	})
+	writeKey(rdb.TypeHashMetadata, "hashmeta", func() {
+		must(enc.WriteMillisecondTime(1))
+		must(enc.WriteLength(1))
+		must(enc.WriteLength(0))
+		writeStrings("f", "v")
+	})
+	writeKey(rdb.TypeList, "after", func() {
+		must(enc.WriteLength(2))
+		writeStrings("x", "y")
+	})
+	must(enc.WriteEOF())
+
+	s := newTestStore(t, "locked", Options{})
+	s.mutex.Lock()
+	err := s.rdbLoad(&buf)
+	s.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _, _ := s.Get("before"); v != "1" {
+		t.Fatalf("GET before = %q, want 1", v)
+	}
+	if got, _ := s.LRange("after", 0, -1); !slices.Equal(got, []string{"x", "y"}) {
+		t.Fatalf("LRANGE after = %v, want [x y]", got)
+	}
+	if n, _ := s.Exists("set", "hash", "zset", "zset2", "setlp", "hashex", "hashmeta"); n != 0 {
+		t.Fatalf("EXISTS = %d, want 0", n)
+	}
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/dict"
+)
+
+// defaultShards 每个数据库默认的分片数量
+const defaultShards = 16
+
+// shard 数据库中的一个分片 拥有独立的锁
+// key 按哈希值分散到各个分片 访问不同分片的命令可以并行执行
+//
+// 锁分为两层
+//  1. KVStore.mutex 按 key 访问的命令持有它的读锁
+//     需要看到整个键空间的操作(快照、FLUSHALL、SWAPDB、INFO 等)持有它的写锁 此时不需要再获取分片锁
+//  2. shard.mu 只读命令持有读锁 其余持有写锁
+//     同时涉及多个分片时按 (数据库编号, 分片下标) 的顺序加锁 因此不会死锁
+type shard struct {
+	// dbID 与 idx 决定加锁顺序 SWAPDB 只交换分片中的数据 分片本身不会移动
+	dbID, idx int
+	mu        sync.RWMutex
+
+	// store 键空间 使用支持稳定游标的哈希表 以便实现 SCAN
+	store *dict.Dict[*Entity]
+	// expires 所有设置了过期时间的 key 主动过期只在其中采样
+	expires *expireIndex
+	// used 分片中所有 key 估算的内存占用 SWAPDB 时随数据一起交换
+	used int64
+	// 用于 List 的阻塞等待 对于一个key可能有多个连接阻塞等待 故需要用一个切片去处理 以此实现后续的FIFO
+	// 阻塞的客户端始终等待在它阻塞时所在的数据库上 SWAPDB 只交换数据而不交换等待者
+	listWaiters map[string][]*listWaiter
+	// streamWaiters 阻塞在 stream 上的 XREAD 与 listWaiters 一样按阻塞的先后顺序排列
+	streamWaiters map[string][]*streamWaiter
+}
+
+func newShard(dbID, idx int) *shard {
+	return &shard{
+		dbID:          dbID,
+		idx:           idx,
+		store:         dict.New[*Entity](),
+		expires:       newExpireIndex(),
+		listWaiters:   make(map[string][]*listWaiter),
+		streamWaiters: make(map[string][]*streamWaiter),
+	}
+}
+
+func compareShard(a, b *shard) int {
+	if c := cmp.Compare(a.dbID, b.dbID); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.idx, b.idx)
+}
+
+// shardLock 已经获取的分片锁 由 unlock 释放
+// 只涉及一个分片时不需要分配切片 单 key 命令加锁没有额外的内存分配
+type shardLock struct {
+	s      *KVStore
+	one    *shard
+	shards []*shard
+	write  bool
+}
+
+// lockShards 持有全局读锁 再按固定顺序获取各分片的锁(重复的分片只锁一次)
+// 事件循环模式下只有执行 goroutine 会访问键空间 不需要加锁
+func (s *KVStore) lockShards(write bool, shards ...*shard) shardLock {
+	if s.exec != nil {
+		return shardLock{}
+	}
+
+	l := shardLock{s: s, write: write}
+	switch len(shards) {
+	case 0:
+	case 1:
+		l.one = shards[0]
+	default:
+		l.shards = slices.Clone(shards)
+		slices.SortFunc(l.shards, compareShard)
+		l.shards = slices.Compact(l.shards)
+	}
+
+	s.mutex.RLock()
+	if l.one != nil {
+		l.lock(l.one)
+	}
+	for _, sh := range l.shards {
+		l.lock(sh)
+	}
+	return l
+}
+
+func (l shardLock) lock(sh *shard) {
+	if l.write {
+		sh.mu.Lock()
+	} else {
+		sh.mu.RLock()
+	}
+}
+
+func (l shardLock) release(sh *shard) {
+	if l.write {
+		sh.mu.Unlock()
+	} else {
+		sh.mu.RUnlock()
+	}
+}
+
+// holds 是否持有 sh 的锁
+func (l shardLock) holds(sh *shard) bool {
+	return l.one == sh || slices.Contains(l.shards, sh)
+}
+
+// unlock 按加锁的相反顺序释放所有锁
+// 释放写锁之前先服务因这次写入而就绪的 key 见 blocking.go
+func (l shardLock) unlock() {
+	if l.s == nil {
+		return
+	}
+	if l.write {
+		l.s.serveLockedReadyKeys(l)
+	}
+	for i := len(l.shards) - 1; i >= 0; i-- {
+		l.release(l.shards[i])
+	}
+	if l.one != nil {
+		l.release(l.one)
+	}
+	l.s.mutex.RUnlock()
+}
+
+// lockKeys 获取 db 中 keys 所在分片的写锁
+// 用法 defer s.lockKeys(c.db, key).unlock()
+func (s *KVStore) lockKeys(db *database, keys ...string) shardLock {
+	if len(keys) == 1 {
+		return s.lockShards(true, db.shard(keys[0]))
+	}
+	return s.lockShards(true, db.shardsOf(keys)...)
+}
+
+// rlockKeys 获取 db 中 keys 所在分片的读锁 只能配合 rawLookup 使用
+func (s *KVStore) rlockKeys(db *database, keys ...string) shardLock {
+	if len(keys) == 1 {
+		return s.lockShards(false, db.shard(keys[0]))
+	}
+	return s.lockShards(false, db.shardsOf(keys)...)
+}
@@ -1,11 +1,18 @@
 package store
 
 import (
+	"hash/maphash"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
+	"github.com/codecrafters-io/redis-starter-go/app/clock"
+	"github.com/codecrafters-io/redis-starter-go/app/config"
 	"github.com/codecrafters-io/redis-starter-go/app/protocol"
+	"github.com/codecrafters-io/redis-starter-go/app/quicklist"
 	"github.com/pkg/errors"
 )
 
@@ -21,103 +28,323 @@ type Entity struct {
 	Type      ValueType
 	ExpiredAt time.Time
 	Data      interface{}
+
+	// lru 最近一次访问的 unix 时间(毫秒) 用于 LRU 淘汰
+	lru int64
+	// lfu 高 16 位为计数器最近一次衰减的时间(分钟) 低 8 位为对数计数器 与 redis 的布局一致
+	lfu uint32
+	// size 写入键空间时计入 used_memory 的估算大小
+	size int64
+}
+
+func (e *Entity) isExpired(now time.Time) bool {
+	return !e.ExpiredAt.IsZero() && !e.ExpiredAt.After(now)
+}
+
+// clone 复制实体 用于生成快照
+// 字符串不可变 直接共享即可 容器类型需要复制一份 避免后续修改影响快照
+func (e *Entity) clone() *Entity {
+	c := *e
+	switch e.Type {
+	case TypeList:
+		c.Data = e.Data.(*quicklist.Quicklist).Clone()
+	case TypeStream:
+		c.Data = e.Data.(*Stream).clone()
+	}
+	return &c
 }
 
 type KVStore struct {
-	store map[string]*Entity
-	// 用于 List 的阻塞等待 对于一个key可能有多个连接阻塞等待 故需要用一个[]chan去处理 以此实现后续的FIFO
-	listWaiters map[string][]chan ListPayload
-	// 未来可能需要的阻塞
-	// streamWaiters map[string][]chan StreamPayload
-	// zsetWaiters   map[string][]chan ZSetPayload
+	// dbs 逻辑数据库 下标即 SELECT 使用的编号
+	dbs []*database
+	// mutex 全局锁 与分片锁的关系见 shard.go
 	mutex sync.RWMutex
+
+	cfg *config.Config
+	// dirty 上次保存之后的修改次数 不同分片上的写命令会并发修改
+	dirty          atomic.Int64
+	lastSave       time.Time
+	lastSaveFailed time.Time
+	// saving 是否有 SAVE/BGSAVE 正在进行
+	saving atomic.Bool
+	// aof 未开启 AOF 时为 nil
+	aof *aof.AOF
+	// aofSelectedDB AOF 中最近一次 SELECT 的数据库 -1 表示下一条命令前必须写入 SELECT
+	aofSelectedDB int
+	// propagateMu 保护 aofSelectedDB 保证 SELECT 与其后的命令连续写入
+	propagateMu sync.Mutex
+	// lazyfreePending 等待后台释放的实体数量
+	lazyfreePending atomic.Int64
+	// usedMemory 所有分片估算的内存占用之和 见 memory.go
+	usedMemory atomic.Int64
+	// peakMemory usedMemory 曾经达到的最大值
+	peakMemory atomic.Int64
+	// evictMu 保证同一时间只有一个客户端在淘汰 key 同时保护 evict
+	evictMu sync.Mutex
+	evict   evictionState
+
+	// expireMu 保证同一时间只有一个主动过期周期在执行 同时保护 expire 以及 stats 中的过期周期统计
+	expireMu sync.Mutex
+	expire   expireCycleState
+	// activeExpireDisabled 通过 DEBUG SET-ACTIVE-EXPIRE 0 关闭主动过期 只保留惰性过期
+	activeExpireDisabled bool
+	stats                storeStats
+	// startTime 启动时间 用于 INFO
+	startTime time.Time
+
+	clock clock.Clock
+	// api Go API 使用的客户端 固定在 0 号数据库
+	api *Client
+	// exec 事件循环模式下的执行器 加锁模式下为 nil
+	exec *executor
+
+	// nextClientID 最近一次分配的客户端 id
+	nextClientID atomic.Int64
+	// clientsMu 保护 clients 以及各客户端中可能被其他客户端访问的字段 见 client.go
+	clientsMu sync.Mutex
+	clients   map[int64]*Client
+
+	// readyMu 保护 readyKeys 与 readySet 不同分片上的写命令会并发标记就绪的 key 见 blocking.go
+	readyMu   sync.Mutex
+	readyKeys []readyKey
+	readySet  map[readyKey]struct{}
+	// readyLen readyKeys 的长度 释放写锁时不加锁检查有没有就绪的 key
+	readyLen atomic.Int32
+
+	// done 关闭时通知后台任务退出 wg 等待它们结束
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
-var kvOnce sync.Once
-var kvStore *KVStore
+// storeStats INFO stats 中的统计信息
+// 除 expiredKeys、evictedKeys 外都由主动过期周期在持有 expireMu 时修改
+type storeStats struct {
+	// expiredKeys 因过期而被删除的 key 总数(包括惰性删除和主动删除)
+	expiredKeys atomic.Int64
+	// evictedKeys 因超出 maxmemory 而被淘汰的 key 总数
+	evictedKeys atomic.Int64
+	// expiredStalePerc 估算的已过期但尚未删除的 key 占有过期时间的 key 的比例
+	expiredStalePerc float64
+	// expiredTimeCapReached 主动过期因为超出时间预算而提前结束的次数
+	expiredTimeCapReached int64
+	// expireCycleTime 主动过期累计耗时
+	expireCycleTime time.Duration
+}
 
-func NewKVStore() *KVStore {
-	kvOnce.Do(func() {
-		kvStore = &KVStore{
-			store:       make(map[string]*Entity),
-			listWaiters: make(map[string][]chan ListPayload),
+// Options 创建 KVStore 的选项 零值字段使用默认值
+type Options struct {
+	// Config 为 nil 时使用 config.Default()
+	// 数据库数量、主动过期频率(hz)、持久化等都由它决定
+	Config *config.Config
+	// Clock 为 nil 时使用系统时钟 测试时可以传入 clock.Fake
+	Clock clock.Clock
+	// Shards 每个数据库的分片数量 会向上取整为 2 的幂 为 0 时使用 defaultShards
+	// 为 1 时等价于只有一把全局锁
+	Shards int
+}
+
+// NewKVStore 创建一个独立的存储实例并启动后台任务(主动过期、自动保存)
+// 不再使用时需要调用 Close 停止后台任务
+func NewKVStore(opts Options) *KVStore {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	clk := opts.Clock
+	if clk == nil {
+		clk = clock.System{}
+	}
+
+	shards := defaultShards
+	if opts.Shards > 0 {
+		shards = 1
+		for shards < opts.Shards {
+			shards <<= 1
 		}
+	}
 
-		go func() {
-			kvStore.handleActiveDelete()
-		}()
-	})
+	s := &KVStore{
+		dbs:           make([]*database, cfg.Databases),
+		cfg:           cfg,
+		clock:         clk,
+		aofSelectedDB: -1,
+		done:          make(chan struct{}),
+	}
+	seed := maphash.MakeSeed()
+	for i := range s.dbs {
+		s.dbs[i] = newDatabase(i, shards, seed)
+	}
+	s.lastSave = s.clock.Now()
+	s.startTime = s.clock.Now()
+	s.api = s.NewClient()
+
+	if cfg.ExecutionMode == "eventloop" {
+		s.exec = newExecutor(s)
+		s.background(s.exec.run)
+	}
+	s.background(s.handleActiveExpire)
+	s.background(s.handleAutoSave)
+
+	return s
+}
+
+// background 启动一个由 Close 等待结束的后台 goroutine
+func (s *KVStore) background(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// Close 停止后台任务 等待正在进行的 BGSAVE 和 AOF 重写结束 然后关闭 AOF
+// 可以重复调用
+func (s *KVStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
 
-	return kvStore
+		s.mutex.Lock()
+		a := s.aof
+		s.aof = nil
+		s.mutex.Unlock()
+
+		if a != nil {
+			err = a.Close()
+		}
+	})
+	return err
 }
 
 // ---------------------------------------------------------
 // raw 操作
 // 约定：调用这些方法前，必须已经持有相应的锁
+// 写锁指 key 所在分片的写锁(或全局写锁) 读锁同理
 // ---------------------------------------------------------
 
 // rawSet 外部必须持有写锁
-func (s *KVStore) rawSet(key string, entity *Entity) {
-	s.store[key] = entity
+// 覆盖已有的 key 时新实体继承旧实体的 LFU 计数器 与 redis 的 dbSetValue 一致
+// RENAME/MOVE 等写入已有实体时保留它的访问信息
+func (s *KVStore) rawSet(db *database, key string, entity *Entity) {
+	sh := db.shard(key)
+	old, exist := sh.store.Get(key)
+	if exist {
+		s.unaccount(sh, old)
+	}
+	if entity.lfu == 0 {
+		now := s.clock.Now()
+		initAccess(entity, now)
+		if exist && old != entity {
+			entity.lfu = old.lfu
+		}
+	}
+	s.account(sh, key, entity)
+
+	sh.store.Set(key, entity)
+	if entity.ExpiredAt.IsZero() {
+		sh.expires.remove(key)
+	} else {
+		sh.expires.add(key)
+	}
+	if exist && old != entity {
+		s.signalDeletedKeyAsReady(db, key)
+	}
+}
+
+// setExpire 修改已存在实体的过期时间 零值表示移除过期时间
+// 外部必须持有写锁
+func (s *KVStore) setExpire(db *database, key string, entity *Entity, when time.Time) {
+	entity.ExpiredAt = when
+	sh := db.shard(key)
+	if when.IsZero() {
+		sh.expires.remove(key)
+	} else {
+		sh.expires.add(key)
+	}
+}
+
+// dbDelete 从键空间以及过期索引中移除 key
+// 外部必须持有写锁
+func (s *KVStore) dbDelete(db *database, key string) {
+	sh := db.shard(key)
+	if old, ok := sh.store.Get(key); ok {
+		s.unaccount(sh, old)
+	}
+	sh.store.Delete(key)
+	sh.expires.remove(key)
+	s.signalDeletedKeyAsReady(db, key)
+}
+
+// expireKey 删除已经过期的 key
+// 外部必须持有写锁
+func (s *KVStore) expireKey(db *database, key string) {
+	s.dbDelete(db, key)
+	s.stats.expiredKeys.Add(1)
+	s.dirty.Add(1)
 }
 
 // rawGet 外部必须持有写锁
-func (s *KVStore) rawGet(key string) (*Entity, bool) {
-	entity, ok := s.store[key]
+// 所有按 key 的查找都应经过这里 以保证惰性过期生效 同时记录一次访问
+func (s *KVStore) rawGet(db *database, key string) (*Entity, bool) {
+	entity, ok := db.shard(key).store.Get(key)
 
 	if !ok {
 		return nil, false
 	}
 
-	isExpired := !entity.ExpiredAt.IsZero() && !entity.ExpiredAt.After(time.Now())
-	if isExpired {
-		delete(s.store, key)
+	now := s.clock.Now()
+	if entity.isExpired(now) {
+		s.expireKey(db, key)
 		return nil, false
 	}
 
+	s.touch(entity, now)
 	return entity, true
 }
 
-func (s *KVStore) Set(key string, entity *Entity) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	s.rawSet(key, entity)
+// rawLookup 外部持有读锁即可
+// 供只读命令使用 已过期的 key 同样视为不存在 但持有读锁时不能删除 留给主动过期或之后的写命令处理
+// 返回的实体不能被修改
+func (s *KVStore) rawLookup(db *database, key string) (*Entity, bool) {
+	entity, ok := s.rawPeek(db, key)
+	if ok {
+		s.touch(entity, s.clock.Now())
+	}
+	return entity, ok
 }
 
-// get 获取数据同时内部处理过期逻辑
-// 1.没过期则返回存在
-// 2.过期则返回不存在且删除
-func (s *KVStore) Get(key string) (*Entity, bool) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	return s.rawGet(key)
+// rawPeek 外部持有读锁即可
+// 与 rawLookup 相同 但不记录访问 供 TYPE、OBJECT 等不应影响淘汰顺序的命令使用
+func (s *KVStore) rawPeek(db *database, key string) (*Entity, bool) {
+	entity, ok := db.shard(key).store.Get(key)
+	if !ok || entity.isExpired(s.clock.Now()) {
+		return nil, false
+	}
+	return entity, true
 }
 
-func (s *KVStore) handleActiveDelete() {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+// rawDelete 外部必须持有写锁
+// 所有按 key 的删除都应经过这里 已过期的 key 视为不存在
+func (s *KVStore) rawDelete(db *database, key string) bool {
+	_, ok := s.rawRemove(db, key)
+	return ok
+}
 
-	hz := 10
-	for range ticker.C {
-		count := 0
-		s.mutex.Lock()
-		now := time.Now()
-		for k, entity := range s.store {
-			if count >= hz {
-				break
-			}
-
-			if !entity.ExpiredAt.IsZero() && !entity.ExpiredAt.After(now) {
-				delete(s.store, k)
-			}
-			count++
-		}
-		s.mutex.Unlock()
+// rawRemove 外部必须持有写锁
+// 与 rawDelete 相同 但会返回被删除的实体 供 UNLINK 等需要继续处理旧值的命令使用
+func (s *KVStore) rawRemove(db *database, key string) (*Entity, bool) {
+	entity, ok := s.rawGet(db, key)
+	if !ok {
+		return nil, false
 	}
+	s.dbDelete(db, key)
+	return entity, true
 }
 
-func (s *KVStore) HandleSET(args []*protocol.Value) (*protocol.Value, error) {
-	// 允许 SET key value [EX seconds | PX milliseconds]
+func (s *KVStore) HandleSET(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	// 允许 SET key value [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds]
 	if len(args) != 2 && len(args) != 4 {
 		return nil, errors.New(emsgArgsNumber("set"))
 	}
@@ -127,7 +354,7 @@ func (s *KVStore) HandleSET(args []*protocol.Value) (*protocol.Value, error) {
 
 	var expAt time.Time
 	if len(args) == 4 {
-		opt := args[2].Bulk()
+		opt := strings.ToUpper(args[2].Bulk())
 		numStr := args[3].Bulk()
 		num, err := strconv.ParseInt(numStr, 10, 64)
 		if err != nil || num < 0 {
@@ -137,31 +364,48 @@ func (s *KVStore) HandleSET(args []*protocol.Value) (*protocol.Value, error) {
 		switch opt {
 		case "EX":
 			// 秒
-			expAt = time.Now().Add(time.Duration(num) * time.Second)
+			expAt = s.clock.Now().Add(time.Duration(num) * time.Second)
 		case "PX":
 			// 毫秒
-			expAt = time.Now().Add(time.Duration(num) * time.Millisecond)
+			expAt = s.clock.Now().Add(time.Duration(num) * time.Millisecond)
+		case "EXAT":
+			expAt = time.Unix(num, 0)
+		case "PXAT":
+			expAt = time.UnixMilli(num)
+		default:
+			return nil, errors.New("ERR syntax error")
 		}
 	}
 
-	s.Set(key, &Entity{
+	defer s.lockKeys(c.db, key).unlock()
+
+	s.rawSet(c.db, key, &Entity{
 		Type:      TypeString,
 		ExpiredAt: expAt,
 		Data:      value,
 	})
+	s.dirty.Add(1)
+
+	// 相对过期时间在重放时会产生偏差 统一改写为绝对时间
+	if expAt.IsZero() {
+		s.propagate(c.db, "SET", key, value)
+	} else {
+		s.propagate(c.db, "SET", key, value, "PXAT", strconv.FormatInt(expAt.UnixMilli(), 10))
+	}
 
 	return new(protocol.Value).SetStr("OK"), nil
 }
 
-func (s *KVStore) HandleGET(args []*protocol.Value) (*protocol.Value, error) {
+func (s *KVStore) HandleGET(c *Client, args []*protocol.Value) (*protocol.Value, error) {
 	if len(args) != 1 {
 		return nil, errors.New(emsgArgsNumber("get"))
 	}
 
 	key := args[0].Bulk()
 
-	entity, exist := s.Get(key)
+	defer s.rlockKeys(c.db, key).unlock()
 
+	entity, exist := s.rawLookup(c.db, key)
 	if !exist {
 		return new(protocol.Value).SetNullBulk(), nil
 	}
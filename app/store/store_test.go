@@ -0,0 +1,41 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/config"
+)
+
+// executionModes 两种执行方式下阻塞命令的实现不同 相关测试需要各跑一遍
+var executionModes = []string{"locked", "eventloop"}
+
+// newTestStore 创建指定执行方式的存储 测试结束时关闭
+func newTestStore(t testing.TB, mode string, opts Options) *KVStore {
+	t.Helper()
+	if opts.Config == nil {
+		opts.Config = config.Default()
+	}
+	opts.Config.ExecutionMode = mode
+	s := NewKVStore(opts)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// waitBlocked 等待客户端进入阻塞状态 此时它已经注册到了等待队列中
+func waitBlocked(t testing.TB, c *Client) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.s.clientsMu.Lock()
+		blocked := c.blocked != nil
+		c.s.clientsMu.Unlock()
+		if blocked {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the client to block")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -3,9 +3,11 @@ package store
 import (
 	"fmt"
 	"math"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/protocol"
@@ -23,6 +25,57 @@ type Stream struct {
 	entities      []StreamEntity
 	lastTimestamp int64
 	lastSeq       int64
+	// bytes 所有条目字段的字节数之和 用于估算内存占用
+	bytes int64
+	// entriesAdded 曾经加入 stream 的条目总数 包括之后被裁剪的
+	entriesAdded int64
+	// maxDeletedID 被删除的条目中最大的 ID 没有删除过时为 0-0
+	maxDeletedID streamID
+	// groups 消费者组 按名称索引 没有组时为 nil
+	groups map[string]*consumerGroup
+}
+
+// append 追加条目并累计字段的字节数
+func (st *Stream) append(entities ...StreamEntity) {
+	for _, e := range entities {
+		for _, f := range e.Fields {
+			st.bytes += int64(len(f))
+		}
+	}
+	st.entities = append(st.entities, entities...)
+}
+
+// removeFirst 删除最前面的 n 个条目 记录被删除的最大 ID
+func (st *Stream) removeFirst(n int) {
+	if n <= 0 {
+		return
+	}
+	for _, e := range st.entities[:n] {
+		for _, f := range e.Fields {
+			st.bytes -= int64(len(f))
+		}
+	}
+	last := st.entities[n-1]
+	if id := (streamID{timestamp: last.timestamp, seq: last.seq}); id.compare(st.maxDeletedID) > 0 {
+		st.maxDeletedID = id
+	}
+	// 直接截取 之后 append 重新分配时只会复制剩余的条目
+	clear(st.entities[:n])
+	st.entities = st.entities[n:]
+}
+
+// clone 复制 stream 用于生成快照
+// 条目本身在写入后不会被修改 只需复制切片 消费者组需要深度复制
+func (st *Stream) clone() *Stream {
+	c := *st
+	c.entities = append([]StreamEntity(nil), st.entities...)
+	if st.groups != nil {
+		c.groups = make(map[string]*consumerGroup, len(st.groups))
+		for name, g := range st.groups {
+			c.groups[name] = g.clone()
+		}
+	}
+	return &c
 }
 
 type streamHelper struct {
@@ -58,15 +111,19 @@ func (h *streamHelper) validateAndUpdateID(stream *Stream, timestamp, seq int64)
 	return nil
 }
 
-func (h *streamHelper) parseIDOrAutoGen(stream *Stream, id string) (int64, int64, error) {
-	// 完全自动生成 暂不实现
+// parseIDOrAutoGen now 为自动生成 ID 时使用的当前时间
+func (h *streamHelper) parseIDOrAutoGen(stream *Stream, id string, now time.Time) (int64, int64, error) {
+	// 完全自动生成
+	// 与 redis 一致 当前时间不大于最后一个 ID 的时间戳时(同一毫秒或时钟回拨) 沿用该时间戳并递增序列号
 	if id == "*" {
-		timestamp := time.Now().UnixMilli()
-		seq := int64(0)
-		if timestamp == stream.lastTimestamp {
-			seq = stream.lastSeq + 1
+		timestamp := now.UnixMilli()
+		if timestamp > stream.lastTimestamp {
+			return timestamp, 0, nil
 		}
-		return timestamp, seq, nil
+		if stream.lastSeq == math.MaxInt64 {
+			return stream.lastTimestamp + 1, 0, nil
+		}
+		return stream.lastTimestamp, stream.lastSeq + 1, nil
 	}
 
 	strs := strings.Split(id, "-")
@@ -106,6 +163,7 @@ func (h *streamHelper) parseIDOrAutoGen(stream *Stream, id string) (int64, int64
 }
 
 // HandleXADD
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] <*|id> field value [field value ...]
 // 必须参数:
 // 1.key
 // 2.id
@@ -114,24 +172,37 @@ func (h *streamHelper) parseIDOrAutoGen(stream *Stream, id string) (int64, int64
 // -XADD stream_key 1526919030474-0 temperature 36 humidity 95
 // -XADD stream_key 1526919030474-* temperature 36 humidity 95
 // -XADD stream_key * temperature 36 humidity 95
+// -XADD stream_key MAXLEN ~ 1000 * temperature 36
+// 写入之后按 MAXLEN/MINID 裁剪 见 HandleXTRIM
 //
 // 返回值:
 // bulk string 添加条目的ID
 // nil reply (bulk string) 如果提供 NOMKSTREAM 选项且键不存在
-func (s *KVStore) HandleXADD(args []*protocol.Value) (*protocol.Value, error) {
-	// 参数不少于四并且参数数量必须为偶数
-	if len(args) < 4 || len(args)%2 != 0 {
+func (s *KVStore) HandleXADD(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 4 {
 		return nil, errors.New(emsgArgsNumber("xadd"))
 	}
 
 	key := args[0].Bulk()
+	trim, idAt, err := parseStreamTrimArgs(args[1:], true)
+	if err != nil {
+		return nil, err
+	}
+	idAt++
+	// ID 之后至少一个键值对 并且必须成对出现
+	if idAt >= len(args) || len(args[idAt+1:]) < 2 || len(args[idAt+1:])%2 != 0 {
+		return nil, errors.New(emsgArgsNumber("xadd"))
+	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.lockKeys(c.db, key).unlock()
 
-	entity, ok := s.store[key]
+	entity, ok := s.rawGet(c.db, key)
 	var stream *Stream
+	var expAt time.Time
 	if !ok {
+		if trim.nomkstream {
+			return new(protocol.Value).SetNullBulk(), nil
+		}
 		stream = &Stream{
 			entities: make([]StreamEntity, 0, 1), // 直接为新的entity分配空间
 		}
@@ -140,11 +211,12 @@ func (s *KVStore) HandleXADD(args []*protocol.Value) (*protocol.Value, error) {
 			return nil, errors.New(emsgKeyType())
 		}
 		stream = entity.Data.(*Stream)
+		expAt = entity.ExpiredAt
 	}
 
-	id := args[1].Bulk()
+	id := args[idAt].Bulk()
 	helper := new(streamHelper)
-	timestamp, seq, err := helper.parseIDOrAutoGen(stream, id)
+	timestamp, seq, err := helper.parseIDOrAutoGen(stream, id, s.clock.Now())
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -158,24 +230,214 @@ func (s *KVStore) HandleXADD(args []*protocol.Value) (*protocol.Value, error) {
 	streamEntity := StreamEntity{
 		timestamp: timestamp,
 		seq:       seq,
-		Fields:    make([]string, 0, len(args)/2-1),
+		Fields:    make([]string, 0, len(args)-idAt-1),
 	}
 
-	for _, v := range args[2:] {
+	for _, v := range args[idAt+1:] {
 		streamEntity.Fields = append(streamEntity.Fields, v.Bulk())
 	}
-	stream.entities = append(stream.entities, streamEntity)
+	stream.append(streamEntity)
+	stream.entriesAdded++
+	trimmed := stream.trim(trim)
+	s.dirty.Add(1)
+
+	// 自动生成的 ID 在重放时会不同 记录实际的 ID
+	propagateArgs := make([]string, 0, len(args)+1)
+	propagateArgs = append(propagateArgs, "XADD", key, actualID)
+	propagateArgs = append(propagateArgs, streamEntity.Fields...)
+	s.propagate(c.db, propagateArgs...)
+	if trimmed > 0 {
+		s.propagateTrim(c.db, key, stream)
+	}
 
-	s.rawSet(key, &Entity{
-		Type: TypeStream,
-		// wait todo
-		// ExpiredAt: ,
-		Data: stream,
+	s.rawSet(c.db, key, &Entity{
+		Type:      TypeStream,
+		ExpiredAt: expAt,
+		Data:      stream,
 	})
+	s.signalKeyAsReady(c.db, key)
 
 	return new(protocol.Value).SetBulk(actualID), nil
 }
 
+// streamTrimArgs XADD 与 XTRIM 共用的裁剪选项
+type streamTrimArgs struct {
+	// strategy 为空表示不裁剪
+	strategy string
+	maxLen   int
+	minID    streamID
+	// approx ~ 近似裁剪 只删除完整的节点
+	approx bool
+	// limit 近似裁剪最多删除的条目数量 0 表示不限制
+	limit int
+	// nomkstream 只用于 XADD key 不存在时不创建
+	nomkstream bool
+}
+
+// parseStreamTrimArgs 从 args 开头解析裁剪选项
+// xadd 时遇到第一个不是选项的参数停止 返回它的位置(即 ID 的位置) 否则所有参数都必须是选项
+// 与 redis 一致 近似裁剪没有指定 LIMIT 时最多删除 100 个节点的条目 精确裁剪不能指定 LIMIT
+func parseStreamTrimArgs(args []*protocol.Value, xadd bool) (*streamTrimArgs, int, error) {
+	opts := &streamTrimArgs{}
+	limitGiven := false
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk())
+		moreArgs := len(args) - 1 - i
+		switch {
+		case xadd && opt == "*":
+			// 自动生成 ID 的快速路径
+		case (opt == "MAXLEN" || opt == "MINID") && moreArgs > 0:
+			if opts.strategy != "" {
+				return nil, 0, errors.New("ERR syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			if next := args[i+1].Bulk(); moreArgs >= 2 && (next == "~" || next == "=") {
+				opts.approx = next == "~"
+				i++
+			}
+			threshold := args[i+1].Bulk()
+			i++
+			opts.strategy = opt
+			if opt == "MAXLEN" {
+				n, err := strconv.Atoi(threshold)
+				if err != nil {
+					return nil, 0, errors.New("ERR value is not an integer or out of range")
+				}
+				if n < 0 {
+					return nil, 0, errors.New("ERR The MAXLEN argument must be >= 0.")
+				}
+				opts.maxLen = n
+			} else {
+				id, err := parseStrictID(threshold)
+				if err != nil {
+					return nil, 0, err
+				}
+				opts.minID = id
+			}
+			continue
+		case opt == "LIMIT" && moreArgs > 0:
+			n, err := strconv.Atoi(args[i+1].Bulk())
+			if err != nil {
+				return nil, 0, errors.New("ERR value is not an integer or out of range")
+			}
+			if n < 0 {
+				return nil, 0, errors.New("ERR The LIMIT argument must be >= 0.")
+			}
+			opts.limit = n
+			limitGiven = true
+			i++
+			continue
+		case xadd && opt == "NOMKSTREAM":
+			opts.nomkstream = true
+			continue
+		case xadd:
+			// 不是选项 应当是 ID
+		default:
+			return nil, 0, errors.New("ERR syntax error")
+		}
+		break
+	}
+
+	if limitGiven && opts.strategy == "" {
+		return nil, 0, errors.New("ERR syntax error, LIMIT cannot be used without specifying a trimming strategy")
+	}
+	if !xadd && opts.strategy == "" {
+		return nil, 0, errors.New("ERR syntax error, XTRIM must be called with a trimming strategy")
+	}
+	if limitGiven && !opts.approx {
+		return nil, 0, errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	if !limitGiven && opts.approx {
+		opts.limit = 100 * streamNodeMaxEntries
+	}
+	return opts, i, nil
+}
+
+// trim 按 opts 从头部删除条目 返回删除的数量
+// 精确裁剪删除所有超出的条目
+// 近似裁剪只删除完整的节点 节点与 redis 的 listpack 节点对应 按条目加入的顺序每 streamNodeMaxEntries 个一组
+// 因此节点的边界不会因为裁剪而改变 裁剪之后剩余的条目可能多于 MAXLEN 或者包含小于 MINID 的条目
+func (st *Stream) trim(opts *streamTrimArgs) int {
+	if opts.strategy == "" {
+		return 0
+	}
+	// removable 删除前 n 个条目是否满足裁剪条件
+	removable := func(n int) bool {
+		if opts.strategy == "MAXLEN" {
+			return len(st.entities)-n >= opts.maxLen
+		}
+		last := st.entities[n-1]
+		return streamID{timestamp: last.timestamp, seq: last.seq}.compare(opts.minID) < 0
+	}
+
+	n := 0
+	if !opts.approx {
+		if opts.strategy == "MAXLEN" {
+			n = max(len(st.entities)-opts.maxLen, 0)
+		} else {
+			n = new(streamHelper).findStartIndex(st.entities, opts.minID.timestamp, opts.minID.seq, false)
+		}
+	} else {
+		// base 第一个条目是第几个加入的 从 0 开始
+		base := max(int(st.entriesAdded)-len(st.entities), 0)
+		for n < len(st.entities) {
+			// 下一个节点的第一个条目
+			next := ((base+n)/streamNodeMaxEntries+1)*streamNodeMaxEntries - base
+			next = min(next, len(st.entities))
+			if opts.limit > 0 && next > opts.limit {
+				break
+			}
+			if !removable(next) {
+				break
+			}
+			n = next
+		}
+	}
+
+	st.removeFirst(n)
+	return n
+}
+
+// propagateTrim 把裁剪写入 AOF
+// 近似裁剪与 LIMIT 的结果取决于节点的边界 统一改写为精确裁剪到当前长度 与 redis 相同
+func (s *KVStore) propagateTrim(db *database, key string, stream *Stream) {
+	s.propagate(db, "XTRIM", key, "MAXLEN", "=", strconv.Itoa(len(stream.entities)))
+}
+
+// HandleXTRIM
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+// MAXLEN 只保留最新的 threshold 个条目 MINID 删除 ID 小于 threshold 的条目
+// ~ 表示近似裁剪 只删除完整的节点 LIMIT 限制最多删除的条目数量
+// 返回删除的条目数量 key 不存在时返回 0
+func (s *KVStore) HandleXTRIM(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 3 {
+		return nil, errors.New(emsgArgsNumber("xtrim"))
+	}
+	key := args[0].Bulk()
+	opts, _, err := parseStreamTrimArgs(args[1:], false)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, stream, err := s.lookupStream(c.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+
+	n := stream.trim(opts)
+	if n > 0 {
+		s.updateSize(c.db, key, entity)
+		s.dirty.Add(1)
+		s.propagateTrim(c.db, key, stream)
+	}
+	return new(protocol.Value).SetInteger(n), nil
+}
+
 // parseID 由于解析xrange的id
 // 序列号是可选的 如果不提供
 // 对于start ID 序列号默认为 0
@@ -281,17 +543,16 @@ func (h *streamHelper) findStartIndex(entities []StreamEntity, startTimestamp, s
 // 策略
 // 依旧使用切片 暂不使用基数树
 // 使用sort.Search查询到start然后直到end结束
-func (s *KVStore) HandleXRANGE(args []*protocol.Value) (*protocol.Value, error) {
+func (s *KVStore) HandleXRANGE(c *Client, args []*protocol.Value) (*protocol.Value, error) {
 	if len(args) != 3 {
 		return nil, errors.New(emsgArgsNumber("xrange"))
 	}
 
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
 	key := args[0].Bulk()
 
-	entity, ok := s.store[key]
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawLookup(c.db, key)
 	if !ok {
 		return new(protocol.Value).SetEmptyArray(), nil
 	}
@@ -330,100 +591,1521 @@ func (s *KVStore) HandleXRANGE(args []*protocol.Value) (*protocol.Value, error)
 			break
 		}
 
-		entityArr := new(protocol.Value).SetEmptyArray()
-		id := new(protocol.Value).SetBulk(fmt.Sprintf("%d-%d", v.timestamp, v.seq))
-		fileds := make([]*protocol.Value, 0, len(v.Fields))
-		for _, filed := range v.Fields {
-			fileds = append(fileds, new(protocol.Value).SetBulk(filed))
-		}
-		fieldsArray := new(protocol.Value).SetArray(fileds)
-		entityArr.Append(id, fieldsArray)
-		result.Append(entityArr)
+		result.Append(streamEntryValue(v))
 	}
 
 	return result, nil
 }
 
+// streamID stream 条目的 ID
+type streamID struct {
+	timestamp int64
+	seq       int64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.timestamp, id.seq)
+}
+
+// lastID stream 中曾经出现过的最大 ID 空 stream 为 0-0
+func (st *Stream) lastID() streamID {
+	return streamID{timestamp: st.lastTimestamp, seq: st.lastSeq}
+}
+
+// entriesAfter 返回 ID 大于 id 的条目 count 大于 0 时最多返回 count 个
+// 返回的切片是复制出来的 之后修改 stream 不会影响它
+func (st *Stream) entriesAfter(id streamID, count int) []StreamEntity {
+	helper := new(streamHelper)
+	entries := st.entities[helper.findStartIndex(st.entities, id.timestamp, id.seq, true):]
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return slices.Clone(entries)
+}
+
+// streamEntryValue 单个条目的回复 [id, [field1, value1, ...]]
+// Fields 为 nil 表示条目已经被删除(XREADGROUP 读取历史时) 回复 [id, nil]
+func streamEntryValue(e StreamEntity) *protocol.Value {
+	if e.Fields == nil {
+		return new(protocol.Value).SetArray([]*protocol.Value{
+			new(protocol.Value).SetBulk(fmt.Sprintf("%d-%d", e.timestamp, e.seq)),
+			new(protocol.Value).SetNullArray(),
+		})
+	}
+	fields := make([]*protocol.Value, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		fields = append(fields, new(protocol.Value).SetBulk(f))
+	}
+	return new(protocol.Value).SetArray([]*protocol.Value{
+		new(protocol.Value).SetBulk(fmt.Sprintf("%d-%d", e.timestamp, e.seq)),
+		new(protocol.Value).SetArray(fields),
+	})
+}
+
+// StreamPayload 交给阻塞的 XREAD 的数据 entries 为 key 中 ID 大于等待起点的条目
+// 阻塞的 XREADGROUP 等待的消费者组被删除时 err 不为 nil
+type StreamPayload struct {
+	key     string
+	entries []StreamEntity
+	err     error
+}
+
+// streamReply XREAD 中一个 key 的回复 [key, [[id, fields], ...]]
+func streamReply(res StreamPayload) *protocol.Value {
+	entries := make([]*protocol.Value, 0, len(res.entries))
+	for _, e := range res.entries {
+		entries = append(entries, streamEntryValue(e))
+	}
+	return new(protocol.Value).SetArray([]*protocol.Value{
+		new(protocol.Value).SetBulk(res.key),
+		new(protocol.Value).SetArray(entries),
+	})
+}
+
+// streamWaiter 阻塞的 XREAD 阻塞在多个 key 上时每个 key 的等待队列中都是同一个 streamWaiter
+// 与 listWaiter 不同 读取不会消费条目 同一个 key 上的所有等待者都可以被服务
+// 阻塞的 XREADGROUP 例外 同一个组的等待者竞争 按 FIFO 顺序分配组内的新条目
+type streamWaiter struct {
+	// ch 容量为 1 被服务时恰好写入一次
+	ch chan StreamPayload
+	// done 与 listWaiter.done 相同 保证客户端只被服务一次
+	done atomic.Bool
+	// ids 每个 key 只返回 ID 大于它的条目
+	ids map[string]streamID
+	// count 最多返回的条目数量 0 表示不限制
+	count int
+	// group 不为空时是阻塞的 XREADGROUP 读取组内的新条目 此时不使用 ids
+	group    string
+	consumer string
+	noack    bool
+}
+
+// serveStreamWaiters 服务阻塞在 key 上 并且有了新条目的 XREAD 与 XREADGROUP
+// 没有新条目的等待者(例如写入的是更早的 ID 之后又被删除)继续等待
+// key 被删除或者被其他类型覆盖时 与 redis 一致 XREADGROUP 返回错误 XREAD 继续等待
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) serveStreamWaiters(db *database, key string) {
+	sh := db.shard(key)
+	waiters := sh.streamWaiters[key]
+	if len(waiters) == 0 {
+		return
+	}
+	var stream *Stream
+	var lost error
+	entity, ok := s.rawLookup(db, key)
+	switch {
+	case !ok:
+		lost = errors.New("UNBLOCKED the stream key no longer exists")
+	case entity.Type != TypeStream:
+		lost = errors.New(emsgKeyType())
+	default:
+		stream = entity.Data.(*Stream)
+	}
+
+	remain := waiters[:0]
+	for _, waiter := range waiters {
+		if waiter.done.Load() {
+			continue
+		}
+		if stream == nil {
+			if waiter.group == "" {
+				remain = append(remain, waiter)
+			} else if waiter.done.CompareAndSwap(false, true) {
+				waiter.ch <- StreamPayload{key: key, err: lost}
+			}
+			continue
+		}
+		if waiter.group != "" {
+			if !s.serveGroupWaiter(db, key, entity, waiter) {
+				remain = append(remain, waiter)
+			}
+			continue
+		}
+		entries := stream.entriesAfter(waiter.ids[key], waiter.count)
+		if len(entries) == 0 {
+			remain = append(remain, waiter)
+			continue
+		}
+		if waiter.done.CompareAndSwap(false, true) {
+			waiter.ch <- StreamPayload{key: key, entries: entries}
+		}
+	}
+	clear(waiters[len(remain):])
+	if len(remain) == 0 {
+		delete(sh.streamWaiters, key)
+	} else {
+		sh.streamWaiters[key] = remain
+	}
+}
+
+// xreadArgs XREAD 与 XREADGROUP 共用的参数
+type xreadArgs struct {
+	// count 每个 key 最多返回的条目数量 0 表示不限制
+	count   int
+	block   bool
+	timeout time.Duration
+	// group consumer noack 只用于 XREADGROUP
+	group, consumer string
+	noack           bool
+	keys            []string
+	ids             []string
+}
+
+// parseXReadArgs 解析 XREAD 与 XREADGROUP 的参数 group 为 true 时是 XREADGROUP
+// ID 依赖 stream 当前的状态 由调用方加锁之后再解析
+func parseXReadArgs(args []*protocol.Value, group bool) (*xreadArgs, error) {
+	cmd, special := "xread", "$"
+	if group {
+		cmd, special = "xreadgroup", ">"
+	}
+
+	opts := &xreadArgs{}
+	streamsAt := -1
+	for i := 0; i < len(args) && streamsAt < 0; i++ {
+		switch strings.ToUpper(args[i].Bulk()) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			n, err := args[i+1].BulkToInteger()
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			// 与 redis 一致 0 和负数都表示不限制
+			opts.count = max(n, 0)
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			ms, err := args[i+1].BulkToInteger()
+			if err != nil {
+				return nil, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return nil, errors.New("ERR timeout is negative")
+			}
+			opts.block = true
+			opts.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case "GROUP":
+			if !group {
+				return nil, errors.New("ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+			}
+			if i+2 >= len(args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			opts.group, opts.consumer = args[i+1].Bulk(), args[i+2].Bulk()
+			i += 2
+		case "NOACK":
+			if !group {
+				return nil, errors.New("ERR syntax error")
+			}
+			opts.noack = true
+		case "STREAMS":
+			streamsAt = i
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+	if streamsAt < 0 {
+		return nil, errors.Errorf("ERR %s requires the STREAMS option", strings.ToUpper(cmd))
+	}
+	rest := args[streamsAt+1:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return nil, errors.Errorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '%s' must be specified.", cmd, special)
+	}
+	if group && opts.group == "" {
+		return nil, errors.New("ERR Missing GROUP option for XREADGROUP")
+	}
+
+	n := len(rest) / 2
+	opts.keys = bulkStrings(rest[:n])
+	opts.ids = bulkStrings(rest[n:])
+	return opts, nil
+}
+
 // HandleXREAD
 // XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
 // XREAD是排他的 意味着要从大于id的条目开始
-func (s *KVStore) HandleXREAD(args []*protocol.Value) (*protocol.Value, error) {
-	if len(args) != 3 {
-		return nil, errors.New(emsgArgsNumber("xread"))
+// id 为 $ 时只读取之后新增的条目 为 + 时读取最后一个条目
+// 所有 key 都没有新条目时返回 nil 指定 BLOCK 时阻塞等待 XADD 写入任意一个 key 0 表示一直等待
+// 被唤醒时只返回写入的那一个 key
+func (s *KVStore) HandleXREAD(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	opts, err := parseXReadArgs(args, false)
+	if err != nil {
+		return nil, err
 	}
+	count, block, timeout, keys := opts.count, opts.block, opts.timeout, opts.keys
+	n := len(keys)
 
-	if args[0].Bulk() != "STREAMS" {
-		return nil, errors.New("ERR XREAD requires the STREAMS option")
+	// $ 与 + 依赖 stream 当前的状态 加锁之后再解析
+	rawIDs := opts.ids
+	parsed := make([]streamID, n)
+	helper := new(streamHelper)
+	for i, raw := range rawIDs {
+		if raw == "$" || raw == "+" {
+			continue
+		}
+		timestamp, seq, err := helper.parseID(raw, true)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = streamID{timestamp: timestamp, seq: seq}
 	}
 
-	keys := make([]string, 0, 1)
-	// 当前只处理一个key
-	keys = append(keys, args[1].Bulk())
-	startID := args[2].Bulk()
+	// 阻塞时需要在分片中注册等待者 必须持有写锁
+	var lk shardLock
+	if block {
+		lk = s.lockKeys(c.db, keys...)
+	} else {
+		lk = s.rlockKeys(c.db, keys...)
+	}
 
-	result := new(protocol.Value).SetEmptyArray()
+	ids := make(map[string]streamID, n)
+	results := make([]*protocol.Value, 0, n)
+	for i, key := range keys {
+		entity, ok := s.rawLookup(c.db, key)
+		if ok && entity.Type != TypeStream {
+			lk.unlock()
+			return nil, errors.New(emsgKeyType())
+		}
+		var stream *Stream
+		if ok {
+			stream = entity.Data.(*Stream)
+		}
+
+		id := parsed[i]
+		switch rawIDs[i] {
+		case "$":
+			// 只读取之后新增的条目
+			if stream != nil {
+				id = stream.lastID()
+			}
+		case "+":
+			// 最后一个条目 即 ID 大于最后一个 ID 减一的条目
+			if stream != nil && len(stream.entities) > 0 {
+				last := stream.entities[len(stream.entities)-1]
+				id = streamID{timestamp: last.timestamp, seq: last.seq - 1}
+				if last.seq == 0 {
+					id = streamID{timestamp: last.timestamp - 1, seq: math.MaxInt64}
+				}
+			}
+		}
+		// 同一个 key 出现多次时以第一次为准
+		if _, dup := ids[key]; !dup {
+			ids[key] = id
+		}
+
+		if stream == nil {
+			continue
+		}
+		if entries := stream.entriesAfter(id, count); len(entries) > 0 {
+			results = append(results, streamReply(StreamPayload{key: key, entries: entries}))
+		}
+	}
+
+	if len(results) > 0 || !block {
+		lk.unlock()
+		if len(results) == 0 {
+			return new(protocol.Value).SetNullArray(), nil
+		}
+		return new(protocol.Value).SetArray(results), nil
+	}
+
+	// 阻塞等待 XADD
+	db := c.db
+	waiter := &streamWaiter{ch: make(chan StreamPayload, 1), ids: ids, count: count}
+	for key := range ids {
+		sh := db.shard(key)
+		sh.streamWaiters[key] = append(sh.streamWaiters[key], waiter)
+	}
+	bs := s.blockClient(c, keys)
+	lk.unlock()
+
+	cleanup := func() {
+		defer s.lockKeys(db, keys...).unlock()
+		for key := range ids {
+			sh := db.shard(key)
+			waiters := slices.DeleteFunc(sh.streamWaiters[key], func(w *streamWaiter) bool {
+				return w == waiter
+			})
+			if len(waiters) == 0 {
+				delete(sh.streamWaiters, key)
+			} else {
+				sh.streamWaiters[key] = waiters
+			}
+		}
+	}
+
+	return awaitBlocked(s, c, bs, blockedWait[StreamPayload]{
+		ch:      waiter.ch,
+		done:    &waiter.done,
+		timeout: timeout,
+		cleanup: cleanup,
+		reply: func(res StreamPayload) *protocol.Value {
+			return new(protocol.Value).SetArray([]*protocol.Value{streamReply(res)})
+		},
+	})
+}
+
+// ---------------------------------------------------------
+// 消费者组
+// 与 redis 的 streamCG 对应 每个组记录最后投递的 ID 以及已投递但还没有确认的条目(PEL)
+// 组内的消费者竞争读取 同一个条目只会投递给一个消费者 XACK 之前一直留在 PEL 中
+// ---------------------------------------------------------
+
+// consumerGroup 消费者组
+type consumerGroup struct {
+	// lastID 最后投递给组内消费者的 ID XREADGROUP > 只返回大于它的条目
+	lastID streamID
+	// entriesRead 组已经读取的条目数量 -1 表示未知
+	entriesRead int64
+	// pel 组内所有消费者的待确认条目
+	pel *pendingList
+	// consumers 组内的消费者 按名称索引
+	consumers map[string]*streamConsumer
+}
+
+// streamConsumer 组内的消费者
+type streamConsumer struct {
+	name string
+	// seenTime 最后一次读取或认领的时间
+	seenTime time.Time
+	// pel 投递给该消费者且还没有确认的条目 与组的 pel 共享 streamNACK
+	pel *pendingList
+}
+
+// streamNACK PEL 中的一个待确认条目
+type streamNACK struct {
+	// deliveryTime 最后一次投递的时间 用于计算空闲时间
+	deliveryTime time.Time
+	// deliveryCount 投递的次数
+	deliveryCount int64
+	// consumer 当前拥有该条目的消费者
+	consumer *streamConsumer
+}
+
+// pendingList 按 ID 排序的待确认条目 与 redis 中以 ID 为 key 的 rax 对应
+// 新投递的条目 ID 总是更大 插入绝大多数发生在末尾
+type pendingList struct {
+	ids   []streamID
+	nacks map[streamID]*streamNACK
+}
 
+func newPendingList() *pendingList {
+	return &pendingList{nacks: make(map[streamID]*streamNACK)}
+}
+
+func (p *pendingList) len() int {
+	return len(p.ids)
+}
+
+func (p *pendingList) get(id streamID) (*streamNACK, bool) {
+	nack, ok := p.nacks[id]
+	return nack, ok
+}
+
+// add 插入条目 已经存在时返回 false
+func (p *pendingList) add(id streamID, nack *streamNACK) bool {
+	if _, ok := p.nacks[id]; ok {
+		return false
+	}
+	p.nacks[id] = nack
+	if n := len(p.ids); n == 0 || p.ids[n-1].compare(id) < 0 {
+		p.ids = append(p.ids, id)
+		return true
+	}
+	i := p.seek(id, false)
+	p.ids = slices.Insert(p.ids, i, id)
+	return true
+}
+
+// remove 删除条目 不存在时返回 false
+func (p *pendingList) remove(id streamID) bool {
+	if _, ok := p.nacks[id]; !ok {
+		return false
+	}
+	delete(p.nacks, id)
+	i := p.seek(id, false)
+	p.ids = slices.Delete(p.ids, i, i+1)
+	return true
+}
+
+// seek 第一个大于等于 id 的位置 exclusive 时为第一个大于 id 的位置
+func (p *pendingList) seek(id streamID, exclusive bool) int {
+	return sort.Search(len(p.ids), func(i int) bool {
+		if exclusive {
+			return p.ids[i].compare(id) > 0
+		}
+		return p.ids[i].compare(id) >= 0
+	})
+}
+
+// compare id < other 返回 -1 相等返回 0 否则返回 1
+func (id streamID) compare(other streamID) int {
+	return new(streamHelper).compareID(id.timestamp, id.seq, other.timestamp, other.seq)
+}
+
+// next 紧随其后的 ID 已经是最大 ID 时返回 false
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxInt64:
+		return streamID{timestamp: id.timestamp, seq: id.seq + 1}, true
+	case id.timestamp < math.MaxInt64:
+		return streamID{timestamp: id.timestamp + 1}, true
+	}
+	return id, false
+}
+
+// prev 紧邻的前一个 ID 已经是 0-0 时返回 false
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{timestamp: id.timestamp, seq: id.seq - 1}, true
+	case id.timestamp > 0:
+		return streamID{timestamp: id.timestamp - 1, seq: math.MaxInt64}, true
+	}
+	return id, false
+}
+
+func newConsumerGroup(lastID streamID, entriesRead int64) *consumerGroup {
+	return &consumerGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pel:         newPendingList(),
+		consumers:   make(map[string]*streamConsumer),
+	}
+}
+
+// clone 深度复制消费者组 用于生成快照
+func (g *consumerGroup) clone() *consumerGroup {
+	c := newConsumerGroup(g.lastID, g.entriesRead)
+	for name, consumer := range g.consumers {
+		c.consumers[name] = &streamConsumer{name: name, seenTime: consumer.seenTime, pel: newPendingList()}
+	}
+	c.pel.ids = slices.Clone(g.pel.ids)
+	for _, id := range g.pel.ids {
+		nack := *g.pel.nacks[id]
+		nack.consumer = c.consumers[nack.consumer.name]
+		c.pel.nacks[id] = &nack
+		nack.consumer.pel.ids = append(nack.consumer.pel.ids, id)
+		nack.consumer.pel.nacks[id] = &nack
+	}
+	return c
+}
+
+// lookupConsumer 返回名为 name 的消费者 create 时不存在则创建 created 表示是否新建
+func (g *consumerGroup) lookupConsumer(name string, create bool, now time.Time) (consumer *streamConsumer, created bool) {
+	if consumer, ok := g.consumers[name]; ok {
+		return consumer, false
+	}
+	if !create {
+		return nil, false
+	}
+	consumer = &streamConsumer{name: name, seenTime: now, pel: newPendingList()}
+	g.consumers[name] = consumer
+	return consumer, true
+}
+
+// deleteConsumer 删除消费者以及它的所有待确认条目 返回删除的待确认条目数量
+func (g *consumerGroup) deleteConsumer(consumer *streamConsumer) int {
+	n := consumer.pel.len()
+	for _, id := range consumer.pel.ids {
+		g.pel.remove(id)
+	}
+	delete(g.consumers, consumer.name)
+	return n
+}
+
+// deliver 把新条目投递给消费者 推进 last-delivered-id 与 entries-read
+// 没有 noack 时条目加入组与消费者的 PEL 条目已经在组的 PEL 中(XGROUP SETID 回退过)时转移给该消费者
+func (g *consumerGroup) deliver(st *Stream, consumer *streamConsumer, entries []StreamEntity, noack bool, now time.Time) {
+	for _, e := range entries {
+		id := streamID{timestamp: e.timestamp, seq: e.seq}
+		g.lastID = id
+		// 条目只会从头部删除 投递的条目之后不会有空洞 计数有效时直接递增
+		if g.entriesRead >= 0 {
+			g.entriesRead++
+		} else if st.entriesAdded > 0 {
+			g.entriesRead = st.entriesReadAt(id)
+		}
+	}
+	if noack {
+		return
+	}
+	for _, e := range entries {
+		id := streamID{timestamp: e.timestamp, seq: e.seq}
+		if nack, ok := g.pel.get(id); ok {
+			nack.consumer.pel.remove(id)
+			nack.consumer = consumer
+			nack.deliveryTime = now
+			nack.deliveryCount = 1
+			consumer.pel.add(id, nack)
+			continue
+		}
+		nack := &streamNACK{deliveryTime: now, deliveryCount: 1, consumer: consumer}
+		g.pel.add(id, nack)
+		consumer.pel.add(id, nack)
+	}
+}
+
+// claim 把待确认条目转移给 consumer 投递时间与次数由调用方更新
+func (g *consumerGroup) claim(id streamID, nack *streamNACK, consumer *streamConsumer) {
+	if nack.consumer == consumer {
+		return
+	}
+	if nack.consumer != nil {
+		nack.consumer.pel.remove(id)
+	}
+	nack.consumer = consumer
+	consumer.pel.add(id, nack)
+}
+
+// ack 确认条目 返回条目是否在 PEL 中
+// 条目已经从 stream 中删除时 XCLAIM 与 XAUTOCLAIM 同样通过它把条目移出 PEL
+func (g *consumerGroup) ack(id streamID) bool {
+	nack, ok := g.pel.get(id)
+	if !ok {
+		return false
+	}
+	g.pel.remove(id)
+	nack.consumer.pel.remove(id)
+	return true
+}
+
+// entriesReadAt 读到 id 为止(包含)曾经加入过的条目数量 无法确定时返回 -1
+// 与 redis 的 streamEstimateDistanceFromFirstEverEntry 对应
+func (st *Stream) entriesReadAt(id streamID) int64 {
+	if st.entriesAdded == 0 {
+		return 0
+	}
+	last := st.lastID()
+	if len(st.entities) == 0 && id.compare(last) <= 0 {
+		return st.entriesAdded
+	}
+	switch id.compare(last) {
+	case 0:
+		return st.entriesAdded
+	case 1:
+		return -1
+	}
+
+	// 被删除的条目都在第一个条目之前时 第一个条目之前的条目数量是确定的
+	first := streamID{timestamp: st.entities[0].timestamp, seq: st.entities[0].seq}
+	if st.maxDeletedID.compare(first) < 0 {
+		switch id.compare(first) {
+		case -1:
+			return st.entriesAdded - int64(len(st.entities))
+		case 0:
+			return st.entriesAdded - int64(len(st.entities)) + 1
+		}
+	}
+	return -1
+}
+
+// entry 按 ID 查找条目
+func (st *Stream) entry(id streamID) (StreamEntity, bool) {
+	helper := new(streamHelper)
+	i := helper.findStartIndex(st.entities, id.timestamp, id.seq, false)
+	if i < len(st.entities) && st.entities[i].timestamp == id.timestamp && st.entities[i].seq == id.seq {
+		return st.entities[i], true
+	}
+	return StreamEntity{}, false
+}
+
+// pendingHistory 消费者 PEL 中 ID 大于 after 的条目 count 大于 0 时最多返回 count 个
+// 返回的条目视为再次投递 更新投递时间与次数 已经被删除的条目 Fields 为 nil
+func (st *Stream) pendingHistory(consumer *streamConsumer, after streamID, count int, now time.Time) []StreamEntity {
+	ids := consumer.pel.ids[consumer.pel.seek(after, true):]
+	if count > 0 && len(ids) > count {
+		ids = ids[:count]
+	}
+	entries := make([]StreamEntity, 0, len(ids))
+	for _, id := range ids {
+		e, ok := st.entry(id)
+		if !ok {
+			e = StreamEntity{timestamp: id.timestamp, seq: id.seq}
+		}
+		entries = append(entries, e)
+		nack := consumer.pel.nacks[id]
+		nack.deliveryTime = now
+		nack.deliveryCount++
+	}
+	return entries
+}
+
+// emsgNoGroup 指定的消费者组不存在
+func emsgNoGroup(key, group string) string {
+	return fmt.Sprintf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
+}
+
+// emsgNoKeyOrGroup key 或消费者组不存在
+func emsgNoKeyOrGroup(key, group string) string {
+	return fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+// lookupStream 写命令读取 stream key 不存在时返回 nil 类型不对时返回 WRONGTYPE
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) lookupStream(db *database, key string) (*Entity, *Stream, error) {
+	entity, ok := s.rawGet(db, key)
+	if !ok {
+		return nil, nil, nil
+	}
+	if entity.Type != TypeStream {
+		return nil, nil, errors.New(emsgKeyType())
+	}
+	return entity, entity.Data.(*Stream), nil
+}
+
+// parseGroupID XGROUP CREATE/SETID 的 ID $ 表示 stream 最后的 ID
+func parseGroupID(raw string, stream *Stream) (streamID, error) {
+	if raw == "$" {
+		if stream == nil {
+			return streamID{}, nil
+		}
+		return stream.lastID(), nil
+	}
+	timestamp, seq, err := new(streamHelper).parseID(raw, true)
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{timestamp: timestamp, seq: seq}, nil
+}
+
+// parseEntriesRead XGROUP CREATE/SETID 的 ENTRIESREAD 选项的值
+func parseEntriesRead(arg *protocol.Value) (int64, error) {
+	n, err := strconv.ParseInt(arg.Bulk(), 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if n < -1 {
+		return 0, errors.New("ERR value for ENTRIESREAD must be positive or -1")
+	}
+	return n, nil
+}
+
+// HandleXGROUP
+// XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read]
+// XGROUP SETID key group id|$ [ENTRIESREAD entries-read]
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+// XGROUP HELP
+// 除 CREATE MKSTREAM 外 key 必须已经存在
+func (s *KVStore) HandleXGROUP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 1 {
+		return nil, errors.New(emsgArgsNumber("xgroup"))
+	}
+
+	sub := strings.ToUpper(args[0].Bulk())
+	switch {
+	case sub == "HELP" && len(args) == 1:
+		return helpReply("XGROUP",
+			"CREATE <key> <groupname> <id|$> [option]",
+			"    Create a new consumer group. Options are:",
+			"    * MKSTREAM",
+			"      Create the empty stream if it does not exist.",
+			"    * ENTRIESREAD entries_read",
+			"      Set the group's entries_read counter (internal use).",
+			"CREATECONSUMER <key> <groupname> <consumer>",
+			"    Create a new consumer in the specified group.",
+			"DELCONSUMER <key> <groupname> <consumer>",
+			"    Remove the specified consumer.",
+			"DESTROY <key> <groupname>",
+			"    Remove the specified group.",
+			"SETID <key> <groupname> <id|$> [ENTRIESREAD entries_read]",
+			"    Set the current group ID and entries_read counter.",
+		), nil
+	case sub == "CREATE" && len(args) >= 4 && len(args) <= 7,
+		sub == "SETID" && (len(args) == 4 || len(args) == 6),
+		sub == "DESTROY" && len(args) == 3,
+		(sub == "CREATECONSUMER" || sub == "DELCONSUMER") && len(args) == 4:
+	default:
+		return nil, errors.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try XGROUP HELP.", args[0].Bulk())
+	}
+
+	key, name := args[1].Bulk(), args[2].Bulk()
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, stream, err := s.lookupStream(c.db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先解析所有参数 出错时不能创建 key
+	mkstream := false
+	entriesRead := int64(-1)
+	var id streamID
+	if sub == "CREATE" || sub == "SETID" {
+		if id, err = parseGroupID(args[3].Bulk(), stream); err != nil {
+			return nil, err
+		}
+		// 选项可以以任意顺序出现
+		for i := 4; i < len(args); i++ {
+			switch opt := args[i].Bulk(); {
+			case sub == "CREATE" && strings.EqualFold(opt, "MKSTREAM"):
+				mkstream = true
+			case strings.EqualFold(opt, "ENTRIESREAD") && i+1 < len(args):
+				if entriesRead, err = parseEntriesRead(args[i+1]); err != nil {
+					return nil, err
+				}
+				i++
+			default:
+				return nil, errors.New("ERR syntax error")
+			}
+		}
+	}
+
+	if stream == nil {
+		if !mkstream {
+			return nil, errors.New("ERR The XGROUP subcommand requires the key to exist. " +
+				"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+		}
+		stream = &Stream{entities: make([]StreamEntity, 0)}
+		entity = &Entity{Type: TypeStream, Data: stream}
+		s.rawSet(c.db, key, entity)
+	}
+
+	group := stream.groups[name]
+	if group == nil && sub != "CREATE" && sub != "DESTROY" {
+		return nil, errors.New(emsgNoGroup(key, name))
+	}
+
+	var reply *protocol.Value
+	switch sub {
+	case "CREATE":
+		if group != nil {
+			return nil, errors.New("BUSYGROUP Consumer Group name already exists")
+		}
+		if stream.groups == nil {
+			stream.groups = make(map[string]*consumerGroup)
+		}
+		stream.groups[name] = newConsumerGroup(id, entriesRead)
+		reply = new(protocol.Value).SetStr("OK")
+	case "SETID":
+		group.lastID = id
+		group.entriesRead = entriesRead
+		reply = new(protocol.Value).SetStr("OK")
+	case "DESTROY":
+		if group == nil {
+			return new(protocol.Value).SetInteger(0), nil
+		}
+		delete(stream.groups, name)
+		// 阻塞在该组上的 XREADGROUP 收到 NOGROUP 错误
+		s.signalKeyAsReady(c.db, key)
+		reply = new(protocol.Value).SetInteger(1)
+	case "CREATECONSUMER":
+		_, created := group.lookupConsumer(args[3].Bulk(), true, s.clock.Now())
+		if !created {
+			return new(protocol.Value).SetInteger(0), nil
+		}
+		reply = new(protocol.Value).SetInteger(1)
+	case "DELCONSUMER":
+		consumer, _ := group.lookupConsumer(args[3].Bulk(), false, time.Time{})
+		if consumer == nil {
+			return new(protocol.Value).SetInteger(0), nil
+		}
+		reply = new(protocol.Value).SetInteger(group.deleteConsumer(consumer))
+	}
+
+	s.updateSize(c.db, key, entity)
+	s.dirty.Add(1)
+	s.propagate(c.db, append([]string{"XGROUP"}, bulkStrings(args)...)...)
+	return reply, nil
+}
+
+// propagateDelivery 把 XREADGROUP 投递的新条目以确定的形式写入 AOF 与 redis 一致
+// 每个加入 PEL 的条目写为一条 XCLAIM 保留投递时间 最后用 XGROUP SETID 写入 last-delivered-id 与 entries-read
+// 不能直接重放 XREADGROUP 那样投递时间会变成重放的时间
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) propagateDelivery(db *database, key, name string, g *consumerGroup, entries []StreamEntity, noack bool) {
+	s.dirty.Add(1)
+	if !noack {
+		for _, e := range entries {
+			id := streamID{timestamp: e.timestamp, seq: e.seq}
+			nack, _ := g.pel.get(id)
+			s.propagateClaim(db, key, name, g, id, nack)
+		}
+	}
+	s.propagateGroupID(db, key, name, g)
+}
+
+// serveGroupWaiter 服务阻塞在 key 上的 XREADGROUP 把组内的新条目投递给它 返回是否已经服务
+// 组已经被删除时以 NOGROUP 错误唤醒
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) serveGroupWaiter(db *database, key string, entity *Entity, waiter *streamWaiter) bool {
+	stream := entity.Data.(*Stream)
+	group := stream.groups[waiter.group]
+	if group == nil {
+		if waiter.done.CompareAndSwap(false, true) {
+			waiter.ch <- StreamPayload{key: key, err: errors.New("NOGROUP the consumer group this client was blocked on no longer exists")}
+		}
+		return true
+	}
+
+	entries := stream.entriesAfter(group.lastID, waiter.count)
+	if len(entries) == 0 {
+		return false
+	}
+	if !waiter.done.CompareAndSwap(false, true) {
+		return true
+	}
+
+	now := s.clock.Now()
+	// 阻塞期间消费者可能被 XGROUP DELCONSUMER 删除
+	consumer, created := group.lookupConsumer(waiter.consumer, true, now)
+	if created {
+		s.propagate(db, "XGROUP", "CREATECONSUMER", key, waiter.group, waiter.consumer)
+	}
+	consumer.seenTime = now
+	group.deliver(stream, consumer, entries, waiter.noack, now)
+	s.updateSize(db, key, entity)
+	s.propagateDelivery(db, key, waiter.group, group, entries, waiter.noack)
+
+	waiter.ch <- StreamPayload{key: key, entries: entries}
+	return true
+}
+
+// HandleXREADGROUP
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+// id 为 > 时读取组内还没有投递过的条目 投递给该消费者并加入 PEL(NOACK 时不加入)
+// 其他 ID 读取该消费者 PEL 中大于 ID 的条目 即已经投递但还没有确认的历史
+// 所有 ID 都是 > 并且没有新条目时 指定 BLOCK 阻塞等待 否则返回 nil
+// 消费者不存在时自动创建
+func (s *KVStore) HandleXREADGROUP(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	opts, err := parseXReadArgs(args, true)
+	if err != nil {
+		return nil, err
+	}
+	keys := opts.keys
+	n := len(keys)
+
+	after := make([]streamID, n)
+	helper := new(streamHelper)
+	for i, raw := range opts.ids {
+		switch raw {
+		case ">":
+			continue
+		case "$":
+			return nil, errors.New("ERR The $ ID is meaningless in the context of XREADGROUP: " +
+				"you want to read the history of this consumer by specifying a proper ID, " +
+				"or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		}
+		timestamp, seq, err := helper.parseID(raw, true)
+		if err != nil {
+			return nil, err
+		}
+		after[i] = streamID{timestamp: timestamp, seq: seq}
+	}
+
+	// 读取会修改组的状态 总是持有写锁
+	lk := s.lockKeys(c.db, keys...)
+
+	// 先检查所有的 key 与组 出错时不修改任何状态
+	entities := make([]*Entity, n)
+	for i, key := range keys {
+		entity, stream, err := s.lookupStream(c.db, key)
+		if err != nil {
+			lk.unlock()
+			return nil, err
+		}
+		if stream == nil || stream.groups[opts.group] == nil {
+			lk.unlock()
+			return nil, errors.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, opts.group)
+		}
+		entities[i] = entity
+	}
+
+	now := s.clock.Now()
+	history := false
+	results := make([]*protocol.Value, 0, n)
+	for i, key := range keys {
+		stream := entities[i].Data.(*Stream)
+		group := stream.groups[opts.group]
+		consumer, created := group.lookupConsumer(opts.consumer, true, now)
+		if created {
+			s.dirty.Add(1)
+			s.propagate(c.db, "XGROUP", "CREATECONSUMER", key, opts.group, opts.consumer)
+		}
+		consumer.seenTime = now
+
+		if opts.ids[i] != ">" {
+			// 历史总是返回 没有待确认的条目时为空数组
+			history = true
+			// 与 redis 一致 读取历史更新的投递时间与次数不写入 AOF
+			entries := stream.pendingHistory(consumer, after[i], opts.count, now)
+			results = append(results, streamReply(StreamPayload{key: key, entries: entries}))
+		} else if entries := stream.entriesAfter(group.lastID, opts.count); len(entries) > 0 {
+			group.deliver(stream, consumer, entries, opts.noack, now)
+			s.propagateDelivery(c.db, key, opts.group, group, entries, opts.noack)
+			results = append(results, streamReply(StreamPayload{key: key, entries: entries}))
+		}
+		s.updateSize(c.db, key, entities[i])
+	}
+
+	if len(results) > 0 || history || !opts.block {
+		lk.unlock()
+		if len(results) == 0 {
+			return new(protocol.Value).SetNullArray(), nil
+		}
+		return new(protocol.Value).SetArray(results), nil
+	}
+
+	// 阻塞等待组内的新条目
+	db := c.db
+	waiter := &streamWaiter{
+		ch:       make(chan StreamPayload, 1),
+		count:    opts.count,
+		group:    opts.group,
+		consumer: opts.consumer,
+		noack:    opts.noack,
+	}
+	waiting := make(map[string]struct{}, n)
 	for _, key := range keys {
-		entity, ok := s.store[key]
+		if _, dup := waiting[key]; dup {
+			continue
+		}
+		waiting[key] = struct{}{}
+		sh := db.shard(key)
+		sh.streamWaiters[key] = append(sh.streamWaiters[key], waiter)
+	}
+	bs := s.blockClient(c, keys)
+	lk.unlock()
+
+	cleanup := func() {
+		defer s.lockKeys(db, keys...).unlock()
+		for key := range waiting {
+			sh := db.shard(key)
+			waiters := slices.DeleteFunc(sh.streamWaiters[key], func(w *streamWaiter) bool {
+				return w == waiter
+			})
+			if len(waiters) == 0 {
+				delete(sh.streamWaiters, key)
+			} else {
+				sh.streamWaiters[key] = waiters
+			}
+		}
+	}
+
+	// 连接断开时投递的条目留在 PEL 中 之后可以由其他消费者认领
+	return awaitBlocked(s, c, bs, blockedWait[StreamPayload]{
+		ch:      waiter.ch,
+		done:    &waiter.done,
+		timeout: opts.timeout,
+		cleanup: cleanup,
+		reply: func(res StreamPayload) *protocol.Value {
+			if res.err != nil {
+				return new(protocol.Value).SetError(res.err.Error())
+			}
+			return new(protocol.Value).SetArray([]*protocol.Value{streamReply(res)})
+		},
+	})
+}
+
+// parseStreamIDs 解析 XACK 等命令中的多个 ID
+func parseStreamIDs(args []*protocol.Value) ([]streamID, error) {
+	helper := new(streamHelper)
+	ids := make([]streamID, 0, len(args))
+	for _, arg := range args {
+		timestamp, seq, err := helper.parseID(arg.Bulk(), true)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, streamID{timestamp: timestamp, seq: seq})
+	}
+	return ids, nil
+}
+
+// HandleXACK
+// XACK key group id [id ...]
+// 把条目从组的 PEL 中移除 返回实际确认的数量 key 或组不存在时返回 0
+func (s *KVStore) HandleXACK(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 3 {
+		return nil, errors.New(emsgArgsNumber("xack"))
+	}
+	key, name := args[0].Bulk(), args[1].Bulk()
+	ids, err := parseStreamIDs(args[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, stream, err := s.lookupStream(c.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil || stream.groups[name] == nil {
+		return new(protocol.Value).SetInteger(0), nil
+	}
+	group := stream.groups[name]
+
+	acked := 0
+	for _, id := range ids {
+		if group.ack(id) {
+			acked++
+		}
+	}
+	if acked > 0 {
+		s.updateSize(c.db, key, entity)
+		s.dirty.Add(1)
+		s.propagate(c.db, append([]string{"XACK"}, bulkStrings(args)...)...)
+	}
+	return new(protocol.Value).SetInteger(acked), nil
+}
+
+// parseIntervalID XPENDING 区间的边界 以 ( 开头时不包含该 ID
+func parseIntervalID(raw string, isStart bool) (streamID, error) {
+	exclusive := strings.HasPrefix(raw, "(")
+	if exclusive {
+		raw = raw[1:]
+	}
+	timestamp, seq, err := new(streamHelper).parseID(raw, isStart)
+	if err != nil {
+		return streamID{}, err
+	}
+	id := streamID{timestamp: timestamp, seq: seq}
+	if !exclusive {
+		return id, nil
+	}
+
+	ok := false
+	if isStart {
+		if id, ok = id.next(); !ok {
+			return streamID{}, errors.New("ERR invalid start ID for the interval")
+		}
+	} else if id, ok = id.prev(); !ok {
+		return streamID{}, errors.New("ERR invalid end ID for the interval")
+	}
+	return id, nil
+}
+
+// HandleXPENDING
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+// 只有 key 与 group 时返回摘要 [数量, 最小 ID, 最大 ID, [[消费者, 数量], ...]]
+// 否则返回区间内的待确认条目 [[id, 消费者, 空闲毫秒数, 投递次数], ...]
+// IDLE 只返回空闲时间不小于 min-idle-time 毫秒的条目 指定消费者时只返回该消费者的条目
+func (s *KVStore) HandleXPENDING(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 2 {
+		return nil, errors.New(emsgArgsNumber("xpending"))
+	}
+	key, name := args[0].Bulk(), args[1].Bulk()
+
+	extended := len(args) > 2
+	var minIdle time.Duration
+	var start, end streamID
+	count := 0
+	consumerName := ""
+	if extended {
+		rest := args[2:]
+		if strings.EqualFold(rest[0].Bulk(), "IDLE") && len(rest) > 1 {
+			ms, err := rest[1].BulkToInteger()
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			minIdle = time.Duration(ms) * time.Millisecond
+			rest = rest[2:]
+		}
+		if len(rest) != 3 && len(rest) != 4 {
+			return nil, errors.New("ERR syntax error")
+		}
+		var err error
+		if start, err = parseIntervalID(rest[0].Bulk(), true); err != nil {
+			return nil, err
+		}
+		if end, err = parseIntervalID(rest[1].Bulk(), false); err != nil {
+			return nil, err
+		}
+		if count, err = rest[2].BulkToInteger(); err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		count = max(count, 0)
+		if len(rest) == 4 {
+			consumerName = rest[3].Bulk()
+		}
+	}
+
+	defer s.rlockKeys(c.db, key).unlock()
+
+	entity, ok := s.rawLookup(c.db, key)
+	if ok && entity.Type != TypeStream {
+		return nil, errors.New(emsgKeyType())
+	}
+	var group *consumerGroup
+	if ok {
+		group = entity.Data.(*Stream).groups[name]
+	}
+	if group == nil {
+		return nil, errors.New(emsgNoKeyOrGroup(key, name))
+	}
+
+	if !extended {
+		return pendingSummary(group), nil
+	}
+
+	pel := group.pel
+	if consumerName != "" {
+		consumer, ok := group.consumers[consumerName]
 		if !ok {
 			return new(protocol.Value).SetEmptyArray(), nil
 		}
-		if entity.Type != TypeStream {
-			return nil, errors.New(emsgKeyType())
+		pel = consumer.pel
+	}
+
+	now := s.clock.Now()
+	results := make([]*protocol.Value, 0)
+	for _, id := range pel.ids[pel.seek(start, false):] {
+		if len(results) >= count || id.compare(end) > 0 {
+			break
+		}
+		nack := pel.nacks[id]
+		idle := now.Sub(nack.deliveryTime)
+		if idle < minIdle {
+			continue
+		}
+		results = append(results, new(protocol.Value).SetArray([]*protocol.Value{
+			new(protocol.Value).SetBulk(id.String()),
+			new(protocol.Value).SetBulk(nack.consumer.name),
+			new(protocol.Value).SetInteger(int(max(idle.Milliseconds(), 0))),
+			new(protocol.Value).SetInteger(int(nack.deliveryCount)),
+		}))
+	}
+	return new(protocol.Value).SetArray(results), nil
+}
+
+// pendingSummary XPENDING 的摘要形式 消费者按名称排序 没有待确认条目的消费者不出现
+func pendingSummary(group *consumerGroup) *protocol.Value {
+	pel := group.pel
+	if pel.len() == 0 {
+		return new(protocol.Value).SetArray([]*protocol.Value{
+			new(protocol.Value).SetInteger(0),
+			new(protocol.Value).SetNullBulk(),
+			new(protocol.Value).SetNullBulk(),
+			new(protocol.Value).SetNullArray(),
+		})
+	}
+
+	names := make([]string, 0, len(group.consumers))
+	for name, consumer := range group.consumers {
+		if consumer.pel.len() > 0 {
+			names = append(names, name)
 		}
-		stream := entity.Data.(*Stream)
-		helper := new(streamHelper)
+	}
+	slices.Sort(names)
+	consumers := make([]*protocol.Value, 0, len(names))
+	for _, name := range names {
+		consumers = append(consumers, new(protocol.Value).SetArray([]*protocol.Value{
+			new(protocol.Value).SetBulk(name),
+			new(protocol.Value).SetBulk(strconv.Itoa(group.consumers[name].pel.len())),
+		}))
+	}
 
-		startTimestamp, startSeq, err := helper.parseID(startID, true)
+	return new(protocol.Value).SetArray([]*protocol.Value{
+		new(protocol.Value).SetInteger(pel.len()),
+		new(protocol.Value).SetBulk(pel.ids[0].String()),
+		new(protocol.Value).SetBulk(pel.ids[pel.len()-1].String()),
+		new(protocol.Value).SetArray(consumers),
+	})
+}
+
+// parseStrictID 解析完整的 ID 不接受 - 与 +
+func parseStrictID(raw string) (streamID, error) {
+	if raw == "-" || raw == "+" {
+		return streamID{}, errors.New("ERR Invalid stream ID specified as stream command argument")
+	}
+	timestamp, seq, err := new(streamHelper).parseID(raw, true)
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{timestamp: timestamp, seq: seq}, nil
+}
+
+// parseMinIdle XCLAIM 与 XAUTOCLAIM 的 min-idle-time 负数视为 0
+func parseMinIdle(arg *protocol.Value, cmd string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(arg.Bulk(), 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("ERR Invalid min-idle-time argument for %s", cmd)
+	}
+	return time.Duration(max(ms, 0)) * time.Millisecond, nil
+}
+
+// propagateClaim 把一个条目的认领以确定的形式写入 AOF 与 redis 的 streamPropagateXCLAIM 相同
+// 重放时不再检查空闲时间 投递时间与次数使用认领之后的值 条目已经被删除时重放同样会把它移出 PEL
+// 外部必须持有 key 所在分片的写锁
+func (s *KVStore) propagateClaim(db *database, key, group string, g *consumerGroup, id streamID, nack *streamNACK) {
+	s.propagate(db, "XCLAIM", key, group, nack.consumer.name, "0", id.String(),
+		"TIME", strconv.FormatInt(nack.deliveryTime.UnixMilli(), 10),
+		"RETRYCOUNT", strconv.FormatInt(nack.deliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", g.lastID.String())
+}
+
+// HandleXCLAIM
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+// [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+// 把空闲时间不小于 min-idle-time 的待确认条目转移给 consumer 返回认领的条目 JUSTID 时只返回 ID
+// 认领会更新投递时间 并在没有 JUSTID 时增加投递次数 IDLE/TIME/RETRYCOUNT 直接指定这些值
+// FORCE 时不在 PEL 中但仍然存在的条目也会被加入 PEL
+// LASTID 大于组的 last-delivered-id 时更新它
+// 已经从 stream 中删除的条目从 PEL 中移除 不出现在回复中
+func (s *KVStore) HandleXCLAIM(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 5 {
+		return nil, errors.New(emsgArgsNumber("xclaim"))
+	}
+	key, name, consumerName := args[0].Bulk(), args[1].Bulk(), args[2].Bulk()
+	minIdle, err := parseMinIdle(args[3], "XCLAIM")
+	if err != nil {
+		return nil, err
+	}
+
+	// ID 一直到第一个无法解析为 ID 的参数为止 之后都是选项
+	i := 4
+	ids := make([]streamID, 0, len(args)-i)
+	for ; i < len(args); i++ {
+		id, err := parseStrictID(args[i].Bulk())
 		if err != nil {
-			return nil, errors.WithStack(err)
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := s.clock.Now()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justid := false, false
+	var lastID streamID
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk())
+		hasValue := i+1 < len(args)
+		switch {
+		case opt == "FORCE":
+			force = true
+		case opt == "JUSTID":
+			justid = true
+		case opt == "IDLE" && hasValue:
+			ms, err := strconv.ParseInt(args[i+1].Bulk(), 10, 64)
+			if err != nil {
+				return nil, errors.New("ERR Invalid IDLE option argument for XCLAIM")
+			}
+			deliveryTime = now.Add(-time.Duration(ms) * time.Millisecond)
+			i++
+		case opt == "TIME" && hasValue:
+			ms, err := strconv.ParseInt(args[i+1].Bulk(), 10, 64)
+			if err != nil {
+				return nil, errors.New("ERR Invalid TIME option argument for XCLAIM")
+			}
+			deliveryTime = time.UnixMilli(ms)
+			i++
+		case opt == "RETRYCOUNT" && hasValue:
+			n, err := strconv.ParseInt(args[i+1].Bulk(), 10, 64)
+			if err != nil {
+				return nil, errors.New("ERR Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+			retryCount = n
+			i++
+		case opt == "LASTID" && hasValue:
+			if lastID, err = parseStrictID(args[i+1].Bulk()); err != nil {
+				return nil, err
+			}
+			i++
+		default:
+			return nil, errors.Errorf("ERR Unrecognized XCLAIM option '%s'", args[i].Bulk())
 		}
+	}
+	// 与 redis 一致 投递时间不能晚于当前时间
+	if deliveryTime.After(now) || deliveryTime.UnixMilli() < 0 {
+		deliveryTime = now
+	}
 
-		index := helper.findStartIndex(stream.entities, startTimestamp, startSeq, true)
+	defer s.lockKeys(c.db, key).unlock()
 
-		// 如果没有找到符合条件的条目，返回空数组
-		if index >= len(stream.entities) {
-			return new(protocol.Value).SetNullArray(), nil
+	entity, stream, err := s.lookupStream(c.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil || stream.groups[name] == nil {
+		return nil, errors.New(emsgNoKeyOrGroup(key, name))
+	}
+	group := stream.groups[name]
+
+	changed := false
+	propagateLastID := false
+	if lastID.compare(group.lastID) > 0 {
+		group.lastID = lastID
+		changed, propagateLastID = true, true
+	}
+
+	var consumer *streamConsumer
+	results := make([]*protocol.Value, 0, len(ids))
+	for _, id := range ids {
+		nack, pending := group.pel.get(id)
+		entry, exists := stream.entry(id)
+		if !exists {
+			// 条目已经被删除 从 PEL 中移除
+			if pending {
+				s.propagateClaim(c.db, key, name, group, id, nack)
+				group.ack(id)
+				changed, propagateLastID = true, false
+			}
+			continue
 		}
 
-		target := stream.entities[index]
+		if !pending {
+			if !force {
+				continue
+			}
+			// FORCE 创建的条目没有之前的投递 不检查空闲时间
+			nack = &streamNACK{deliveryCount: 1}
+			group.pel.add(id, nack)
+		} else if minIdle > 0 && now.Sub(nack.deliveryTime) < minIdle {
+			continue
+		}
 
-		// 构建单个条目: [id, [field1, value1, field2, value2]]
-		entryID := new(protocol.Value).SetBulk(fmt.Sprintf("%d-%d", target.timestamp, target.seq))
+		if consumer == nil {
+			consumer, _ = group.lookupConsumer(consumerName, true, now)
+			consumer.seenTime = now
+		}
+		group.claim(id, nack, consumer)
+		nack.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			nack.deliveryCount = retryCount
+		} else if !justid {
+			nack.deliveryCount++
+		}
 
-		fieldArr := new(protocol.Value).SetEmptyArray()
-		for _, v := range target.Fields {
-			fieldArr.Append(new(protocol.Value).SetBulk(v))
+		if justid {
+			results = append(results, new(protocol.Value).SetBulk(id.String()))
+		} else {
+			results = append(results, streamEntryValue(entry))
 		}
+		s.propagateClaim(c.db, key, name, group, id, nack)
+		changed, propagateLastID = true, false
+	}
 
-		// 单个条目数组: [id, fields]
-		singleEntry := new(protocol.Value).SetEmptyArray().Append(entryID, fieldArr)
+	if changed {
+		s.updateSize(c.db, key, entity)
+		s.dirty.Add(1)
+	}
+	if propagateLastID {
+		s.propagateGroupID(c.db, key, name, group)
+	}
+	return new(protocol.Value).SetArray(results), nil
+}
 
-		// 该 key 的所有条目数组: [[id1, fields1], [id2, fields2], ...]
-		entriesArray := new(protocol.Value).SetEmptyArray().Append(singleEntry)
+// propagateGroupID 把组的 last-delivered-id 与 entries-read 写入 AOF
+func (s *KVStore) propagateGroupID(db *database, key, name string, g *consumerGroup) {
+	s.propagate(db, "XGROUP", "SETID", key, name, g.lastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10))
+}
 
-		// 键值对: [key, entries]
-		// 键值对: [key, entries]
-		keyArr := new(protocol.Value).SetEmptyArray().Append(new(protocol.Value).SetBulk(key), entriesArray)
+// HandleXAUTOCLAIM
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+// 从 start 开始扫描组的 PEL 把空闲时间不小于 min-idle-time 的条目转移给 consumer 最多 count 个 默认 100
+// 最多检查 count*10 个条目 返回 [下一次扫描的起点, 认领的条目, 已经被删除的条目 ID]
+// 扫描到 PEL 末尾时起点为 0-0 已经被删除的条目从 PEL 中移除 同样计入 count
+func (s *KVStore) HandleXAUTOCLAIM(c *Client, args []*protocol.Value) (*protocol.Value, error) {
+	if len(args) < 5 {
+		return nil, errors.New(emsgArgsNumber("xautoclaim"))
+	}
+	key, name, consumerName := args[0].Bulk(), args[1].Bulk(), args[2].Bulk()
+	minIdle, err := parseMinIdle(args[3], "XAUTOCLAIM")
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseIntervalID(args[4].Bulk(), true)
+	if err != nil {
+		return nil, err
+	}
 
-		result.Append(keyArr)
+	// attemptsFactor 每认领一个条目最多检查的 PEL 条目数 避免空闲条目很少时扫描整个 PEL
+	const attemptsFactor = 10
+	count := 100
+	justid := false
+	for i := 5; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i].Bulk()); {
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := args[i+1].BulkToInteger()
+			if err != nil {
+				return nil, errors.New("ERR value is not an integer or out of range")
+			}
+			if n < 1 || n > math.MaxInt/attemptsFactor {
+				return nil, errors.New("ERR COUNT must be > 0")
+			}
+			count = n
+			i++
+		case opt == "JUSTID":
+			justid = true
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
 	}
-	// [
-	//   [
-	//     "some_key",
-	//     [
-	//       [
-	//         "1526985054079-0",
-	//         [
-	//           "temperature",
-	//           "37",
-	//           "humidity",
-	//           "94"
-	//         ]
-	//       ]
-	//     ]
-	//   ]
-	// ]
 
-	return result, nil
+	defer s.lockKeys(c.db, key).unlock()
+
+	entity, stream, err := s.lookupStream(c.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if stream == nil || stream.groups[name] == nil {
+		return nil, errors.New(emsgNoKeyOrGroup(key, name))
+	}
+	group := stream.groups[name]
+
+	now := s.clock.Now()
+	var consumer *streamConsumer
+	claimed := make([]*protocol.Value, 0)
+	deleted := make([]*protocol.Value, 0)
+	attempts := count * attemptsFactor
+	pel := group.pel
+	i := pel.seek(start, false)
+	for ; attempts > 0 && count > 0 && i < pel.len(); attempts-- {
+		id := pel.ids[i]
+		nack := pel.nacks[id]
+		entry, exists := stream.entry(id)
+		if !exists {
+			// 条目已经被删除 从 PEL 中移除 之后的条目前移到 i
+			s.propagateClaim(c.db, key, name, group, id, nack)
+			group.ack(id)
+			deleted = append(deleted, new(protocol.Value).SetBulk(id.String()))
+			count--
+			continue
+		}
+		i++
+		if minIdle > 0 && now.Sub(nack.deliveryTime) < minIdle {
+			continue
+		}
+
+		if consumer == nil {
+			consumer, _ = group.lookupConsumer(consumerName, true, now)
+			consumer.seenTime = now
+		}
+		group.claim(id, nack, consumer)
+		nack.deliveryTime = now
+		if !justid {
+			nack.deliveryCount++
+		}
+
+		if justid {
+			claimed = append(claimed, new(protocol.Value).SetBulk(id.String()))
+		} else {
+			claimed = append(claimed, streamEntryValue(entry))
+		}
+		s.propagateClaim(c.db, key, name, group, id, nack)
+		count--
+	}
+
+	if len(claimed) > 0 || len(deleted) > 0 {
+		s.updateSize(c.db, key, entity)
+		s.dirty.Add(1)
+	}
+
+	next := streamID{}
+	if i < pel.len() {
+		next = pel.ids[i]
+	}
+	return new(protocol.Value).SetArray([]*protocol.Value{
+		new(protocol.Value).SetBulk(next.String()),
+		new(protocol.Value).SetArray(claimed),
+		new(protocol.Value).SetArray(deleted),
+	}), nil
 }
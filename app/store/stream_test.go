@@ -0,0 +1,114 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// XGROUP CREATE 的选项可以以任意顺序出现
+func TestXGroupCreateOptionsAnyOrder(t *testing.T) {
+	s := newTestStore(t, "locked", Options{})
+	c := s.NewClient()
+
+	for _, args := range [][]string{
+		{"CREATE", "s1", "g", "$", "MKSTREAM", "ENTRIESREAD", "0"},
+		{"CREATE", "s2", "g", "$", "ENTRIESREAD", "0", "MKSTREAM"},
+	} {
+		if _, err := c.call(s.HandleXGROUP, args...); err != nil {
+			t.Fatalf("XGROUP %v: %v", args, err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"CREATE", "s3", "g", "$", "ENTRIESREAD"},
+		{"CREATE", "s3", "g", "$", "MKSTREAM", "NOSUCHOPTION"},
+		{"SETID", "s1", "g", "$", "MKSTREAM", "ENTRIESREAD"},
+	} {
+		if _, err := c.call(s.HandleXGROUP, args...); err == nil {
+			t.Fatalf("XGROUP %v: expected an error", args)
+		}
+	}
+	if n, _ := s.Exists("s1", "s2", "s3"); n != 2 {
+		t.Fatalf("EXISTS = %d, want 2", n)
+	}
+}
+
+// stream 被删除或者被覆盖时 阻塞的 XREADGROUP 返回错误 阻塞的 XREAD 继续等待
+func TestXReadGroupUnblockedWhenStreamDeleted(t *testing.T) {
+	cases := map[string]struct {
+		remove func(c *Client) error
+		want   string
+	}{
+		"del": {
+			remove: func(c *Client) error { _, err := c.Del("s"); return err },
+			want:   "UNBLOCKED the stream key no longer exists",
+		},
+		"set": {
+			remove: func(c *Client) error { return c.Set("s", "v", 0) },
+			want:   "WRONGTYPE Operation against a key holding the wrong kind of value",
+		},
+		"flushdb": {
+			remove: func(c *Client) error { _, err := c.call(c.s.HandleFLUSHDB); return err },
+			want:   "UNBLOCKED the stream key no longer exists",
+		},
+	}
+	for _, mode := range executionModes {
+		for name, tc := range cases {
+			t.Run(mode+"/"+name, func(t *testing.T) {
+				s := newTestStore(t, mode, Options{})
+				c := s.NewClient()
+				if _, err := c.call(s.HandleXGROUP, "CREATE", "s", "g", "$", "MKSTREAM"); err != nil {
+					t.Fatal(err)
+				}
+
+				group := s.NewClient()
+				groupErr := make(chan error, 1)
+				go func() {
+					_, err := group.call(s.HandleXREADGROUP, "GROUP", "g", "x", "BLOCK", "0", "STREAMS", "s", ">")
+					groupErr <- err
+				}()
+				waitBlocked(t, group)
+
+				reader := s.NewClient()
+				readerErr := make(chan error, 1)
+				go func() {
+					_, err := reader.call(s.HandleXREAD, "BLOCK", "0", "STREAMS", "s", "$")
+					readerErr <- err
+				}()
+				waitBlocked(t, reader)
+
+				if err := tc.remove(c); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case err := <-groupErr:
+					if err == nil || err.Error() != tc.want {
+						t.Fatalf("XREADGROUP error = %v, want %q", err, tc.want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("XREADGROUP is still blocked")
+				}
+
+				select {
+				case err := <-readerErr:
+					t.Fatalf("XREAD returned %v, want it to keep waiting", err)
+				case <-time.After(50 * time.Millisecond):
+				}
+				if _, err := c.Del("s"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := c.XAdd("s", "1-1", "f", "v"); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case err := <-readerErr:
+					if err != nil {
+						t.Fatal(err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("XREAD is still blocked after XADD")
+				}
+			})
+		}
+	}
+}
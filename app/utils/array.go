@@ -13,15 +13,13 @@ func NormalizeRange(start, stop int, len int) (int, int) {
 	}
 
 	// 2. 处理负数越界（例如长度5，索引-100 -> -95，需要修正为0）
+	// stop 不需要修正 仍为负数时区间在列表之前 会在第4步成为无效区间
 	if start < 0 {
 		start = 0
 	}
-	if stop < 0 {
-		stop = 0
-	}
 
 	// 3. 处理 stop 越界（超过长度）
-	if stop > len {
+	if stop >= len {
 		stop = len - 1
 	}
 
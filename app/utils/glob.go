@@ -0,0 +1,126 @@
+package utils
+
+// GlobMatch 判断 str 是否匹配 glob 风格的 pattern 与 redis 的 stringmatchlen 行为一致
+// 支持 * ? [abc] [^abc] [a-z] 以及使用 \ 转义特殊字符
+func GlobMatch(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return globMatch(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func globMatch(pattern, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	// 防止恶意构造的模式导致递归过深
+	if nesting > 1000 {
+		return false
+	}
+
+	// at 越界时返回 0 对应 C 字符串末尾的 '\0'
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	equal := func(a, b byte) bool {
+		if nocase {
+			return lower(a) == lower(b)
+		}
+		return a == b
+	}
+
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for at(pattern, p+1) == '*' {
+				p++
+			}
+			if p == len(pattern)-1 {
+				return true
+			}
+			for ; s < len(str); s++ {
+				if globMatch(pattern[p+1:], str[s:], nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+			}
+			// 剩余的模式从字符串的任何位置开始都无法匹配
+			// 前面的 * 匹配更长的子串也不可能成功 可以直接结束搜索
+			*skipLongerMatches = true
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := at(pattern, p) == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if at(pattern, p) == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if at(pattern, p) == ']' {
+					break
+				} else if p >= len(pattern) {
+					// 缺少右括号 视为到达模式末尾
+					p--
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start, end, c := pattern[p], pattern[p+2], str[s]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = lower(start), lower(end), lower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equal(pattern[p], str[s]) {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if len(pattern)-p >= 2 {
+				p++
+			}
+			fallthrough
+		default:
+			if !equal(pattern[p], str[s]) {
+				return false
+			}
+			s++
+		}
+
+		p++
+		if s == len(str) {
+			for at(pattern, p) == '*' {
+				p++
+			}
+			break
+		}
+	}
+
+	return p >= len(pattern) && s == len(str)
+}